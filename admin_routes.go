@@ -0,0 +1,242 @@
+package usermod
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var AdminDefaultPageSize = 50
+var AdminMaxPageSize = 200
+
+// AdminUserJSON exposes the account state hidden from the user's own view
+type AdminUserJSON struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	PhoneNumber string `json:"phone"`
+	IsActivated bool   `json:"activated"`
+	IsDeleted   bool   `json:"deleted"`
+	IsDisabled  bool   `json:"disabled"`
+}
+
+type AdminUserListJSON struct {
+	Users  []AdminUserJSON `json:"users"`
+	Total  int             `json:"total"`
+	Limit  int             `json:"limit"`
+	Offset int             `json:"offset"`
+}
+
+func newAdminUserJSON(u *User) AdminUserJSON {
+	return AdminUserJSON{
+		ID:          u.ID.String(),
+		Name:        u.Name,
+		Email:       u.Email,
+		PhoneNumber: u.PhoneNumber,
+		IsActivated: u.IsActivated,
+		IsDeleted:   u.IsDeleted,
+		IsDisabled:  u.IsDisabled,
+	}
+}
+
+// adminRouter manages every user, and is only reachable by holders of
+// AdminRole
+func (rr *Router) adminRouter(auth func(http.Handler) http.Handler) http.Handler {
+	r := chi.NewRouter()
+	r.Use(auth, RequireRole(rr.store, AdminRole))
+	r.Get("/users", rr.AdminListUsers)
+	r.Get("/users/{id}", rr.AdminGetUser)
+	r.Delete("/users/{id}", rr.AdminDeleteUser)
+	r.Post("/users/{id}/activate", rr.AdminActivateUser)
+	r.Post("/users/{id}/deactivate", rr.AdminDeactivateUser)
+	r.Post("/users/{id}/restore", rr.AdminRestoreUser)
+	r.Post("/users/{id}/reset_password", rr.AdminResetPassword)
+	r.Post("/users/{id}/unlock", rr.AdminUnlockUser)
+	if rr.oidc != nil {
+		r.Post("/oauth/clients", rr.AdminCreateOAuthClient)
+		r.Delete("/oauth/clients/{id}", rr.AdminDeleteOAuthClient)
+	}
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// parseBool parses an optional boolean query parameter
+func parseBool(s string) (*bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// parseInt parses an optional non-negative integer query parameter
+func parseInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err == nil && i < 0 {
+		err = strconv.ErrRange
+	}
+	return i, err
+}
+
+// AdminListUsers pages through users, filtered by the email, name,
+// activated, deleted and disabled query parameters
+func (rr *Router) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := UserFilter{Email: q.Get("email"), Name: q.Get("name")}
+
+	var err error
+	if filter.Activated, err = parseBool(q.Get("activated")); err != nil {
+		jsonErrorFromString(w, "invalid activated filter", http.StatusBadRequest)
+		return
+	}
+	if filter.Deleted, err = parseBool(q.Get("deleted")); err != nil {
+		jsonErrorFromString(w, "invalid deleted filter", http.StatusBadRequest)
+		return
+	}
+	if filter.Disabled, err = parseBool(q.Get("disabled")); err != nil {
+		jsonErrorFromString(w, "invalid disabled filter", http.StatusBadRequest)
+		return
+	}
+	if filter.Limit, err = parseInt(q.Get("limit"), AdminDefaultPageSize); err != nil || filter.Limit == 0 {
+		jsonErrorFromString(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if filter.Offset, err = parseInt(q.Get("offset"), 0); err != nil {
+		jsonErrorFromString(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	filter.Limit = min(filter.Limit, AdminMaxPageSize)
+
+	users, total, err := rr.store.ListUsers(r.Context(), filter)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := AdminUserListJSON{Users: []AdminUserJSON{}, Total: total, Limit: filter.Limit, Offset: filter.Offset}
+	for _, u := range users {
+		res.Users = append(res.Users, newAdminUserJSON(u))
+	}
+	writeJSON(w, res)
+}
+
+// adminUser loads the user named in the url, writing a 404 if there is none
+func (rr *Router) adminUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	u, err := rr.store.GetUserByID(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		jsonErrorFromString(w, "user not found", http.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+func (rr *Router) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := rr.adminUser(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, newAdminUserJSON(u))
+}
+
+// adminUpdate applies fn to the user named in the url, and responds with
+// the updated user
+func (rr *Router) adminUpdate(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, u *User) error) {
+	u, ok := rr.adminUser(w, r)
+	if !ok {
+		return
+	}
+	if err := fn(r.Context(), u); err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	u, ok = rr.adminUser(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, newAdminUserJSON(u))
+}
+
+// AdminActivateUser activates the user, and lifts a deactivation
+func (rr *Router) AdminActivateUser(w http.ResponseWriter, r *http.Request) {
+	rr.adminUpdate(w, r, func(ctx context.Context, u *User) error {
+		if err := rr.store.Activate(ctx, u.ID.String()); err != nil {
+			return err
+		}
+		return rr.store.SetDisabled(ctx, u.ID.String(), false)
+	})
+}
+
+// AdminDeactivateUser disables the user until an admin activates them
+// again. It is kept apart from activation, so that the user's own
+// activation tokens can't lift it.
+func (rr *Router) AdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	rr.adminUpdate(w, r, func(ctx context.Context, u *User) error {
+		if err := rr.store.SetDisabled(ctx, u.ID.String(), true); err != nil {
+			return err
+		}
+		return rr.tokens.RevokeUserTokens(ctx, u.ID.String())
+	})
+}
+
+func (rr *Router) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	rr.adminUpdate(w, r, func(ctx context.Context, u *User) error {
+		if err := rr.store.SoftDeleteUser(ctx, u.ID.String()); err != nil {
+			return err
+		}
+		return rr.tokens.RevokeUserTokens(ctx, u.ID.String())
+	})
+}
+
+func (rr *Router) AdminRestoreUser(w http.ResponseWriter, r *http.Request) {
+	rr.adminUpdate(w, r, func(ctx context.Context, u *User) error {
+		return rr.store.RestoreUser(ctx, u.ID.String())
+	})
+}
+
+// AdminUnlockUser lifts a lockout early, and forgets the failed logins
+// that led to it
+func (rr *Router) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	rr.adminUpdate(w, r, func(ctx context.Context, u *User) error {
+		return rr.lockout.Unlock(ctx, u)
+	})
+}
+
+// AdminResetPassword locks the user out of their current password, ends
+// their sessions, and sends them a password reset token.
+func (rr *Router) AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	rr.adminUpdate(w, r, func(ctx context.Context, u *User) error {
+		uid := u.ID.String()
+		if err := rr.store.SetPassword(ctx, uid, nil); err != nil {
+			return err
+		}
+		if err := rr.signOutEverywhere(ctx, u.ID); err != nil {
+			return err
+		}
+
+		uot := NewUserOperationTokenInStore(rr.store, u.ID, ForgotPaswordToken, time.Now().Add(TokenDefaultExpiry))
+		if err := uot.Insert(); err != nil {
+			return err
+		}
+		return rr.notify(ctx, u, uot)
+	})
+}
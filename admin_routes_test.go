@@ -0,0 +1,219 @@
+package usermod_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) newAdmin() *usermod.User {
+	ctx := context.Background()
+	u := usermod.NewUserWithDetails(s.db, "Admin", "admin@ummmfoo.com", testPassword)
+	assert.Nil(s.T(), u.Insert())
+	assert.Nil(s.T(), usermod.Activate(s.db, u.ID.String()))
+	assert.Nil(s.T(), s.store.CreateRole(ctx, usermod.AdminRole))
+	assert.Nil(s.T(), s.store.GrantRole(ctx, u.ID.String(), usermod.AdminRole))
+	return u
+}
+
+func (s *UserModTestSuite) adminRequest(u *usermod.User, method, path string) *http.Response {
+	r, _ := http.NewRequest(method, s.ts.URL+"/api/admin"+path, nil)
+	auth := u.Email + ":" + string(testPassword)
+	r.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	w, _ := http.DefaultClient.Do(r)
+	return w
+}
+
+func (s *UserModTestSuite) TestAdminRequiresRole() {
+	u := s.newActivatedUser()
+	w := s.adminRequest(u, http.MethodGet, "/users")
+	assert.Equal(s.T(), http.StatusForbidden, w.StatusCode)
+
+	r, _ := http.NewRequest(http.MethodGet, s.ts.URL+"/api/admin/users", nil)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestAdminListUsers() {
+	admin := s.newAdmin()
+	for i := 0; i < 5; i++ {
+		u := usermod.NewUserWithDetails(s.db, fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@ummmfoo.com", i), testPassword)
+		assert.Nil(s.T(), u.Insert())
+		if i%2 == 0 {
+			assert.Nil(s.T(), usermod.Activate(s.db, u.ID.String()))
+		}
+		if i == 4 {
+			assert.Nil(s.T(), u.SoftDeleteByUID(u.ID.String()))
+		}
+	}
+	odd := usermod.NewUserWithDetails(s.db, "Percent", "100%_sure@ummmfoo.com", testPassword)
+	assert.Nil(s.T(), odd.Insert())
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		total  int
+		count  int
+		first  string
+	}{{
+		name:   "everyone",
+		query:  "",
+		status: http.StatusOK,
+		total:  7,
+		count:  7,
+		first:  "100%_sure@ummmfoo.com",
+	}, {
+		name:   "paginated",
+		query:  "limit=2&offset=3",
+		status: http.StatusOK,
+		total:  7,
+		count:  2,
+		first:  "user1@ummmfoo.com",
+	}, {
+		name:   "email substring, case insensitive",
+		query:  "email=USER",
+		status: http.StatusOK,
+		total:  5,
+		count:  5,
+		first:  "user0@ummmfoo.com",
+	}, {
+		name:   "wildcards are literal",
+		query:  "email=%25_",
+		status: http.StatusOK,
+		total:  1,
+		count:  1,
+		first:  "100%_sure@ummmfoo.com",
+	}, {
+		name:   "name",
+		query:  "name=user+3",
+		status: http.StatusOK,
+		total:  1,
+		count:  1,
+		first:  "user3@ummmfoo.com",
+	}, {
+		name:   "activated and not deleted",
+		query:  "activated=true&deleted=false",
+		status: http.StatusOK,
+		total:  3,
+		count:  3,
+		first:  "admin@ummmfoo.com",
+	}, {
+		name:   "deleted",
+		query:  "deleted=true",
+		status: http.StatusOK,
+		total:  1,
+		count:  1,
+		first:  "user4@ummmfoo.com",
+	}, {
+		name:   "bad filter",
+		query:  "activated=maybe",
+		status: http.StatusBadRequest,
+	}, {
+		name:   "bad limit",
+		query:  "limit=-1",
+		status: http.StatusBadRequest,
+	}}
+
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			w := s.adminRequest(admin, http.MethodGet, "/users?"+tc.query)
+			assert.Equal(t, tc.status, w.StatusCode)
+			if tc.status != http.StatusOK {
+				return
+			}
+			res := usermod.AdminUserListJSON{}
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(&res))
+			assert.Equal(t, tc.total, res.Total)
+			assert.Equal(t, tc.count, len(res.Users))
+			assert.Equal(t, tc.first, res.Users[0].Email)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestAdminManageUser() {
+	admin := s.newAdmin()
+	u := s.newUser()
+	path := "/users/" + u.ID.String()
+
+	state := func(w *http.Response) usermod.AdminUserJSON {
+		assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+		res := usermod.AdminUserJSON{}
+		json.NewDecoder(w.Body).Decode(&res)
+		return res
+	}
+
+	assert.False(s.T(), state(s.adminRequest(admin, http.MethodGet, path)).IsActivated)
+	assert.True(s.T(), state(s.adminRequest(admin, http.MethodPost, path+"/activate")).IsActivated)
+	disabled := state(s.adminRequest(admin, http.MethodPost, path+"/deactivate"))
+	assert.True(s.T(), disabled.IsDisabled)
+	assert.True(s.T(), disabled.IsActivated)
+	assert.False(s.T(), state(s.adminRequest(admin, http.MethodPost, path+"/activate")).IsDisabled)
+	assert.True(s.T(), state(s.adminRequest(admin, http.MethodDelete, path)).IsDeleted)
+	assert.False(s.T(), state(s.adminRequest(admin, http.MethodPost, path+"/restore")).IsDeleted)
+
+	w := s.adminRequest(admin, http.MethodGet, "/users/not-a-user")
+	assert.Equal(s.T(), http.StatusNotFound, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestAdminDeactivationOutlastsTokens() {
+	admin := s.newAdmin()
+	u := s.newUser()
+	activation := usermod.NewUserOperationTokenWithExpires(s.db, u.ID, usermod.ActivationToken, time.Now().Add(-time.Hour))
+	assert.Nil(s.T(), activation.Insert())
+	fresh := usermod.NewUserOperationTokenDefaultExpires(s.db, u.ID, usermod.ActivationToken)
+	assert.Nil(s.T(), fresh.Insert())
+	reset := s.newUserOperationsToken(u)
+	activate := func(token string) int {
+		w, _ := http.Get(s.ts.URL + "/api/user/activate?token=" + token)
+		return w.StatusCode
+	}
+	assert.Nil(s.T(), usermod.Activate(s.db, u.ID.String()))
+	_, err := usermod.MarkTokenAsUsed(s.db, activation.ID.String())
+	assert.Nil(s.T(), err)
+	assert.NotEqual(s.T(), "", s.login(u, testPassword))
+
+	w := s.adminRequest(admin, http.MethodPost, "/users/"+u.ID.String()+"/deactivate")
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	// used, expired and other kinds of tokens activate nothing
+	assert.Equal(s.T(), http.StatusNotFound, activate(activation.ID.String()))
+	assert.Equal(s.T(), http.StatusNotFound, activate(reset.ID.String()))
+	// and a valid one activates the account without lifting the deactivation
+	assert.Equal(s.T(), http.StatusOK, activate(fresh.ID.String()))
+	assert.Equal(s.T(), http.StatusNotFound, activate(fresh.ID.String()))
+	found, err := usermod.GetUserByID(s.db, u.ID.String())
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), found.IsDisabled)
+	assert.Equal(s.T(), "", s.login(u, testPassword))
+
+	w = s.adminRequest(admin, http.MethodPost, "/users/"+u.ID.String()+"/activate")
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	assert.NotEqual(s.T(), "", s.login(u, testPassword))
+}
+
+func (s *UserModTestSuite) TestAdminResetPassword() {
+	admin := s.newAdmin()
+	u := s.newActivatedUser()
+	refresh := s.newRefreshToken(u)
+
+	w := s.adminRequest(admin, http.MethodPost, "/users/"+u.ID.String()+"/reset_password")
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	_, err := usermod.AuthenticateByEmail(s.db, u.Email, testPassword)
+	assert.NotNil(s.T(), err)
+	_, _, err = usermod.RotateRefreshToken(s.db, refresh.ID.String())
+	assert.Equal(s.T(), usermod.ErrRefreshTokenInvalid, err)
+
+	n, ok := s.notifier.Last()
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), usermod.ForgotPaswordToken, n.TokenType)
+	assert.Equal(s.T(), u.Email, n.To)
+}
@@ -0,0 +1,91 @@
+package usermod
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// APIKeyJSON requests a new api key. ExpiresIn is in seconds, up to
+// APIKeyMaxExpiry, and keys without it never expire.
+type APIKeyJSON struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn *int64   `json:"expires_in,omitempty"`
+}
+
+// NewAPIKeyJSON is the only response that includes the key itself
+type NewAPIKeyJSON struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey issues an api key to the user. Keys can't be used to create
+// more keys, so that a leaked key can't outlive its revocation.
+func (rr *Router) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+	if _, ok := r.Context().Value(CTX_APIKEY_KEY).(*APIKey); ok {
+		jsonErrorFromString(w, "api keys can't create api keys", http.StatusForbidden)
+		return
+	}
+
+	kj := APIKeyJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &kj)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	var expires int64
+	if kj.ExpiresIn != nil {
+		if *kj.ExpiresIn <= 0 || *kj.ExpiresIn > int64(APIKeyMaxExpiry/time.Second) {
+			jsonErrorFromString(w, fmt.Sprintf("expires_in must be between 1 and %d seconds",
+				int64(APIKeyMaxExpiry/time.Second)), http.StatusBadRequest)
+			return
+		}
+		expires = time.Now().Add(time.Duration(*kj.ExpiresIn) * time.Second).Unix()
+	}
+	key, k, err := CreateAPIKey(r.Context(), rr.store, u.ID, kj.Name, kj.Scopes, expires)
+	if err == ErrAPIKeyScopeInvalid {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, NewAPIKeyJSON{APIKey: k, Key: key})
+}
+
+func (rr *Router) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(CTX_UID_KEY).(string)
+	keys, err := rr.store.GetUserAPIKeys(r.Context(), uid)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, keys)
+}
+
+func (rr *Router) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(CTX_UID_KEY).(string)
+	err := rr.store.DeleteAPIKey(r.Context(), uid, chi.URLParam(r, "id"))
+	if err == ErrAPIKeyNotFound {
+		jsonError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,211 @@
+package usermod
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+var ErrAPIKeyInvalid = errors.New("invalid api key")
+var ErrAPIKeyNotFound = errors.New("api key not found")
+var ErrAPIKeyScopeInvalid = errors.New("scopes must be non-empty and without whitespace")
+
+var apiKeyTblName = "api_keys"
+
+// APIKeyPrefix starts every api key, so that they can be told apart from
+// JWTs and spotted by secret scanners
+var APIKeyPrefix = "umk_"
+
+// AccountScope lets an api key with scopes use the router's own routes,
+// which manage the user's account
+var AccountScope = "account"
+
+// APIKeyMaxExpiry is the furthest ahead a key's expiry can be requested
+var APIKeyMaxExpiry = 5 * 365 * 24 * time.Hour
+
+// APIKeyTouchInterval limits how often the last used time is written
+var APIKeyTouchInterval = time.Minute
+
+// APIKey lets machine clients act as the user. Keys without scopes may do
+// anything the user can; RequireScope limits the others.
+type APIKey struct {
+	ID       uuid.UUID `json:"id"`
+	UserID   uuid.UUID `json:"-"`
+	Name     string    `json:"name"`
+	Hash     []byte    `json:"-"`
+	Scopes   []string  `json:"scopes"`
+	Expires  int64     `json:"expires,omitempty"`
+	LastUsed int64     `json:"last_used,omitempty"`
+	Created  int64     `json:"created"`
+}
+
+// IsExpired is false for keys that never expire
+func (k *APIKey) IsExpired() bool {
+	return k.Expires != 0 && k.Expires <= time.Now().Unix()
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	return len(k.Scopes) == 0 || containsAny(k.Scopes, []string{scope})
+}
+
+// APIKeyStore persists api keys. Deleting another user's key fails with
+// ErrAPIKeyNotFound.
+type APIKeyStore interface {
+	InsertAPIKey(ctx context.Context, k *APIKey) error
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	GetUserAPIKeys(ctx context.Context, uid string) ([]*APIKey, error)
+	DeleteAPIKey(ctx context.Context, uid, id string) error
+	TouchAPIKey(ctx context.Context, id string, at int64) error
+}
+
+// hashAPIKeySecret doesn't need a password hash, as the secret is random
+// and as long as the hash itself
+func hashAPIKeySecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// CreateAPIKey returns the new key in plain text, which is never stored.
+// An expires of 0 never expires. Scopes are stored space separated, so
+// ErrAPIKeyScopeInvalid is returned for any that are empty or contain
+// whitespace.
+func CreateAPIKey(ctx context.Context, store APIKeyStore, uid uuid.UUID, name string, scopes []string, expires int64) (string, *APIKey, error) {
+	for _, scope := range scopes {
+		if scope == "" || strings.IndexFunc(scope, unicode.IsSpace) >= 0 {
+			return "", nil, ErrAPIKeyScopeInvalid
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := hex.EncodeToString(b)
+	k := &APIKey{
+		ID:      uuid.New(),
+		UserID:  uid,
+		Name:    name,
+		Hash:    hashAPIKeySecret(secret),
+		Scopes:  scopes,
+		Expires: expires,
+		Created: time.Now().Unix(),
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	if err := store.InsertAPIKey(ctx, k); err != nil {
+		return "", nil, err
+	}
+	return APIKeyPrefix + k.ID.String() + "_" + secret, k, nil
+}
+
+// VerifyAPIKey returns the stored key the plain text key matches, and
+// records that it was used
+func VerifyAPIKey(ctx context.Context, store APIKeyStore, key string) (*APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrAPIKeyInvalid
+	}
+	k, err := store.GetAPIKey(ctx, id)
+	if err == ErrAPIKeyNotFound {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(k.Hash, hashAPIKeySecret(secret)) != 1 || k.IsExpired() {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(k.LastUsed, 0)) >= APIKeyTouchInterval {
+		if err = store.TouchAPIKey(ctx, id, now.Unix()); err != nil {
+			return nil, err
+		}
+		k.LastUsed = now.Unix()
+	}
+	return k, nil
+}
+
+func (s *SQLStore) InsertAPIKey(ctx context.Context, k *APIKey) error {
+	query := fmt.Sprintf(`INSERT INTO %s (id, user_id, name, key_hash, scopes, expires, last_used, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, apiKeyTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), k.ID.String(), k.UserID.String(), k.Name, k.Hash,
+		strings.Join(k.Scopes, " "), k.Expires, k.LastUsed, k.Created)
+	return err
+}
+
+var apiKeyColumns = "id, user_id, name, key_hash, scopes, expires, last_used, created"
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	k := APIKey{}
+	var scopes string
+	err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Hash, &scopes, &k.Expires, &k.LastUsed, &k.Created)
+	if err != nil {
+		return nil, err
+	}
+	k.Scopes = strings.Fields(scopes)
+	return &k, nil
+}
+
+func (s *SQLStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id = $1", apiKeyColumns, apiKeyTblName)
+	k, err := scanAPIKey(s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+func (s *SQLStore) GetUserAPIKeys(ctx context.Context, uid string) ([]*APIKey, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE user_id = $1 ORDER BY created, id", apiKeyColumns, apiKeyTblName)
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) DeleteAPIKey(ctx context.Context, uid, id string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1 AND user_id = $2", apiKeyTblName)
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), id, uid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) TouchAPIKey(ctx context.Context, id string, at int64) error {
+	query := fmt.Sprintf("UPDATE %s SET last_used = $1 WHERE id = $2", apiKeyTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), at, id)
+	return err
+}
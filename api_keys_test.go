@@ -0,0 +1,172 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+// apiKeyRequest calls the url with either the user's password or a key
+func (s *UserModTestSuite) apiKeyRequest(method, url string, u *usermod.User, key string, body any) *http.Response {
+	b, _ := json.Marshal(body)
+	r, _ := http.NewRequest(method, url, bytes.NewReader(b))
+	if key != "" {
+		r.Header.Add("Authorization", "Bearer "+key)
+	} else {
+		auth := u.Email + ":" + string(testPassword)
+		r.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	w, _ := http.DefaultClient.Do(r)
+	return w
+}
+
+func (s *UserModTestSuite) TestAPIKeys() {
+	u := s.newActivatedUser()
+	url := s.ts.URL + "/api/user/api_keys"
+
+	w := s.apiKeyRequest(http.MethodPost, url, u, "", usermod.APIKeyJSON{Name: "ci"})
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	created := usermod.NewAPIKeyJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&created))
+	assert.True(s.T(), strings.HasPrefix(created.Key, usermod.APIKeyPrefix))
+	assert.Equal(s.T(), "ci", created.Name)
+
+	tests := []struct {
+		name       string
+		url        string
+		key        string
+		statusCode int
+	}{
+		{"middleware", s.ts.URL + "/auth3", created.Key, http.StatusOK},
+		{"user route", s.ts.URL + "/api/user", created.Key, http.StatusOK},
+		{"unscoped key", s.ts.URL + "/scope", created.Key, http.StatusOK},
+		{"wrong secret", s.ts.URL + "/auth3", created.Key + "0", http.StatusUnauthorized},
+		{"not a key", s.ts.URL + "/auth3", usermod.APIKeyPrefix + "nope", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			w := s.apiKeyRequest(http.MethodGet, tc.url, u, tc.key, nil)
+			assert.Equal(t, tc.statusCode, w.StatusCode)
+		})
+	}
+
+	// keys are listed without their secret, but with when they were used
+	w = s.apiKeyRequest(http.MethodGet, url, u, "", nil)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	var listed []map[string]any
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&listed))
+	assert.Len(s.T(), listed, 1)
+	assert.Equal(s.T(), created.ID.String(), listed[0]["id"])
+	assert.NotContains(s.T(), listed[0], "key")
+	assert.NotZero(s.T(), listed[0]["last_used"])
+
+	// keys never count as a recent login, so can't create more keys
+	w = s.apiKeyRequest(http.MethodPost, url, u, created.Key, usermod.APIKeyJSON{Name: "escalate"})
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+
+	expiresIn := func(n int64) *int64 { return &n }
+	invalid := []struct {
+		name string
+		key  usermod.APIKeyJSON
+	}{
+		{"zero expiry", usermod.APIKeyJSON{Name: "ci", ExpiresIn: expiresIn(0)}},
+		{"negative expiry", usermod.APIKeyJSON{Name: "ci", ExpiresIn: expiresIn(-1)}},
+		{"overflowing expiry", usermod.APIKeyJSON{Name: "ci", ExpiresIn: expiresIn(math.MaxInt64)}},
+		{"expiry past the max", usermod.APIKeyJSON{Name: "ci", ExpiresIn: expiresIn(int64(usermod.APIKeyMaxExpiry/time.Second) + 1)}},
+		{"scope with a space", usermod.APIKeyJSON{Name: "ci", Scopes: []string{"read write"}}},
+		{"scope with a tab", usermod.APIKeyJSON{Name: "ci", Scopes: []string{"read\twrite"}}},
+		{"empty scope", usermod.APIKeyJSON{Name: "ci", Scopes: []string{""}}},
+	}
+	for _, tc := range invalid {
+		s.T().Run(tc.name, func(t *testing.T) {
+			w := s.apiKeyRequest(http.MethodPost, url, u, "", tc.key)
+			assert.Equal(t, http.StatusBadRequest, w.StatusCode)
+		})
+	}
+	w = s.apiKeyRequest(http.MethodPost, url, u, "", usermod.APIKeyJSON{Name: "hour", ExpiresIn: expiresIn(3600)})
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	hour := usermod.NewAPIKeyJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&hour))
+	assert.InDelta(s.T(), time.Now().Add(time.Hour).Unix(), hour.Expires, 5)
+	w = s.apiKeyRequest(http.MethodDelete, url+"/"+hour.ID.String(), u, "", nil)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	w = s.apiKeyRequest(http.MethodDelete, url+"/"+created.ID.String(), u, "", nil)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	w = s.apiKeyRequest(http.MethodDelete, url+"/"+created.ID.String(), u, "", nil)
+	assert.Equal(s.T(), http.StatusNotFound, w.StatusCode)
+	w = s.apiKeyRequest(http.MethodGet, s.ts.URL+"/auth3", u, created.Key, nil)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestAPIKeyScopesAndExpiry() {
+	ctx := context.Background()
+	u := s.newActivatedUser()
+	deploy, _, err := usermod.CreateAPIKey(ctx, s.store, u.ID, "deploy", []string{"deploy"}, 0)
+	assert.Nil(s.T(), err)
+	other, _, err := usermod.CreateAPIKey(ctx, s.store, u.ID, "other", []string{"other", usermod.AccountScope}, 0)
+	assert.Nil(s.T(), err)
+	expired, _, err := usermod.CreateAPIKey(ctx, s.store, u.ID, "expired", nil, time.Now().Add(-time.Second).Unix())
+	assert.Nil(s.T(), err)
+
+	tests := []struct {
+		name       string
+		url        string
+		key        string
+		statusCode int
+	}{
+		{"scoped", s.ts.URL + "/scope", deploy, http.StatusOK},
+		{"missing scope", s.ts.URL + "/scope", other, http.StatusForbidden},
+		{"no account scope", s.ts.URL + "/api/user", deploy, http.StatusForbidden},
+		{"account scope", s.ts.URL + "/api/user", other, http.StatusOK},
+		{"expired", s.ts.URL + "/auth3", expired, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			w := s.apiKeyRequest(http.MethodGet, tc.url, u, tc.key, nil)
+			assert.Equal(t, tc.statusCode, w.StatusCode)
+		})
+	}
+
+	// keys stop working with their user
+	assert.Nil(s.T(), s.store.Deactivate(ctx, u.ID.String()))
+	w := s.apiKeyRequest(http.MethodGet, s.ts.URL+"/auth3", u, deploy, nil)
+	assert.Equal(s.T(), http.StatusForbidden, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestStoreAPIKeys() {
+	ctx := context.Background()
+	for name, store := range s.stores() {
+		s.T().Run(name, func(t *testing.T) {
+			u := s.newActivatedUser()
+			key, k, err := usermod.CreateAPIKey(ctx, store, u.ID, "ci", []string{"a", "b"}, 0)
+			assert.Nil(t, err)
+
+			found, err := usermod.VerifyAPIKey(ctx, store, key)
+			assert.Nil(t, err)
+			assert.Equal(t, k.ID, found.ID)
+			assert.Equal(t, []string{"a", "b"}, found.Scopes)
+			assert.NotZero(t, found.LastUsed)
+
+			keys, err := store.GetUserAPIKeys(ctx, u.ID.String())
+			assert.Nil(t, err)
+			assert.Len(t, keys, 1)
+			assert.NotZero(t, keys[0].LastUsed)
+
+			assert.Equal(t, usermod.ErrAPIKeyNotFound, store.DeleteAPIKey(ctx, "someone-else", k.ID.String()))
+			assert.Nil(t, store.DeleteAPIKey(ctx, u.ID.String(), k.ID.String()))
+			_, err = usermod.VerifyAPIKey(ctx, store, key)
+			assert.Equal(t, usermod.ErrAPIKeyInvalid, err)
+			assert.Nil(t, u.DeleteByUID(u.ID.String()))
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package usermod
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachChecker reports whether a password has appeared in a data breach.
+// A client of HIBP's k-anonymity range API can stand in for BreachList.
+type BreachChecker interface {
+	IsBreached(ctx context.Context, password []byte) (bool, error)
+}
+
+// BreachList is a BreachChecker over a local copy of HIBP's Pwned
+// Passwords, so that it works without network access. Passwords seen fewer
+// than MinCount times are allowed.
+type BreachList struct {
+	// hashes holds the hashes given to ReadBreachList, while a list loaded
+	// from path searches it on each check
+	hashes   map[[sha1.Size]byte]int
+	path     string
+	isDir    bool
+	ext      string
+	MinCount int
+}
+
+// LoadBreachList searches HIBP's SHA-1 hashes at path, without reading
+// them into memory. A file holds a line per hash, sorted as HIBP's
+// downloader writes them: the hash in hex, a colon and the number of times
+// it was seen. A directory holds a file per 5 character prefix, named for
+// it, with a line per suffix in the format of the range API, and only the
+// file for the password's prefix is read. Lines without a count are
+// counted once.
+func LoadBreachList(path string) (*BreachList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &BreachList{path: path, isDir: info.IsDir(), MinCount: 1}
+	if b.isDir {
+		return b, b.findExt()
+	}
+
+	// catch files in another format now, rather than on every check
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if _, _, err = parseBreachLine(line, ""); err != nil {
+		return nil, fmt.Errorf("%w on line 1", err)
+	}
+	return b, nil
+}
+
+// findExt learns the extension of the range files from the first of them,
+// without listing the whole directory
+func (b *BreachList) findExt() error {
+	dir, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		names, err := dir.Readdirnames(100)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if len(strings.TrimSuffix(name, filepath.Ext(name))) == 5 {
+				b.ext = filepath.Ext(name)
+				return nil
+			}
+		}
+	}
+}
+
+// ReadBreachList reads a single file of full hashes into memory, which
+// suits short lists. Use LoadBreachList for HIBP's full corpus.
+func ReadBreachList(r io.Reader) (*BreachList, error) {
+	b := &BreachList{hashes: map[[sha1.Size]byte]int{}, MinCount: 1}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		hash, seen, err := parseBreachLine(scanner.Text(), "")
+		if err != nil {
+			return nil, fmt.Errorf("%w on line %d", err, n)
+		}
+		b.hashes[hash] += seen
+	}
+	return b, scanner.Err()
+}
+
+// parseBreachLine reads a hash following prefix, and the times it was seen
+func parseBreachLine(line, prefix string) ([sha1.Size]byte, int, error) {
+	hash, count, found := strings.Cut(strings.TrimSpace(line), ":")
+	decoded, err := hex.DecodeString(prefix + hash)
+	if err != nil || len(decoded) != sha1.Size {
+		return [sha1.Size]byte{}, 0, errors.New("invalid hash")
+	}
+	seen := 1
+	if found {
+		if seen, err = strconv.Atoi(count); err != nil {
+			return [sha1.Size]byte{}, 0, errors.New("invalid count")
+		}
+	}
+	return [sha1.Size]byte(decoded), seen, nil
+}
+
+func (b *BreachList) IsBreached(ctx context.Context, password []byte) (bool, error) {
+	hash := sha1.Sum(password)
+	var count int
+	var err error
+	switch {
+	case b.hashes != nil:
+		count = b.hashes[hash]
+	case b.isDir:
+		count, err = b.scanRange(hash)
+	default:
+		count, err = b.searchFile(hash)
+	}
+	return count > 0 && count >= b.MinCount, err
+}
+
+// scanRange reads the range file for the hash's prefix. A missing file
+// holds no hashes.
+func (b *BreachList) scanRange(hash [sha1.Size]byte) (int, error) {
+	prefix := strings.ToUpper(hex.EncodeToString(hash[:]))[:5]
+	f, err := os.Open(filepath.Join(b.path, prefix+b.ext))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(b.path, strings.ToLower(prefix)+b.ext))
+	}
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		found, seen, err := parseBreachLine(scanner.Text(), prefix)
+		if err != nil {
+			return 0, fmt.Errorf("%w on line %d of %s", err, n, f.Name())
+		}
+		if found == hash {
+			count += seen
+		}
+	}
+	return count, scanner.Err()
+}
+
+// searchFile binary searches the sorted file for the hash, by the byte
+// offsets of its lines
+func (b *BreachList) searchFile(hash [sha1.Size]byte) (int, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// the hash's line, if any, starts within [lo, hi)
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineFrom(f, mid, info.Size())
+		if err != nil {
+			return 0, err
+		}
+		if start >= hi || line == "" {
+			hi = mid
+			continue
+		}
+		found, seen, err := parseBreachLine(line, "")
+		if err != nil {
+			return 0, fmt.Errorf("%w at byte %d of %s", err, start, f.Name())
+		}
+		switch bytes.Compare(found[:], hash[:]) {
+		case 0:
+			return seen, nil
+		case -1:
+			lo = start + int64(len(line))
+		default:
+			hi = mid
+		}
+	}
+	return 0, nil
+}
+
+// lineFrom returns the first line starting at or after off, with its
+// newline, and where it starts. At the end of the file the line is empty.
+func lineFrom(r io.ReaderAt, off, size int64) (int64, string, error) {
+	start := off
+	if off > 0 {
+		// the line starts after the first newline from the byte before off
+		start = off - 1
+	}
+	br := bufio.NewReader(io.NewSectionReader(r, start, size-start))
+	if off > 0 {
+		skipped, err := br.ReadString('\n')
+		if err == io.EOF {
+			return size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	return start, line, nil
+}
@@ -0,0 +1,121 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func (s *UserModTestSuite) TestBreachList() {
+	ctx := context.Background()
+	file := sha1Hex("correct horse battery") + ":3\n" + strings.ToLower(sha1Hex("hunter2")) + "\n"
+	list, err := usermod.ReadBreachList(strings.NewReader(file))
+	assert.Nil(s.T(), err)
+
+	for password, breached := range map[string]bool{"correct horse battery": true, "hunter2": true, "unseen": false} {
+		found, err := list.IsBreached(ctx, []byte(password))
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), breached, found, password)
+	}
+	list.MinCount = 2
+	found, _ := list.IsBreached(ctx, []byte("hunter2"))
+	assert.False(s.T(), found)
+
+	_, err = usermod.ReadBreachList(strings.NewReader("not a hash\n"))
+	assert.NotNil(s.T(), err)
+
+	// range files are named for the prefix they complete
+	dir := s.T().TempDir()
+	hash := sha1Hex("correct horse battery")
+	assert.Nil(s.T(), os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(hash[5:]+":3\n"), 0o600))
+	list, err = usermod.LoadBreachList(dir)
+	assert.Nil(s.T(), err)
+	found, _ = list.IsBreached(ctx, []byte("correct horse battery"))
+	assert.True(s.T(), found)
+
+	// prefixes without a file have no breached passwords
+	found, err = list.IsBreached(ctx, []byte("unseen"))
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), found)
+
+	// a single file is searched in place, so it must be sorted
+	var lines []string
+	passwords := map[string]bool{}
+	for i := 0; i < 500; i++ {
+		password := fmt.Sprintf("password %d", i)
+		if i%2 == 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d", sha1Hex(password), i+1))
+		}
+		passwords[password] = i%2 == 0
+	}
+	sort.Strings(lines)
+	path := filepath.Join(dir, "pwned-passwords.txt")
+	assert.Nil(s.T(), os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600))
+	list, err = usermod.LoadBreachList(path)
+	assert.Nil(s.T(), err)
+	for password, breached := range passwords {
+		found, err := list.IsBreached(ctx, []byte(password))
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), breached, found, password)
+	}
+	list.MinCount = 100
+	found, _ = list.IsBreached(ctx, []byte("password 98"))
+	assert.False(s.T(), found)
+	found, _ = list.IsBreached(ctx, []byte("password 100"))
+	assert.True(s.T(), found)
+
+	assert.Nil(s.T(), os.WriteFile(path, []byte("not a hash\n"), 0o600))
+	_, err = usermod.LoadBreachList(path)
+	assert.NotNil(s.T(), err)
+}
+
+func (s *UserModTestSuite) TestBreachedPasswords() {
+	list, err := usermod.ReadBreachList(strings.NewReader(sha1Hex("correct horse battery") + ":3\n"))
+	assert.Nil(s.T(), err)
+	policy := usermod.NewPasswordPolicy()
+	policy.Breaches = list
+	ts := httptest.NewServer(usermod.NewRouter(s.store, usermod.WithPasswordPolicy(policy), usermod.WithTokenConfig(s.tokens)))
+	defer ts.Close()
+
+	create := func(email, password string) *http.Response {
+		b, _ := json.Marshal(usermod.CreateUserJSON{Name: "Breach", Email: email, Password: password})
+		w, _ := http.Post(ts.URL+"/user", "application/json", bytes.NewReader(b))
+		return w
+	}
+	w := create("breached@ummmfoo.com", "correct horse battery")
+	assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+	rejected := usermod.PasswordPolicyError{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&rejected))
+	assert.Equal(s.T(), "breached", rejected.Violations[0].Code)
+	assert.Equal(s.T(), http.StatusCreated, create("safe@ummmfoo.com", "uncorrected horse battery").StatusCode)
+
+	// changes and resets are checked the same way
+	u := s.newActivatedUser()
+	b, _ := json.Marshal(usermod.PasswordJSON{OldPassword: testPassword, NewPassword: []byte("correct horse battery")})
+	r, _ := http.NewRequest(http.MethodPost, ts.URL+"/change_password", bytes.NewReader(b))
+	r.SetBasicAuth(u.Email, string(testPassword))
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+
+	token := s.newUserOperationsToken(u)
+	b, _ = json.Marshal(usermod.ResetPasswordJSON{Token: token.ID.String(), Password: "correct horse battery"})
+	w, _ = http.Post(ts.URL+"/user/reset_password", "application/json", bytes.NewReader(b))
+	assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+}
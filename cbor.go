@@ -0,0 +1,121 @@
+package usermod
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errCBOR = errors.New("invalid cbor")
+
+// cborMaxDepth bounds nesting, WebAuthn structures are only a few levels deep
+const cborMaxDepth = 16
+
+// cborDecode decodes the first CBOR item in b, returning it along with the
+// bytes that follow. Only what WebAuthn needs is supported: integers, byte
+// and text strings, arrays, maps and simple values. Integers decode to
+// int64, and maps to map[any]any keyed by int64 or string.
+func cborDecode(b []byte) (any, []byte, error) {
+	return cborDecodeItem(b, 0)
+}
+
+func cborDecodeItem(b []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth || len(b) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b[1:], nil
+		case 21:
+			return true, b[1:], nil
+		case 22, 23:
+			return nil, b[1:], nil
+		}
+		return nil, nil, errCBOR
+	}
+
+	n, rest, err := cborArgument(info, b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		if major == 3 {
+			return string(rest[:n]), rest[n:], nil
+		}
+		return append([]byte{}, rest[:n]...), rest[n:], nil
+	case 4:
+		// every item takes at least a byte, which bounds allocation
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item any
+			item, rest, err = cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[any]any, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value any
+			key, rest, err = cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			value, rest, err = cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	}
+	// tags aren't used by WebAuthn
+	return nil, nil, errCBOR
+}
+
+// cborArgument reads the length or value that follows an initial byte.
+// Indefinite lengths aren't supported.
+func cborArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	}
+	return 0, nil, errCBOR
+}
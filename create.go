@@ -1,16 +1,13 @@
 package usermod
 
-import "database/sql"
-
+import (
+	"context"
+	"database/sql"
+)
+
+// CreateAllTables brings the schema up to date.
+//
+// Deprecated: use Migrate, which reports a single error.
 func CreateAllTables(db *sql.DB) []error {
-	u := User{db: db}
-	uot := UserOperationToken{db: db}
-
-	var errors []error
-	err := u.CreateTable()
-	errors = append(errors, err)
-
-	err = uot.CreateTable()
-	errors = append(errors, err)
-	return errors
+	return []error{Migrate(context.Background(), db)}
 }
@@ -0,0 +1,156 @@
+package usermod
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ColumnType is a portable column type, mapped to a concrete type by each
+// Dialect
+type ColumnType int
+
+const (
+	UUIDColumn ColumnType = iota
+	StringColumn
+	BinaryColumn
+	BoolColumn
+	BigIntColumn
+	IntColumn
+)
+
+// Dialect captures the differences between the SQL databases usermod
+// supports. Queries are written with $1 style placeholders, in argument
+// order, and rebound for the target database.
+type Dialect interface {
+	Name() string
+	// Rebind rewrites $1 style placeholders into the dialect's syntax
+	Rebind(query string) string
+	// Type returns the column type used in CREATE TABLE statements
+	Type(t ColumnType) string
+	// SupportsReturning reports whether UPDATE ... RETURNING is available
+	SupportsReturning() bool
+	// InsertIgnore builds an insert that silently skips rows conflicting
+	// on the given unique columns
+	InsertIgnore(table, columns, values, conflict string) string
+}
+
+type sqlDialect struct {
+	name       string
+	positional bool
+	returning  bool
+	types      map[ColumnType]string
+}
+
+var Postgres Dialect = &sqlDialect{
+	name:      "postgres",
+	returning: true,
+	types: map[ColumnType]string{
+		UUIDColumn:   "UUID",
+		StringColumn: "VARCHAR(255)",
+		BinaryColumn: "BYTEA",
+		BoolColumn:   "BOOLEAN",
+		BigIntColumn: "BIGINT",
+		IntColumn:    "INTEGER",
+	},
+}
+
+var MySQL Dialect = &sqlDialect{
+	name:       "mysql",
+	positional: true,
+	returning:  false,
+	types: map[ColumnType]string{
+		UUIDColumn:   "CHAR(36)",
+		StringColumn: "VARCHAR(255)",
+		BinaryColumn: "VARBINARY(1024)",
+		BoolColumn:   "BOOLEAN",
+		BigIntColumn: "BIGINT",
+		IntColumn:    "INTEGER",
+	},
+}
+
+var SQLite Dialect = &sqlDialect{
+	name:      "sqlite3",
+	returning: true,
+	types: map[ColumnType]string{
+		UUIDColumn:   "UUID",
+		StringColumn: "VARCHAR(255)",
+		BinaryColumn: "BLOB",
+		BoolColumn:   "BOOLEAN",
+		BigIntColumn: "BIGINT",
+		IntColumn:    "INTEGER",
+	},
+}
+
+func (d *sqlDialect) Name() string {
+	return d.name
+}
+
+func (d *sqlDialect) Rebind(query string) string {
+	if !d.positional {
+		return query
+	}
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		if query[i] != '$' || i+1 >= len(query) || query[i+1] < '0' || query[i+1] > '9' {
+			b.WriteByte(query[i])
+			continue
+		}
+		for i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+			i++
+		}
+		b.WriteByte('?')
+	}
+	return b.String()
+}
+
+func (d *sqlDialect) Type(t ColumnType) string {
+	return d.types[t]
+}
+
+func (d *sqlDialect) SupportsReturning() bool {
+	return d.returning
+}
+
+func (d *sqlDialect) InsertIgnore(table, columns, values, conflict string) string {
+	if d.name == "mysql" {
+		return fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES (%s)", table, columns, values)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING", table, columns, values, conflict)
+}
+
+// isUniqueViolation recognizes the unique constraint errors of each
+// driver, without importing them
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || // sqlite
+		strings.Contains(msg, "duplicate key value violates unique constraint") || // postgres
+		strings.Contains(msg, "Error 1062") // mysql
+}
+
+// DetectDialect guesses the dialect from the database driver, falling back
+// to Postgres.
+func DetectDialect(db *sql.DB) Dialect {
+	driver := strings.ToLower(fmt.Sprintf("%T", db.Driver()))
+	switch {
+	case strings.Contains(driver, "mysql"):
+		return MySQL
+	case strings.Contains(driver, "sqlite"):
+		return SQLite
+	default:
+		return Postgres
+	}
+}
+
+// placeholders returns "$1, $2, ..., $n"
+func placeholders(n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = "$" + strconv.Itoa(i+1)
+	}
+	return strings.Join(p, ", ")
+}
@@ -0,0 +1,70 @@
+package usermod_test
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) TestDialectRebind() {
+	query := "UPDATE users SET name = $1 WHERE id = $2 AND email = $10"
+	assert.Equal(s.T(), query, usermod.Postgres.Rebind(query))
+	assert.Equal(s.T(), query, usermod.SQLite.Rebind(query))
+	assert.Equal(s.T(), "UPDATE users SET name = ? WHERE id = ? AND email = ?", usermod.MySQL.Rebind(query))
+}
+
+func (s *UserModTestSuite) TestDialectTypes() {
+	assert.Equal(s.T(), "UUID", usermod.Postgres.Type(usermod.UUIDColumn))
+	assert.Equal(s.T(), "CHAR(36)", usermod.MySQL.Type(usermod.UUIDColumn))
+	assert.Equal(s.T(), "BYTEA", usermod.Postgres.Type(usermod.BinaryColumn))
+	assert.True(s.T(), usermod.Postgres.SupportsReturning())
+	assert.False(s.T(), usermod.MySQL.SupportsReturning())
+
+	assert.Equal(s.T(), "INSERT IGNORE INTO t (a, b) VALUES ($1, $2)",
+		usermod.MySQL.InsertIgnore("t", "a, b", "$1, $2", "a"))
+	assert.Equal(s.T(), "INSERT INTO t (a, b) VALUES ($1, $2) ON CONFLICT (a) DO NOTHING",
+		usermod.Postgres.InsertIgnore("t", "a, b", "$1, $2", "a"))
+}
+
+func (s *UserModTestSuite) TestDetectDialect() {
+	d := usermod.DetectDialect(s.db)
+	assert.Equal(s.T(), s.driver, d.Name())
+
+	pg, _ := sql.Open("postgres", "")
+	assert.Equal(s.T(), usermod.Postgres, usermod.DetectDialect(pg))
+	my, _ := sql.Open("mysql", "")
+	assert.Equal(s.T(), usermod.MySQL, usermod.DetectDialect(my))
+}
+
+// TestDialectWithoutReturning exercises the select fallback used by
+// dialects without RETURNING, on whichever database the suite runs.
+func (s *UserModTestSuite) TestDialectWithoutReturning() {
+	ctx := context.Background()
+	store := usermod.NewSQLStoreWithDialect(s.db, noReturning{s.store.Dialect()})
+	user := s.newUser()
+	tok := s.newUserOperationsToken(user)
+
+	_, err := store.ConsumeToken(ctx, tok.ID.String(), usermod.ActivationToken)
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+
+	uid, err := store.ConsumeToken(ctx, tok.ID.String(), usermod.ForgotPaswordToken)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.ID, uid)
+
+	uid, err = store.MarkTokenAsUsed(ctx, tok.ID.String())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.ID, uid)
+
+	_, err = store.MarkTokenAsUsed(ctx, "nope")
+	assert.NotNil(s.T(), err)
+}
+
+type noReturning struct {
+	usermod.Dialect
+}
+
+func (noReturning) SupportsReturning() bool {
+	return false
+}
@@ -0,0 +1,315 @@
+package usermod
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+var ErrIdentityNotFound = errors.New("identity not found")
+var ErrIdentityProviderFailed = errors.New("identity provider login failed")
+
+var identityTblName = "identities"
+
+// Identity links an account at an external OpenID Connect provider,
+// identified by issuer and subject, to a user
+type Identity struct {
+	Issuer  string    `json:"issuer"`
+	Subject string    `json:"subject"`
+	UserID  uuid.UUID `json:"-"`
+	Email   string    `json:"email"`
+	Created int64     `json:"created"`
+}
+
+// IdentityStore persists the links between users and external identities
+type IdentityStore interface {
+	LinkIdentity(ctx context.Context, i *Identity) error
+	GetIdentity(ctx context.Context, issuer, subject string) (*Identity, error)
+	GetUserIdentities(ctx context.Context, uid string) ([]*Identity, error)
+	UnlinkIdentity(ctx context.Context, uid, issuer string) error
+}
+
+// IdentityProviderConfig describes an external OpenID Connect provider
+// users can log in with. Name appears in the login routes, and
+// RedirectURL must point at the provider's callback route,
+// /login/{name}/callback below where the router is mounted.
+type IdentityProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes default to openid, email and profile
+	Scopes     []string
+	HTTPClient *http.Client
+}
+
+// identityProvider caches the provider's discovery document and keys
+type identityProvider struct {
+	IdentityProviderConfig
+	mu        sync.Mutex
+	discovery *OIDCDiscoveryJSON
+	keys      map[string]JWK
+}
+
+func newIdentityProvider(cfg IdentityProviderConfig) *identityProvider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &identityProvider{IdentityProviderConfig: cfg}
+}
+
+func (p *identityProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the discovery document once, retrying after failures
+func (p *identityProvider) discover(ctx context.Context) (*OIDCDiscoveryJSON, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := OIDCDiscoveryJSON{}
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %s", d.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the signing key with the id, refetching the key set when
+// the provider has rotated to a key we haven't seen
+func (p *identityProvider) key(ctx context.Context, kid string) (JWK, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return JWK{}, err
+	}
+	p.mu.Lock()
+	k, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+
+	set := JWKSet{}
+	if err = p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return JWK{}, err
+	}
+	keys := map[string]JWK{}
+	for _, k := range set.Keys {
+		keys[k.Kid] = k
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if k, ok = keys[kid]; !ok {
+		return JWK{}, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return k, nil
+}
+
+// authCodeURL is where the user is sent to log in at the provider
+func (p *identityProvider) authCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// audience accepts the aud claim as either a string or an array
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(b, &list)
+	*a = list
+	return err
+}
+
+// externalClaims are the ID token claims read from an external provider
+type externalClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+func (c *externalClaims) Valid() error {
+	if time.Now().Unix() > c.ExpiresAt {
+		return errors.New("token is expired")
+	}
+	return nil
+}
+
+// exchange redeems the authorization code and verifies the ID token
+func (p *identityProvider) exchange(ctx context.Context, code, verifier, nonce string) (*externalClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+	tok := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+
+	claims := externalClaims{}
+	_, err = jwt.ParseWithClaims(tok.IDToken, &claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		k, err := p.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		return k.PublicKey()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aud := false
+	for _, a := range claims.Audience {
+		aud = aud || a == p.ClientID
+	}
+	if claims.Issuer != p.Issuer || !aud || claims.Subject == "" || claims.Nonce != nonce {
+		return nil, ErrIdentityProviderFailed
+	}
+	return &claims, nil
+}
+
+func (s *SQLStore) LinkIdentity(ctx context.Context, i *Identity) error {
+	query := fmt.Sprintf("INSERT INTO %s (issuer, subject, user_id, email, created) VALUES ($1, $2, $3, $4, $5)",
+		identityTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), i.Issuer, i.Subject, i.UserID.String(), i.Email, i.Created)
+	return err
+}
+
+func (s *SQLStore) GetIdentity(ctx context.Context, issuer, subject string) (*Identity, error) {
+	i := Identity{}
+	query := fmt.Sprintf("SELECT issuer, subject, user_id, email, created FROM %s WHERE issuer = $1 AND subject = $2",
+		identityTblName)
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), issuer, subject).
+		Scan(&i.Issuer, &i.Subject, &i.UserID, &i.Email, &i.Created)
+	if err == sql.ErrNoRows {
+		return nil, ErrIdentityNotFound
+	}
+	return &i, err
+}
+
+func (s *SQLStore) GetUserIdentities(ctx context.Context, uid string) ([]*Identity, error) {
+	query := fmt.Sprintf("SELECT issuer, subject, user_id, email, created FROM %s WHERE user_id = $1 ORDER BY issuer",
+		identityTblName)
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		i := Identity{}
+		if err = rows.Scan(&i.Issuer, &i.Subject, &i.UserID, &i.Email, &i.Created); err != nil {
+			return nil, err
+		}
+		identities = append(identities, &i)
+	}
+	return identities, rows.Err()
+}
+
+// UnlinkIdentity removes the user's identities at the issuer, failing with
+// ErrIdentityNotFound if there were none
+func (s *SQLStore) UnlinkIdentity(ctx context.Context, uid, issuer string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND issuer = $2", identityTblName)
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), uid, issuer)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrIdentityNotFound
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package usermod
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt"
+)
+
+// IdentityStateCookieName holds the state of a login at an external
+// provider, between leaving for the provider and returning to the callback
+var IdentityStateCookieName = "usermod_oidc_state"
+
+var identityStateExpiry = time.Minute * 10
+
+// IdentityTOTPCookieName holds a login at an external provider by a user
+// with TOTP enabled, until they give a code at IdentityTOTP
+var IdentityTOTPCookieName = "usermod_oidc_totp"
+
+var identityTOTPExpiry = time.Minute * 5
+
+// identityState is signed like an access token, so that the callback can
+// trust it. LinkUserID is set when a logged in user is linking an identity.
+type identityState struct {
+	State      string `json:"state"`
+	Nonce      string `json:"nonce"`
+	Verifier   string `json:"verifier"`
+	Provider   string `json:"provider"`
+	LinkUserID string `json:"link_user_id,omitempty"`
+	jwt.StandardClaims
+}
+
+// identityTOTPState is signed like identityState, and names the user who
+// logged in at the provider
+type identityTOTPState struct {
+	PendingUserID string `json:"pending_user_id"`
+	Provider      string `json:"provider"`
+	jwt.StandardClaims
+}
+
+func (rr *Router) provider(w http.ResponseWriter, r *http.Request) *identityProvider {
+	p, ok := rr.providers[chi.URLParam(r, "provider")]
+	if !ok {
+		jsonErrorFromString(w, "unknown identity provider", http.StatusNotFound)
+		return nil
+	}
+	return p
+}
+
+// startIdentityLogin sends the user agent to the provider
+func (rr *Router) startIdentityLogin(w http.ResponseWriter, r *http.Request, p *identityProvider, linkUserID string) {
+	st := identityState{Provider: p.Name, LinkUserID: linkUserID}
+	st.ExpiresAt = time.Now().Add(identityStateExpiry).Unix()
+	var err error
+	for _, v := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		if *v, err = randomToken(32); err != nil {
+			jsonError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	sum := sha256.Sum256([]byte(st.Verifier))
+	authURL, err := p.authCodeURL(r.Context(), st.State, st.Nonce, b64url.EncodeToString(sum[:]))
+	if err != nil {
+		jsonError(w, err, http.StatusBadGateway)
+		return
+	}
+
+	signed, err := rr.tokens.Keys.Sign(&st)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     IdentityStateCookieName,
+		Value:    signed,
+		Path:     "/",
+		Expires:  time.Unix(st.ExpiresAt, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// readIdentityState returns the state saved by startIdentityLogin, once
+func (rr *Router) readIdentityState(w http.ResponseWriter, r *http.Request) (*identityState, error) {
+	cookie, err := r.Cookie(IdentityStateCookieName)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     IdentityStateCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	st := identityState{}
+	return &st, rr.tokens.Keys.Parse(cookie.Value, &st)
+}
+
+// IdentityLogin starts logging in with an external provider
+func (rr *Router) IdentityLogin(w http.ResponseWriter, r *http.Request) {
+	if p := rr.provider(w, r); p != nil {
+		rr.startIdentityLogin(w, r, p, "")
+	}
+}
+
+// LinkIdentity starts linking an identity at an external provider to the
+// logged in user. It has to be visited by the user's browser.
+func (rr *Router) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(CTX_UID_KEY).(string)
+	if p := rr.provider(w, r); p != nil {
+		rr.startIdentityLogin(w, r, p, uid)
+	}
+}
+
+// IdentityCallback completes a login or link started at IdentityLogin or
+// LinkIdentity. Logging in with an unknown identity creates an activated
+// user, unless the provider hasn't verified the email, or a user already
+// has it, in which case they have to log in and link the identity.
+func (rr *Router) IdentityCallback(w http.ResponseWriter, r *http.Request) {
+	p := rr.provider(w, r)
+	if p == nil {
+		return
+	}
+	st, err := rr.readIdentityState(w, r)
+	q := r.URL.Query()
+	if err != nil || st.Provider != p.Name || st.State != q.Get("state") {
+		jsonErrorFromString(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	if q.Get("error") != "" {
+		jsonError(w, fmt.Errorf("%w: %s", ErrIdentityProviderFailed, q.Get("error")), http.StatusUnauthorized)
+		return
+	}
+	claims, err := p.exchange(r.Context(), q.Get("code"), st.Verifier, st.Nonce)
+	if err != nil {
+		jsonError(w, ErrIdentityProviderFailed, http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := rr.store.GetIdentity(r.Context(), claims.Issuer, claims.Subject)
+	if err != nil && err != ErrIdentityNotFound {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if st.LinkUserID != "" {
+		rr.linkIdentity(w, r, st.LinkUserID, identity, claims)
+		return
+	}
+	if identity != nil {
+		u, err := rr.store.GetUserByID(r.Context(), identity.UserID.String())
+		if err != nil || !u.IsActive() {
+			jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+			return
+		}
+		if u.TOTPEnabled {
+			rr.requireIdentityTOTP(w, r, p, u)
+			return
+		}
+		rr.startSession(w, r, u)
+		return
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		jsonErrorFromString(w, "the identity provider has not verified the email", http.StatusForbidden)
+		return
+	}
+	if _, err = rr.store.GetUserByEmail(r.Context(), claims.Email); err == nil {
+		jsonErrorFromString(w, "a user with this email exists, log in to link the identity", http.StatusConflict)
+		return
+	}
+
+	// the user can set a password through forgot password later
+	password, err := randomToken(32)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+	u := NewUserInStore(rr.store, name, claims.Email, []byte(password))
+	err = u.Insert()
+	if err == nil {
+		err = rr.store.Activate(r.Context(), u.ID.String())
+	}
+	if err == nil {
+		err = rr.store.LinkIdentity(r.Context(), newIdentity(u, claims))
+	}
+	if err == ErrEmailTaken {
+		jsonErrorFromString(w, "a user with this email exists, log in to link the identity", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	u.IsActivated = true
+	rr.startSession(w, r, u)
+}
+
+func newIdentity(u *User, claims *externalClaims) *Identity {
+	return &Identity{
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		UserID:  u.ID,
+		Email:   claims.Email,
+		Created: time.Now().Unix(),
+	}
+}
+
+// requireIdentityTOTP holds back the session of a user with TOTP enabled,
+// leaving a cookie to be exchanged for it at IdentityTOTP
+func (rr *Router) requireIdentityTOTP(w http.ResponseWriter, r *http.Request, p *identityProvider, u *User) {
+	st := identityTOTPState{PendingUserID: u.ID.String(), Provider: p.Name}
+	st.ExpiresAt = time.Now().Add(identityTOTPExpiry).Unix()
+	signed, err := rr.tokens.Keys.Sign(&st)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	rr.setIdentityTOTPCookie(w, r, signed, time.Unix(st.ExpiresAt, 0))
+	jsonError(w, ErrTOTPRequired, http.StatusUnauthorized)
+}
+
+func (rr *Router) setIdentityTOTPCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	c := &http.Cookie{
+		Name:     IdentityTOTPCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// IdentityTOTP completes a login at an external provider by a user with TOTP
+// enabled. Wrong codes count towards the lockout, and keep the login so that
+// the user can try again.
+func (rr *Router) IdentityTOTP(w http.ResponseWriter, r *http.Request) {
+	p := rr.provider(w, r)
+	if p == nil {
+		return
+	}
+	cookie, err := r.Cookie(IdentityTOTPCookieName)
+	st := identityTOTPState{}
+	if err == nil {
+		err = rr.tokens.Keys.Parse(cookie.Value, &st)
+	}
+	if err != nil || st.Provider != p.Name || st.PendingUserID == "" {
+		jsonErrorFromString(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	code, err := readTOTPCode(r)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	u, err := rr.store.GetUserByID(r.Context(), st.PendingUserID)
+	if err != nil || !u.IsActive() {
+		jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+		return
+	}
+	if u.TOTPEnabled && !rr.guardTOTP(w, r, u, code) {
+		return
+	}
+	rr.setIdentityTOTPCookie(w, r, "", time.Time{})
+	rr.startSession(w, r, u)
+}
+
+func (rr *Router) linkIdentity(w http.ResponseWriter, r *http.Request, uid string, identity *Identity, claims *externalClaims) {
+	u, err := rr.store.GetUserByID(r.Context(), uid)
+	if err != nil || !u.IsActive() {
+		jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+		return
+	}
+	if identity != nil {
+		if identity.UserID != u.ID {
+			jsonErrorFromString(w, "the identity is linked to another user", http.StatusConflict)
+			return
+		}
+		writeJSON(w, identity)
+		return
+	}
+
+	identity = newIdentity(u, claims)
+	err = rr.store.LinkIdentity(r.Context(), identity)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, identity)
+}
+
+func (rr *Router) ListIdentities(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(CTX_UID_KEY).(string)
+	identities, err := rr.store.GetUserIdentities(r.Context(), uid)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, identities)
+}
+
+func (rr *Router) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value(CTX_UID_KEY).(string)
+	p := rr.provider(w, r)
+	if p == nil {
+		return
+	}
+	err := rr.store.UnlinkIdentity(r.Context(), uid, p.Issuer)
+	if err == ErrIdentityNotFound {
+		jsonError(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
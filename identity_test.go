@@ -0,0 +1,315 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIssuer is a minimal OpenID Connect provider, which logs in whoever
+// its fields describe without asking
+type fakeIssuer struct {
+	ts            *httptest.Server
+	key           *rsa.PrivateKey
+	subject       string
+	email         string
+	emailVerified bool
+	audience      string
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+const fakeClientID = "usermod-client"
+const fakeClientSecret = "usermod-secret"
+
+func newFakeIssuer() *fakeIssuer {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f := &fakeIssuer{key: key, audience: fakeClientID, emailVerified: true, codes: map[string]url.Values{}}
+	r := chi.NewRouter()
+	r.Get("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(usermod.OIDCDiscoveryJSON{
+			Issuer:                f.ts.URL,
+			AuthorizationEndpoint: f.ts.URL + "/authorize",
+			TokenEndpoint:         f.ts.URL + "/token",
+			JWKSURI:               f.ts.URL + "/jwks",
+		})
+	})
+	r.Get("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		n := base64.RawURLEncoding.EncodeToString(f.key.N.Bytes())
+		json.NewEncoder(w).Encode(usermod.JWKSet{Keys: []usermod.JWK{{Kty: "RSA", Kid: "k1", N: n, E: "AQAB"}}})
+	})
+	r.Get("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := base64.RawURLEncoding.EncodeToString([]byte(time.Now().String()))
+		f.mu.Lock()
+		f.codes[code] = q
+		f.mu.Unlock()
+		redirect, _ := url.Parse(q.Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	r.Post("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		q, ok := f.codes[r.PostForm.Get("code")]
+		delete(f.codes, r.PostForm.Get("code"))
+		f.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || r.PostForm.Get("client_secret") != fakeClientSecret ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != q.Get("code_challenge") {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            f.ts.URL,
+			"sub":            f.subject,
+			"aud":            []string{f.audience},
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          q.Get("nonce"),
+			"email":          f.email,
+			"email_verified": f.emailVerified,
+			"name":           "External User",
+		})
+		token.Header["kid"] = "k1"
+		signed, _ := token.SignedString(f.key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "access_token": "x", "token_type": "Bearer"})
+	})
+	f.ts = httptest.NewServer(r)
+	return f
+}
+
+// newIdentityServer serves a router that logs in with the fake issuer
+func (s *UserModTestSuite) newIdentityServer(f *fakeIssuer) *httptest.Server {
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	r := chi.NewRouter()
+	r.Mount("/api", usermod.NewRouter(s.store, usermod.WithIdentityProvider(usermod.IdentityProviderConfig{
+		Name:         "fake",
+		Issuer:       f.ts.URL,
+		ClientID:     fakeClientID,
+		ClientSecret: fakeClientSecret,
+		RedirectURL:  ts.URL + "/api/login/fake/callback",
+	})))
+	handler = r
+	return ts
+}
+
+// browse follows redirects with a cookie jar, like a browser
+func browse(method, url, bearer string) (*http.Response, error) {
+	jar, _ := cookiejar.New(nil)
+	r, _ := http.NewRequest(method, url, nil)
+	if bearer != "" {
+		r.Header.Add("Authorization", "Bearer "+bearer)
+	}
+	return (&http.Client{Jar: jar}).Do(r)
+}
+
+func (s *UserModTestSuite) identityLogin(ts *httptest.Server) (int, *usermod.Claims) {
+	w, err := browse(http.MethodGet, ts.URL+"/api/login/fake", "")
+	assert.Nil(s.T(), err)
+	if w.StatusCode != http.StatusOK {
+		return w.StatusCode, nil
+	}
+	tok := usermod.TokenJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&tok))
+	claims, err := usermod.ParseToken(tok.Token)
+	assert.Nil(s.T(), err)
+	return w.StatusCode, claims
+}
+
+func (s *UserModTestSuite) TestIdentityLoginCreatesUser() {
+	f := newFakeIssuer()
+	defer f.ts.Close()
+	ts := s.newIdentityServer(f)
+	defer ts.Close()
+	f.subject, f.email = "external-1", "external@ummmfoo.com"
+
+	status, claims := s.identityLogin(ts)
+	assert.Equal(s.T(), http.StatusOK, status)
+	assert.Equal(s.T(), f.email, claims.Email)
+
+	u, err := usermod.GetUserByEmail(s.db, f.email)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), u.IsActivated)
+	assert.Equal(s.T(), "External User", u.Name)
+	assert.Equal(s.T(), u.ID.String(), claims.UserID)
+
+	// logging in again finds the same user
+	status, claims = s.identityLogin(ts)
+	assert.Equal(s.T(), http.StatusOK, status)
+	assert.Equal(s.T(), u.ID.String(), claims.UserID)
+
+	existing := s.newActivatedUser()
+	tests := []struct {
+		name       string
+		subject    string
+		email      string
+		verified   bool
+		audience   string
+		statusCode int
+	}{
+		{"unverified email", "external-2", "new@ummmfoo.com", false, fakeClientID, http.StatusForbidden},
+		{"email of another user", "external-3", existing.Email, true, fakeClientID, http.StatusConflict},
+		{"token for another client", "external-4", "other@ummmfoo.com", true, "someone-else", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			f.subject, f.email, f.emailVerified, f.audience = tt.subject, tt.email, tt.verified, tt.audience
+			status, _ := s.identityLogin(ts)
+			assert.Equal(t, tt.statusCode, status)
+		})
+	}
+
+	// the callback only accepts the state it sent the user off with
+	w, _ := browse(http.MethodGet, ts.URL+"/api/login/fake/callback?code=x&state=y", "")
+	assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+	w, _ = browse(http.MethodGet, ts.URL+"/api/login/unknown", "")
+	assert.Equal(s.T(), http.StatusNotFound, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestIdentityLinking() {
+	f := newFakeIssuer()
+	defer f.ts.Close()
+	ts := s.newIdentityServer(f)
+	defer ts.Close()
+
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	f.subject, f.email = "linked-1", "someone@elsewhere.com"
+
+	// linking needs a recent login, which refreshed tokens don't carry
+	tok, _ := s.loginSession(u, testPassword)
+	b, _ := json.Marshal(usermod.RefreshJSON{RefreshToken: tok.RefreshToken})
+	w, _ := http.Post(ts.URL+"/api/token/refresh", "application/json", bytes.NewReader(b))
+	refreshed := usermod.TokenJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&refreshed))
+	w, _ = browse(http.MethodGet, ts.URL+"/api/user/identities/fake/link", refreshed.Token)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+
+	w, err := browse(http.MethodGet, ts.URL+"/api/user/identities/fake/link", token)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	identity := usermod.Identity{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&identity))
+	assert.Equal(s.T(), f.ts.URL, identity.Issuer)
+	assert.Equal(s.T(), "linked-1", identity.Subject)
+
+	status, claims := s.identityLogin(ts)
+	assert.Equal(s.T(), http.StatusOK, status)
+	assert.Equal(s.T(), u.ID.String(), claims.UserID)
+
+	// an identity can only be linked to one user
+	other := usermod.NewUserWithDetails(s.db, "Other", "other@ummmfoo.com", testPassword)
+	assert.Nil(s.T(), other.Insert())
+	assert.Nil(s.T(), usermod.Activate(s.db, other.ID.String()))
+	w, _ = browse(http.MethodGet, ts.URL+"/api/user/identities/fake/link", s.login(other, testPassword))
+	assert.Equal(s.T(), http.StatusConflict, w.StatusCode)
+
+	w, _ = browse(http.MethodGet, ts.URL+"/api/user/identities", token)
+	identities := []usermod.Identity{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&identities))
+	assert.Len(s.T(), identities, 1)
+
+	w, _ = browse(http.MethodDelete, ts.URL+"/api/user/identities/fake", token)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	w, _ = browse(http.MethodDelete, ts.URL+"/api/user/identities/fake", token)
+	assert.Equal(s.T(), http.StatusNotFound, w.StatusCode)
+
+	// unlinked, the identity's email is new, so a user is created for it
+	status, claims = s.identityLogin(ts)
+	assert.Equal(s.T(), http.StatusOK, status)
+	assert.NotEqual(s.T(), u.ID.String(), claims.UserID)
+}
+
+func (s *UserModTestSuite) TestIdentityLoginWithTOTP() {
+	f := newFakeIssuer()
+	defer f.ts.Close()
+	ts := s.newIdentityServer(f)
+	defer ts.Close()
+
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	f.subject, f.email = "totp-1", "totp@elsewhere.com"
+	w, _ := browse(http.MethodGet, ts.URL+"/api/user/identities/fake/link", token)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	now := time.Now()
+	secret := s.enrollTOTP(token)
+	w = s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, now))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	// the provider's word isn't enough, the user still needs a code
+	status, claims := s.identityLogin(ts)
+	assert.Equal(s.T(), http.StatusUnauthorized, status)
+	assert.Nil(s.T(), claims)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	sendCode := func(code string) *http.Response {
+		b, _ := json.Marshal(usermod.TOTPJSON{Code: code})
+		w, err := client.Post(ts.URL+"/api/login/fake/totp", "application/json", bytes.NewReader(b))
+		assert.Nil(s.T(), err)
+		return w
+	}
+	assert.Equal(s.T(), http.StatusBadRequest, sendCode(s.totpCode(secret, now)).StatusCode)
+
+	w, err := client.Get(ts.URL + "/api/login/fake")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+	assert.Equal(s.T(), http.StatusUnauthorized, sendCode("000000").StatusCode)
+	w = sendCode(s.totpCode(secret, now.Add(30*time.Second)))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	tok := usermod.TokenJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&tok))
+	claims, err = usermod.ParseToken(tok.Token)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), u.ID.String(), claims.UserID)
+
+	// the login is used up
+	assert.Equal(s.T(), http.StatusBadRequest, sendCode(s.totpCode(secret, now.Add(60*time.Second))).StatusCode)
+}
+
+func (s *UserModTestSuite) TestStoreIdentities() {
+	ctx := context.Background()
+	for name, store := range s.stores() {
+		s.T().Run(name, func(t *testing.T) {
+			u := usermod.NewUserInStore(store, "Chayim", name+"@ummmfoo.com", testPassword)
+			assert.Nil(t, u.Insert())
+
+			i := &usermod.Identity{Issuer: "https://idp", Subject: "sub", UserID: u.ID, Email: u.Email}
+			assert.Nil(t, store.LinkIdentity(ctx, i))
+			assert.NotNil(t, store.LinkIdentity(ctx, i))
+
+			found, err := store.GetIdentity(ctx, "https://idp", "sub")
+			assert.Nil(t, err)
+			assert.Equal(t, u.ID, found.UserID)
+			_, err = store.GetIdentity(ctx, "https://other", "sub")
+			assert.Equal(t, usermod.ErrIdentityNotFound, err)
+
+			identities, err := store.GetUserIdentities(ctx, u.ID.String())
+			assert.Nil(t, err)
+			assert.Len(t, identities, 1)
+
+			assert.Nil(t, store.UnlinkIdentity(ctx, u.ID.String(), "https://idp"))
+			assert.Equal(t, usermod.ErrIdentityNotFound, store.UnlinkIdentity(ctx, u.ID.String(), "https://idp"))
+		})
+	}
+}
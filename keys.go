@@ -0,0 +1,184 @@
+package usermod
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+var ErrSymmetricKey = errors.New("symmetric keys can't sign tokens verified by others")
+
+// SigningKey signs tokens, which carry its ID in the kid header
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	key    interface{}
+	public interface{}
+}
+
+// NewHMACKey signs with HS256. The secret also verifies, so HMAC keys
+// are never published in the key set.
+func NewHMACKey(id string, secret []byte) *SigningKey {
+	return &SigningKey{ID: id, Method: jwt.SigningMethodHS256, key: secret, public: secret}
+}
+
+// NewRSAKey signs with RS256
+func NewRSAKey(id string, key *rsa.PrivateKey) *SigningKey {
+	return &SigningKey{ID: id, Method: jwt.SigningMethodRS256, key: key, public: &key.PublicKey}
+}
+
+// NewECDSAKey signs with ES256, and so needs a P-256 key
+func NewECDSAKey(id string, key *ecdsa.PrivateKey) (*SigningKey, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("ecdsa signing keys must use the P-256 curve")
+	}
+	return &SigningKey{ID: id, Method: jwt.SigningMethodES256, key: key, public: &key.PublicKey}, nil
+}
+
+// NewEd25519Key signs with EdDSA
+func NewEd25519Key(id string, key ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, key: key, public: key.Public()}
+}
+
+// IsSymmetric is true for keys that can't be published
+func (k *SigningKey) IsSymmetric() bool {
+	_, ok := k.Method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+// JWK returns the public key, which symmetric keys don't have
+func (k *SigningKey) JWK() (JWK, bool) {
+	enc := base64.RawURLEncoding
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		return rsaJWK(pub, k.ID), true
+	case *ecdsa.PublicKey:
+		return JWK{
+			Kty: "EC",
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			Kid: k.ID,
+			Crv: "P-256",
+			X:   enc.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			Y:   enc.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Use: "sig", Alg: k.Method.Alg(), Kid: k.ID, Crv: "Ed25519", X: enc.EncodeToString(pub)}, true
+	}
+	return JWK{}, false
+}
+
+// KeySet signs with its current key and verifies with any of its keys, so
+// that tokens signed before a rotation stay valid until the old key is
+// removed. It is safe for concurrent use.
+type KeySet struct {
+	mu      sync.RWMutex
+	keys    map[string]*SigningKey
+	current string
+}
+
+// NewKeySet signs with current, and also verifies with the others
+func NewKeySet(current *SigningKey, others ...*SigningKey) *KeySet {
+	ks := &KeySet{keys: map[string]*SigningKey{}}
+	for _, k := range others {
+		ks.Add(k)
+	}
+	ks.Rotate(current)
+	return ks
+}
+
+// Add accepts tokens signed with the key, without signing with it
+func (ks *KeySet) Add(k *SigningKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[k.ID] = k
+}
+
+// Rotate signs new tokens with the key. The previous key is kept for
+// verification until it is removed.
+func (ks *KeySet) Rotate(k *SigningKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[k.ID] = k
+	ks.current = k.ID
+}
+
+// Remove stops accepting tokens signed with the key. The current key can't
+// be removed.
+func (ks *KeySet) Remove(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if id == ks.current {
+		return errors.New("the current signing key can't be removed")
+	}
+	delete(ks.keys, id)
+	return nil
+}
+
+func (ks *KeySet) Current() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[ks.current]
+}
+
+// Sign signs the claims with the current key
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	k := ks.Current()
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.key)
+}
+
+// Parse verifies the token with the key its kid names, into claims.
+// Tokens without a kid, issued before key sets, are verified with the
+// current key. The algorithm must be the key's own.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		ks.mu.RLock()
+		k, ok := ks.keys[kid]
+		if kid == "" {
+			k, ok = ks.keys[ks.current], true
+		}
+		ks.mu.RUnlock()
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		if t.Method.Alg() != k.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return k.public, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !token.Valid {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// JWKS returns the public keys, for services verifying tokens themselves
+func (ks *KeySet) JWKS() JWKSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range ks.keys {
+		if jwk, ok := k.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
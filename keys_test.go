@@ -0,0 +1,187 @@
+package usermod_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) TestAsymmetricTokens() {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	es256, err := usermod.NewECDSAKey("ec", ecKey)
+	assert.Nil(s.T(), err)
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err = usermod.NewECDSAKey("p384", p384)
+	assert.NotNil(s.T(), err)
+
+	u := s.newActivatedUser()
+	tests := []struct {
+		name string
+		key  *usermod.SigningKey
+	}{
+		{"RS256", usermod.NewRSAKey("rsa", rsaKey)},
+		{"ES256", es256},
+		{"EdDSA", usermod.NewEd25519Key("ed", edKey)},
+	}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			cfg := usermod.NewTokenConfig(usermod.NewKeySet(tc.key), 0)
+			ts := httptest.NewServer(usermod.NewRouter(s.store, usermod.WithTokenConfig(cfg)))
+			defer ts.Close()
+
+			token := s.loginAt(ts.URL, u, testPassword)
+			assert.NotEqual(t, "", token)
+
+			// services verify tokens with the published keys alone
+			w, err := http.Get(ts.URL + "/.well-known/jwks.json")
+			assert.Nil(t, err)
+			set := usermod.JWKSet{}
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(&set))
+			assert.Len(t, set.Keys, 1)
+			assert.Equal(t, tc.key.ID, set.Keys[0].Kid)
+			assert.Equal(t, tc.name, set.Keys[0].Alg)
+			pub, err := set.Keys[0].PublicKey()
+			assert.Nil(t, err)
+
+			claims := usermod.Claims{}
+			parsed, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+				return pub, nil
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.name, parsed.Method.Alg())
+			assert.Equal(t, tc.key.ID, parsed.Header["kid"])
+			assert.Equal(t, u.ID.String(), claims.UserID)
+
+			r, _ := http.NewRequest(http.MethodGet, ts.URL+"/user", nil)
+			r.Header.Add("Authorization", "Bearer "+token)
+			w, _ = http.DefaultClient.Do(r)
+			assert.Equal(t, http.StatusOK, w.StatusCode)
+
+			// the test router's tokens are signed with a different key
+			r.Header.Set("Authorization", "Bearer "+s.login(u, testPassword))
+			w, _ = http.DefaultClient.Do(r)
+			assert.Equal(t, http.StatusUnauthorized, w.StatusCode)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestKeyRotation() {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := usermod.NewKeySet(usermod.NewRSAKey("2024", rsaKey))
+	cfg := usermod.NewTokenConfig(keys, time.Minute)
+	u := s.newActivatedUser()
+
+	old, err := cfg.CreateToken(u, nil)
+	assert.Nil(s.T(), err)
+
+	keys.Rotate(usermod.NewEd25519Key("2025", edKey))
+	current, err := cfg.CreateToken(u, nil)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "2025", keys.Current().ID)
+	assert.Len(s.T(), keys.JWKS().Keys, 2)
+
+	_, err = cfg.ParseToken(old)
+	assert.Nil(s.T(), err)
+	_, err = cfg.ParseToken(current)
+	assert.Nil(s.T(), err)
+
+	assert.NotNil(s.T(), keys.Remove("2025"))
+	assert.Nil(s.T(), keys.Remove("2024"))
+	_, err = cfg.ParseToken(old)
+	assert.NotNil(s.T(), err)
+	_, err = cfg.ParseToken(current)
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), keys.JWKS().Keys, 1)
+
+	forged := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, &usermod.Claims{UserID: u.ID.String()})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, _ := token.SignedString(key)
+		return signed
+	}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"unknown kid", forged(jwt.SigningMethodRS256, "2024", rsaKey)},
+		{"algorithm confusion", forged(jwt.SigningMethodHS256, "2025", []byte(edKey.Public().(ed25519.PublicKey)))},
+		{"no kid", forged(jwt.SigningMethodHS256, "", []byte("secret"))},
+	}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			_, err := cfg.ParseToken(tc.token)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestHMACKeysArePrivate() {
+	keys := usermod.NewKeySet(usermod.NewHMACKey("", []byte("secret")))
+	assert.True(s.T(), keys.Current().IsSymmetric())
+	assert.Len(s.T(), keys.JWKS().Keys, 0)
+
+	// the default router signs with JWT_SECRET, and publishes nothing
+	w, err := http.Get(s.ts.URL + "/api/.well-known/jwks.json")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	set := usermod.JWKSet{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&set))
+	assert.Len(s.T(), set.Keys, 0)
+
+	// nor can it sign ID tokens for other services to verify
+	cfg := usermod.OIDCProviderConfig{Issuer: "https://localhost"}
+	_, err = cfg.CreateIDToken(keys, s.newActivatedUser(), &usermod.OAuthCode{Scope: "openid"})
+	assert.Equal(s.T(), usermod.ErrSymmetricKey, err)
+}
+
+func (s *UserModTestSuite) TestTokenConfigFromEnv() {
+	tests := []struct {
+		name     string
+		secret   string
+		cacheURL string
+		ok       bool
+	}{
+		{"secret", "secret", "", true},
+		{"secret and redis", "secret", "redis://localhost:6379", true},
+		{"no secret", "", "", false},
+		{"invalid cache url", "secret", "not a url", false},
+	}
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_SECRET", tt.secret)
+			t.Setenv("CACHE_URL", tt.cacheURL)
+			cfg, err := usermod.TokenConfigFromEnv()
+			assert.Equal(t, tt.ok, err == nil)
+			assert.Equal(t, tt.ok, cfg != nil)
+			if tt.ok {
+				assert.NotPanics(t, func() { usermod.NewRouter(s.store) })
+			} else {
+				assert.Panics(t, func() { usermod.NewRouter(s.store) })
+			}
+		})
+	}
+
+	s.T().Setenv("JWT_SECRET", "")
+	_, err := usermod.TokenConfigFromEnv()
+	assert.Equal(s.T(), usermod.ErrJWTSecretMissing, err)
+	// a router given its keys doesn't need the environment
+	cfg := usermod.NewTokenConfig(usermod.NewKeySet(usermod.NewHMACKey("", []byte("secret"))), time.Minute)
+	assert.NotPanics(s.T(), func() { usermod.NewRouter(s.store, usermod.WithTokenConfig(cfg)) })
+}
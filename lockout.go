@@ -0,0 +1,250 @@
+package usermod
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+var ErrAccountLocked = errors.New("account temporarily locked")
+var ErrTooManyAttempts = errors.New("too many failed login attempts")
+
+// LockoutError refuses a login without checking its credentials
+type LockoutError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LockoutError) Unwrap() error {
+	return e.Err
+}
+
+// LoginAttempts counts the consecutive failed logins for an account or an
+// IP address. Times are in unix milliseconds.
+type LoginAttempts struct {
+	Failures    int
+	LastFailure int64
+	LockedUntil int64
+}
+
+// LoginAttemptStore persists failed login counters. Attempts are counted as
+// failures before they are made, so that concurrent guesses can't overtake
+// the count: TakeLoginAttempt refuses a locked key, and otherwise counts the
+// attempt and locks the key for lock once there are max, in one operation.
+// It reports whether the attempt was taken. Earlier failures are forgotten
+// when the last was longer than window ago, or once a lock has ended.
+// ReturnLoginAttempt uncounts an attempt that didn't fail, lifting the lock
+// it may have set.
+type LoginAttemptStore interface {
+	TakeLoginAttempt(ctx context.Context, key string, max int, window, lock time.Duration) (*LoginAttempts, bool, error)
+	ReturnLoginAttempt(ctx context.Context, key string) error
+	GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error)
+	ResetLoginAttempts(ctx context.Context, key string) error
+}
+
+// Lockout slows down and then stops password guessing. Failures count
+// against both the account and the client's IP address. From the second
+// consecutive failure, each delays the next attempt at the account, from
+// BaseDelay doubling up to MaxDelay. MaxAccountFailures lock the account,
+// and MaxIPFailures the address, for Duration. Failures are forgotten after
+// Window without another, when the lock ends, and the account's on a
+// successful login.
+type Lockout struct {
+	Attempts           LoginAttemptStore
+	MaxAccountFailures int
+	MaxIPFailures      int
+	Window             time.Duration
+	Duration           time.Duration
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+	// OnLock is called when an account is locked, such as to tell the user
+	OnLock func(ctx context.Context, u *User, until time.Time) error
+}
+
+// NewLockout locks accounts after 5 failures and addresses after 100, for
+// 15 minutes
+func NewLockout(attempts LoginAttemptStore) *Lockout {
+	return &Lockout{
+		Attempts:           attempts,
+		MaxAccountFailures: 5,
+		MaxIPFailures:      100,
+		Window:             15 * time.Minute,
+		Duration:           15 * time.Minute,
+		BaseDelay:          time.Second,
+		MaxDelay:           30 * time.Second,
+	}
+}
+
+func accountKey(u *User) string {
+	return "user:" + u.ID.String()
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP is the address the request came from. Behind a proxy, mount
+// chi's middleware.RealIP first.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// delay is how long to wait after the failures before trying again
+func (l *Lockout) delay(failures int) time.Duration {
+	if failures < 2 || l.BaseDelay <= 0 {
+		return 0
+	}
+	d := l.BaseDelay
+	for i := 2; i < failures && d < l.MaxDelay; i++ {
+		d *= 2
+	}
+	if l.MaxDelay > 0 && d > l.MaxDelay {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+// check refuses the key while it is locked, or until its delay has passed.
+// It spares a refused login the counters, which take decides on.
+func (l *Lockout) check(ctx context.Context, key string, now time.Time) error {
+	a, err := l.Attempts.GetLoginAttempts(ctx, key)
+	if err != nil {
+		return err
+	}
+	if until := time.UnixMilli(a.LockedUntil); until.After(now) {
+		return &LockoutError{Err: ErrAccountLocked, RetryAfter: until.Sub(now)}
+	}
+	if now.Sub(time.UnixMilli(a.LastFailure)) > l.Window {
+		return nil
+	}
+	if next := time.UnixMilli(a.LastFailure).Add(l.delay(a.Failures)); next.After(now) {
+		return &LockoutError{Err: ErrTooManyAttempts, RetryAfter: next.Sub(now)}
+	}
+	return nil
+}
+
+// take counts an attempt against the key, refusing it while the key is
+// locked
+func (l *Lockout) take(ctx context.Context, key string, max int, now time.Time) (*LoginAttempts, error) {
+	a, ok, err := l.Attempts.TakeLoginAttempt(ctx, key, max, l.Window, l.Duration)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &LockoutError{Err: ErrAccountLocked, RetryAfter: time.UnixMilli(a.LockedUntil).Sub(now)}
+	}
+	return a, nil
+}
+
+// Guard runs attempt unless the account or the IP address is locked out,
+// and counts its failure against both. u is nil for unknown accounts, whose
+// attempts count against the address alone. ErrTOTPRequired, returned once
+// the password is known to be right, isn't counted. A nil Lockout only runs
+// attempt.
+func (l *Lockout) Guard(ctx context.Context, u *User, ip string, attempt func() error) error {
+	if l == nil {
+		return attempt()
+	}
+	now := time.Now()
+	if u != nil {
+		if err := l.check(ctx, accountKey(u), now); err != nil {
+			return err
+		}
+	}
+	if _, err := l.take(ctx, ipKey(ip), l.MaxIPFailures, now); err != nil {
+		return err
+	}
+	var account *LoginAttempts
+	if u != nil {
+		var err error
+		if account, err = l.take(ctx, accountKey(u), l.MaxAccountFailures, now); err != nil {
+			if rerr := l.Attempts.ReturnLoginAttempt(ctx, ipKey(ip)); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+	}
+
+	err := attempt()
+	if err == nil || err == ErrTOTPRequired {
+		if rerr := l.Attempts.ReturnLoginAttempt(ctx, ipKey(ip)); rerr != nil {
+			return rerr
+		}
+		if u == nil {
+			return err
+		}
+		if err == nil {
+			return l.Attempts.ResetLoginAttempts(ctx, accountKey(u))
+		}
+		if rerr := l.Attempts.ReturnLoginAttempt(ctx, accountKey(u)); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+
+	// the attempt that reached the limit tells the user
+	if account != nil && l.MaxAccountFailures > 0 && account.Failures == l.MaxAccountFailures && l.OnLock != nil {
+		if ferr := l.OnLock(ctx, u, time.UnixMilli(account.LockedUntil)); ferr != nil {
+			return ferr
+		}
+	}
+	return err
+}
+
+// Unlock forgets the account's failures, lifting any lock
+func (l *Lockout) Unlock(ctx context.Context, u *User) error {
+	if l == nil {
+		return nil
+	}
+	return l.Attempts.ResetLoginAttempts(ctx, accountKey(u))
+}
+
+// login authenticates the email and password, and the TOTP code when the
+// user has enabled it, subject to the lockout. Codes are only accepted once
+// when consume is set.
+func (l *Lockout) login(ctx context.Context, store UserStore, ip, email string, password []byte, code string, consume bool) (*User, error) {
+	u, err := store.GetActiveUserByEmail(ctx, email)
+	if err != nil || !u.IsActive() {
+		u = nil
+	}
+	err = l.Guard(ctx, u, ip, func() error {
+		if u == nil {
+			// hash anyway, so that the time taken doesn't tell which
+			// emails have accounts
+			verifyPassword(dummyPasswordHash(), password)
+			return ErrInvalidCredentials
+		}
+		if u.validatePassword(password) != nil {
+			return ErrInvalidCredentials
+		}
+		if u.TOTPEnabled {
+			return verifyTOTP(ctx, store, u, code, consume)
+		}
+		return nil
+	})
+	return u, err
+}
+
+// writeLockoutError responds to logins refused by the lockout
+func writeLockoutError(w http.ResponseWriter, err *LockoutError) {
+	setRetryAfter(w, err.RetryAfter)
+	jsonError(w, err, http.StatusTooManyRequests)
+}
+
+// setRetryAfter rounds up to whole seconds, so that clients don't retry early
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := int64((d + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+}
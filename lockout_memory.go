@@ -0,0 +1,65 @@
+package usermod
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLoginAttemptStore keeps failed login counters in process memory,
+// which suits tests and single instance deployments.
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempts
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: map[string]LoginAttempts{}}
+}
+
+func (s *MemoryLoginAttemptStore) TakeLoginAttempt(ctx context.Context, key string, max int, window, lock time.Duration) (*LoginAttempts, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixMilli()
+	a := s.attempts[key]
+	if a.LockedUntil > now {
+		return &a, false, nil
+	}
+	if a.LockedUntil > 0 || a.LastFailure < now-window.Milliseconds() {
+		a = LoginAttempts{}
+	}
+	a.Failures++
+	a.LastFailure = now
+	if max > 0 && a.Failures >= max {
+		a.LockedUntil = now + lock.Milliseconds()
+	}
+	s.attempts[key] = a
+	return &a, true, nil
+}
+
+func (s *MemoryLoginAttemptStore) ReturnLoginAttempt(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attempts[key]
+	if !ok || a.Failures == 0 {
+		return nil
+	}
+	a.Failures--
+	a.LockedUntil = 0
+	s.attempts[key] = a
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.attempts[key]
+	return &a, nil
+}
+
+func (s *MemoryLoginAttemptStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
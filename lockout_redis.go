@@ -0,0 +1,103 @@
+package usermod
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisLoginAttemptStore keeps failed login counters in redis, shared by
+// every instance of the application. Counters expire after the window, or
+// when their lock is lifted if that is later.
+type RedisLoginAttemptStore struct {
+	client *redis.Client
+}
+
+var redisLoginFailuresPrefix = "usermod:login_failures:"
+
+// takeAttemptScript refuses the key while it is locked, and otherwise
+// counts the attempt, locking the key once there are max. It returns
+// whether the attempt was taken, and the counters.
+var takeAttemptScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+local lock = tonumber(ARGV[4])
+local a = redis.call('HMGET', KEYS[1], 'failures', 'last_failure', 'locked_until')
+local failures = tonumber(a[1] or '0')
+local last = tonumber(a[2] or '0')
+local locked = tonumber(a[3] or '0')
+if locked > now then
+	return {0, failures, last, locked}
+end
+if locked > 0 or last < now - window then
+	failures = 0
+end
+failures = failures + 1
+locked = 0
+local ttl = window
+if max > 0 and failures >= max then
+	locked = now + lock
+	ttl = math.max(window, lock)
+end
+redis.call('HSET', KEYS[1], 'failures', failures, 'last_failure', now, 'locked_until', locked)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {1, failures, now, locked}
+`)
+
+// returnAttemptScript uncounts an attempt, lifting the lock it may have set
+var returnAttemptScript = redis.NewScript(`
+local failures = tonumber(redis.call('HGET', KEYS[1], 'failures') or '0')
+if failures > 0 then
+	redis.call('HSET', KEYS[1], 'failures', failures - 1, 'locked_until', 0)
+end
+return 0
+`)
+
+// NewRedisLoginAttemptStore connects to the redis server at url. An empty
+// url falls back to CACHE_URL.
+func NewRedisLoginAttemptStore(url string) (*RedisLoginAttemptStore, error) {
+	if url == "" {
+		url = CacheURL()
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisLoginAttemptStoreWithClient(redis.NewClient(opts)), nil
+}
+
+func NewRedisLoginAttemptStoreWithClient(client *redis.Client) *RedisLoginAttemptStore {
+	return &RedisLoginAttemptStore{client: client}
+}
+
+func (s *RedisLoginAttemptStore) TakeLoginAttempt(ctx context.Context, key string, max int, window, lock time.Duration) (*LoginAttempts, bool, error) {
+	res, err := takeAttemptScript.Run(ctx, s.client, []string{redisLoginFailuresPrefix + key},
+		time.Now().UnixMilli(), window.Milliseconds(), max, lock.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, false, err
+	}
+	return &LoginAttempts{Failures: int(res[1]), LastFailure: res[2], LockedUntil: res[3]}, res[0] == 1, nil
+}
+
+func (s *RedisLoginAttemptStore) ReturnLoginAttempt(ctx context.Context, key string) error {
+	return returnAttemptScript.Run(ctx, s.client, []string{redisLoginFailuresPrefix + key}).Err()
+}
+
+func (s *RedisLoginAttemptStore) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	f, err := s.client.HGetAll(ctx, redisLoginFailuresPrefix+key).Result()
+	if err != nil {
+		return nil, err
+	}
+	a := LoginAttempts{}
+	a.Failures, _ = strconv.Atoi(f["failures"])
+	a.LastFailure, _ = strconv.ParseInt(f["last_failure"], 10, 64)
+	a.LockedUntil, _ = strconv.ParseInt(f["locked_until"], 10, 64)
+	return &a, nil
+}
+
+func (s *RedisLoginAttemptStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	return s.client.Del(ctx, redisLoginFailuresPrefix+key).Err()
+}
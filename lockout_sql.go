@@ -0,0 +1,91 @@
+package usermod
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// SQLLoginAttemptStore keeps failed login counters in the same database as
+// the users table. Its table is created by Migrate.
+type SQLLoginAttemptStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+var loginAttemptTblName = "login_attempts"
+
+// NewSQLLoginAttemptStore creates a store, detecting the dialect from the
+// driver
+func NewSQLLoginAttemptStore(db *sql.DB) *SQLLoginAttemptStore {
+	return NewSQLLoginAttemptStoreWithDialect(db, DetectDialect(db))
+}
+
+func NewSQLLoginAttemptStoreWithDialect(db *sql.DB, dialect Dialect) *SQLLoginAttemptStore {
+	return &SQLLoginAttemptStore{db: db, dialect: dialect}
+}
+
+// TakeLoginAttempt decides in a single conditional update, so that
+// concurrent attempts are all counted and none is taken past the lock. The
+// counters the update builds on are first forgotten if they are stale,
+// which concurrent attempts may do again harmlessly.
+func (s *SQLLoginAttemptStore) TakeLoginAttempt(ctx context.Context, key string, max int, window, lock time.Duration) (*LoginAttempts, bool, error) {
+	query := s.dialect.InsertIgnore(loginAttemptTblName, "attempt_key, failures, last_failure, locked_until",
+		"$1, 0, 0, 0", "attempt_key")
+	if _, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), key); err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UnixMilli()
+	query = fmt.Sprintf(`UPDATE %s SET failures = 0, locked_until = 0
+		WHERE attempt_key = $1 AND locked_until <= $2 AND (locked_until > 0 OR last_failure < $3)`, loginAttemptTblName)
+	if _, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), key, now, now-window.Milliseconds()); err != nil {
+		return nil, false, err
+	}
+
+	if max <= 0 {
+		max = math.MaxInt32
+	}
+	// mysql assigns in order, seeing the columns already assigned, so
+	// locked_until goes first
+	query = fmt.Sprintf(`UPDATE %s SET
+		locked_until = CASE WHEN failures + 1 >= $1 THEN $2 ELSE 0 END,
+		failures = failures + 1,
+		last_failure = $3
+		WHERE attempt_key = $4 AND locked_until <= $5`, loginAttemptTblName)
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), max, now+lock.Milliseconds(), now, key, now)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	a, err := s.GetLoginAttempts(ctx, key)
+	return a, n > 0, err
+}
+
+func (s *SQLLoginAttemptStore) ReturnLoginAttempt(ctx context.Context, key string) error {
+	query := fmt.Sprintf("UPDATE %s SET locked_until = 0, failures = failures - 1 WHERE attempt_key = $1 AND failures > 0",
+		loginAttemptTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), key)
+	return err
+}
+
+func (s *SQLLoginAttemptStore) GetLoginAttempts(ctx context.Context, key string) (*LoginAttempts, error) {
+	a := LoginAttempts{}
+	query := fmt.Sprintf("SELECT failures, last_failure, locked_until FROM %s WHERE attempt_key = $1", loginAttemptTblName)
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), key).Scan(&a.Failures, &a.LastFailure, &a.LockedUntil)
+	if err == sql.ErrNoRows {
+		return &a, nil
+	}
+	return &a, err
+}
+
+func (s *SQLLoginAttemptStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE attempt_key = $1", loginAttemptTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), key)
+	return err
+}
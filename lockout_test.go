@@ -0,0 +1,202 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chayim/usermod"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// loginStatus attempts to log in at the router, returning the response
+func loginStatus(base, email string, password []byte) *http.Response {
+	b, _ := json.Marshal(usermod.LoginJSON{Email: email, Password: string(password)})
+	w, _ := http.Post(base+"/login", "application/json", bytes.NewReader(b))
+	return w
+}
+
+func (s *UserModTestSuite) TestLockout() {
+	lockout := usermod.NewLockout(s.store.LoginAttempts())
+	lockout.MaxAccountFailures = 3
+	lockout.MaxIPFailures = 6
+	lockout.BaseDelay = 0
+	notifier := usermod.NewRecordingNotifier()
+	ts := httptest.NewServer(usermod.NewRouter(s.store, usermod.WithLockout(lockout), usermod.WithNotifier(notifier),
+		usermod.WithTokenConfig(s.tokens)))
+	defer ts.Close()
+
+	u := s.newActivatedUser()
+	for i := 0; i < 3; i++ {
+		assert.Equal(s.T(), http.StatusUnauthorized, loginStatus(ts.URL, u.Email, []byte("wrong")).StatusCode)
+	}
+
+	// the right password is refused until the lock ends
+	w := loginStatus(ts.URL, u.Email, testPassword)
+	assert.Equal(s.T(), http.StatusTooManyRequests, w.StatusCode)
+	assert.Equal(s.T(), "900", w.Header.Get("Retry-After"))
+	n, ok := notifier.Last()
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), usermod.AccountLockedNotice, n.TokenType)
+	assert.Equal(s.T(), u.Email, n.To)
+	assert.Equal(s.T(), "Your account has been locked", n.Subject)
+
+	// both routers keep their counters in the store
+	admin := s.newAdmin()
+	assert.Equal(s.T(), http.StatusOK, s.adminRequest(admin, http.MethodPost, "/users/"+u.ID.String()+"/unlock").StatusCode)
+	assert.Equal(s.T(), http.StatusOK, loginStatus(ts.URL, u.Email, testPassword).StatusCode)
+
+	// unknown emails count against the address alone
+	for i := 0; i < 3; i++ {
+		assert.Equal(s.T(), http.StatusUnauthorized, loginStatus(ts.URL, "nobody@ummmfoo.com", testPassword).StatusCode)
+	}
+	assert.Equal(s.T(), http.StatusTooManyRequests, loginStatus(ts.URL, u.Email, testPassword).StatusCode)
+	assert.Nil(s.T(), s.store.LoginAttempts().ResetLoginAttempts(context.Background(), "ip:127.0.0.1"))
+	assert.Equal(s.T(), http.StatusOK, loginStatus(ts.URL, u.Email, testPassword).StatusCode)
+}
+
+func (s *UserModTestSuite) TestLockoutDelay() {
+	ctx := context.Background()
+	lockout := usermod.NewLockout(usermod.NewMemoryLoginAttemptStore())
+	lockout.BaseDelay = 10 * time.Second
+	u := s.newActivatedUser()
+
+	attempts := 0
+	fail := func() error {
+		attempts++
+		return usermod.ErrInvalidCredentials
+	}
+	assert.Equal(s.T(), usermod.ErrInvalidCredentials, lockout.Guard(ctx, u, "10.0.0.1", fail))
+	assert.Equal(s.T(), usermod.ErrInvalidCredentials, lockout.Guard(ctx, u, "10.0.0.1", fail))
+
+	// the delay applies to the account, from any address
+	err := lockout.Guard(ctx, u, "10.0.0.2", fail)
+	locked := &usermod.LockoutError{}
+	assert.True(s.T(), errors.As(err, &locked))
+	assert.Equal(s.T(), usermod.ErrTooManyAttempts, locked.Err)
+	assert.InDelta(s.T(), 10*time.Second, locked.RetryAfter, float64(time.Second))
+	assert.Equal(s.T(), 2, attempts)
+
+	// a password that is right but missing its TOTP code isn't a failure
+	assert.Nil(s.T(), lockout.Unlock(ctx, u))
+	for i := 0; i < 3; i++ {
+		assert.Equal(s.T(), usermod.ErrTOTPRequired, lockout.Guard(ctx, u, "10.0.0.1", func() error {
+			return usermod.ErrTOTPRequired
+		}))
+	}
+}
+
+func (s *UserModTestSuite) TestLoginAttemptStores() {
+	ctx := context.Background()
+	mr := miniredis.RunT(s.T())
+	stores := map[string]usermod.LoginAttemptStore{
+		"sql":    s.store.LoginAttempts(),
+		"redis":  usermod.NewRedisLoginAttemptStoreWithClient(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		"memory": usermod.NewMemoryLoginAttemptStore(),
+	}
+	for name, store := range stores {
+		s.T().Run(name, func(t *testing.T) {
+			a, err := store.GetLoginAttempts(ctx, "key")
+			assert.Nil(t, err)
+			assert.Equal(t, 0, a.Failures)
+
+			// the attempt reaching max locks the key, and the next is
+			// refused
+			var ok bool
+			for i := 1; i <= 3; i++ {
+				a, ok, err = store.TakeLoginAttempt(ctx, "key", 3, time.Minute, time.Minute)
+				assert.Nil(t, err)
+				assert.True(t, ok)
+				assert.Equal(t, i, a.Failures)
+			}
+			assert.InDelta(t, time.Now().Add(time.Minute).UnixMilli(), a.LockedUntil, 5000)
+			a, ok, err = store.TakeLoginAttempt(ctx, "key", 3, time.Minute, time.Minute)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			assert.Equal(t, 3, a.Failures)
+			a, err = store.GetLoginAttempts(ctx, "key")
+			assert.Nil(t, err)
+			assert.Equal(t, 3, a.Failures)
+			assert.NotZero(t, a.LockedUntil)
+			assert.InDelta(t, time.Now().UnixMilli(), a.LastFailure, 5000)
+
+			// returning the attempt that locked lifts the lock
+			assert.Nil(t, store.ReturnLoginAttempt(ctx, "key"))
+			a, err = store.GetLoginAttempts(ctx, "key")
+			assert.Nil(t, err)
+			assert.Equal(t, 2, a.Failures)
+			assert.Equal(t, int64(0), a.LockedUntil)
+
+			// failures older than the window are forgotten
+			_, _, err = store.TakeLoginAttempt(ctx, "other", 0, time.Millisecond, time.Minute)
+			assert.Nil(t, err)
+			time.Sleep(5 * time.Millisecond)
+			mr.FastForward(5 * time.Millisecond)
+			a, ok, err = store.TakeLoginAttempt(ctx, "other", 0, time.Millisecond, time.Minute)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, 1, a.Failures)
+			assert.Equal(t, int64(0), a.LockedUntil)
+
+			// and so are those before a lock that has ended
+			_, ok, err = store.TakeLoginAttempt(ctx, "locked", 1, time.Minute, time.Millisecond)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			time.Sleep(5 * time.Millisecond)
+			a, ok, err = store.TakeLoginAttempt(ctx, "locked", 2, time.Minute, time.Millisecond)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, 1, a.Failures)
+
+			assert.Nil(t, store.ResetLoginAttempts(ctx, "key"))
+			a, err = store.GetLoginAttempts(ctx, "key")
+			assert.Nil(t, err)
+			assert.Equal(t, 0, a.Failures)
+			assert.Equal(t, int64(0), a.LockedUntil)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestLockoutConcurrentAttempts() {
+	ctx := context.Background()
+	mr := miniredis.RunT(s.T())
+	stores := map[string]usermod.LoginAttemptStore{
+		"sql":    s.store.LoginAttempts(),
+		"redis":  usermod.NewRedisLoginAttemptStoreWithClient(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		"memory": usermod.NewMemoryLoginAttemptStore(),
+	}
+	u := s.newActivatedUser()
+	for name, store := range stores {
+		s.T().Run(name, func(t *testing.T) {
+			lockout := usermod.NewLockout(store)
+			lockout.BaseDelay = 0
+
+			// guesses made at once are held to the limit all the same
+			var attempts atomic.Int32
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					lockout.Guard(ctx, u, "10.0.0.1", func() error {
+						attempts.Add(1)
+						time.Sleep(10 * time.Millisecond)
+						return usermod.ErrInvalidCredentials
+					})
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, int32(lockout.MaxAccountFailures), attempts.Load())
+			assert.Nil(t, store.ResetLoginAttempts(ctx, "ip:10.0.0.1"))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package usermod_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) sendMagicLink(email string) int {
+	b, _ := json.Marshal(usermod.MagicLinkJSON{Email: email})
+	r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/login/magic", bytes.NewReader(b))
+	w, _ := http.DefaultClient.Do(r)
+	return w.StatusCode
+}
+
+func (s *UserModTestSuite) magicLinkLogin(query string) *http.Response {
+	r, _ := http.NewRequest(http.MethodGet, s.ts.URL+"/api/login/magic?"+query, nil)
+	w, _ := http.DefaultClient.Do(r)
+	return w
+}
+
+func (s *UserModTestSuite) TestMagicLinkLogin() {
+	u := s.newActivatedUser()
+	inactive := usermod.NewUserWithDetails(s.db, "Inactive", "inactive@ummmfoo.com", testPassword)
+	assert.Nil(s.T(), inactive.Insert())
+
+	assert.Equal(s.T(), http.StatusBadRequest, s.sendMagicLink(""))
+	// unknown and inactive emails look the same, but get no mail
+	sent := len(s.notifier.Notifications())
+	assert.Equal(s.T(), http.StatusOK, s.sendMagicLink("nobody@ummmfoo.com"))
+	assert.Equal(s.T(), http.StatusOK, s.sendMagicLink(inactive.Email))
+	assert.Len(s.T(), s.notifier.Notifications(), sent)
+	assert.Equal(s.T(), http.StatusOK, s.sendMagicLink(u.Email))
+	assert.Len(s.T(), s.notifier.Notifications(), sent+1)
+
+	n, ok := s.notifier.Last()
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), usermod.MagicLinkToken, n.TokenType)
+	assert.Equal(s.T(), u.Email, n.To)
+	token := strings.TrimSpace(strings.Split(strings.Split(n.Text, "log in: ")[1], "\n")[0])
+
+	uot, err := usermod.GetUserOperationToken(s.db, token)
+	assert.Nil(s.T(), err)
+	assert.WithinDuration(s.T(), time.Now().Add(usermod.MagicLinkDefaultExpiry), time.Unix(uot.Expiry, 0), time.Minute)
+
+	w := s.magicLinkLogin("token=" + token)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	tok := usermod.TokenJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&tok))
+	assert.NotEqual(s.T(), "", tok.Token)
+	found := false
+	for _, c := range w.Cookies() {
+		found = found || c.Name == usermod.SessionCookieName
+	}
+	assert.True(s.T(), found)
+
+	expired := usermod.NewUserOperationTokenWithExpires(s.db, u.ID, usermod.MagicLinkToken, time.Now().Add(-time.Minute))
+	assert.Nil(s.T(), expired.Insert())
+	reset := usermod.NewUserOperationTokenDefaultExpires(s.db, u.ID, usermod.ForgotPaswordToken)
+	assert.Nil(s.T(), reset.Insert())
+
+	tests := []struct {
+		name       string
+		query      string
+		statusCode int
+	}{
+		{"missing token", "", http.StatusBadRequest},
+		{"used token", "token=" + token, http.StatusNotFound},
+		{"expired token", "token=" + expired.ID.String(), http.StatusNotFound},
+		{"other token type", "token=" + reset.ID.String(), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.statusCode, s.magicLinkLogin(tt.query).StatusCode)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestMagicLinkLoginWithTOTP() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	now := time.Now()
+	secret := s.enrollTOTP(token)
+	w := s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, now))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	assert.Equal(s.T(), http.StatusOK, s.sendMagicLink(u.Email))
+	n, _ := s.notifier.Last()
+	link := strings.TrimSpace(strings.Split(strings.Split(n.Text, "log in: ")[1], "\n")[0])
+
+	// a missing code doesn't use up the link
+	assert.Equal(s.T(), http.StatusUnauthorized, s.magicLinkLogin("token="+link).StatusCode)
+	code := s.totpCode(secret, now.Add(30*time.Second))
+	assert.Equal(s.T(), http.StatusOK, s.magicLinkLogin("token="+link+"&totp_code="+code).StatusCode)
+
+	// nor can the link be used to guess codes
+	assert.Equal(s.T(), http.StatusOK, s.sendMagicLink(u.Email))
+	n, _ = s.notifier.Last()
+	link = strings.TrimSpace(strings.Split(strings.Split(n.Text, "log in: ")[1], "\n")[0])
+	for i := 0; i < 5; i++ {
+		assert.Equal(s.T(), http.StatusUnauthorized, s.magicLinkLogin("token="+link+"&totp_code=000000").StatusCode)
+	}
+	assert.Equal(s.T(), http.StatusTooManyRequests, s.magicLinkLogin("token="+link+"&totp_code=000000").StatusCode)
+}
@@ -0,0 +1,721 @@
+package usermod
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps everything in process memory. It is meant for unit
+// tests, and mirrors the SQL store by returning sql.ErrNoRows for missing
+// records.
+type MemoryStore struct {
+	mu            sync.Mutex
+	users         map[string]User
+	tokens        map[string]UserOperationToken
+	refreshTokens map[string]RefreshToken
+	roles         map[string]map[string]bool
+	userRoles     map[string]map[string]bool
+	recoveryCodes map[string]RecoveryCode
+	webAuthn      map[string]WebAuthnCredential
+	oauthClients  map[string]OAuthClient
+	oauthCodes    map[string]OAuthCode
+	identities    map[[2]string]Identity
+	apiKeys       map[string]APIKey
+	passwords     map[string][][]byte
+	sessions      *MemorySessionStore
+	loginAttempts *MemoryLoginAttemptStore
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:         map[string]User{},
+		tokens:        map[string]UserOperationToken{},
+		refreshTokens: map[string]RefreshToken{},
+		roles:         map[string]map[string]bool{},
+		userRoles:     map[string]map[string]bool{},
+		recoveryCodes: map[string]RecoveryCode{},
+		webAuthn:      map[string]WebAuthnCredential{},
+		oauthClients:  map[string]OAuthClient{},
+		oauthCodes:    map[string]OAuthCode{},
+		identities:    map[[2]string]Identity{},
+		apiKeys:       map[string]APIKey{},
+		passwords:     map[string][][]byte{},
+		sessions:      NewMemorySessionStore(),
+		loginAttempts: NewMemoryLoginAttemptStore(),
+	}
+}
+
+func (m *MemoryStore) Sessions() SessionStore {
+	return m.sessions
+}
+
+func (m *MemoryStore) LoginAttempts() LoginAttemptStore {
+	return m.loginAttempts
+}
+
+func (m *MemoryStore) InsertUser(ctx context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.ID.String()]; ok {
+		return errors.New("user already exists")
+	}
+	if m.emailTaken(u.ID.String(), u.Email) {
+		return ErrEmailTaken
+	}
+	stored := *u
+	stored.store = nil
+	m.users[u.ID.String()] = stored
+	return nil
+}
+
+// findUser returns a copy of the first user matching, bound to this store
+func (m *MemoryStore) findUser(match func(u *User) bool) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if match(&u) {
+			u.store = m
+			return &u, nil
+		}
+	}
+	return &User{store: m}, sql.ErrNoRows
+}
+
+func (m *MemoryStore) GetUserByID(ctx context.Context, id string) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.ID.String() == id })
+}
+
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.Email == email })
+}
+
+func (m *MemoryStore) GetActiveUserByEmail(ctx context.Context, email string) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.Email == email && u.IsActivated && !u.IsDisabled })
+}
+
+// updateUser applies fn to the stored user, failing if it doesn't exist
+func (m *MemoryStore) updateUser(id string, fn func(u *User)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return errors.New("no rows were updated")
+	}
+	fn(&u)
+	m.users[id] = u
+	return nil
+}
+
+func (m *MemoryStore) UpdateUser(ctx context.Context, id, name, email, phone string) error {
+	m.mu.Lock()
+	taken := m.emailTaken(id, email)
+	m.mu.Unlock()
+	if taken {
+		return ErrEmailTaken
+	}
+	return m.updateUser(id, func(u *User) {
+		u.Name = name
+		u.Email = email
+		u.PhoneNumber = phone
+	})
+}
+
+// emailTaken reports whether a user other than id has the email, like the
+// unique index on users.email. The caller holds the lock.
+func (m *MemoryStore) emailTaken(id, email string) bool {
+	for uid, u := range m.users {
+		if uid != id && u.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) SetPassword(ctx context.Context, id string, hash []byte) error {
+	return m.updateUser(id, func(u *User) { u.Password = hash })
+}
+
+func (m *MemoryStore) Activate(ctx context.Context, id string) error {
+	return m.updateUser(id, func(u *User) { u.IsActivated = true })
+}
+
+func (m *MemoryStore) Deactivate(ctx context.Context, id string) error {
+	return m.updateUser(id, func(u *User) { u.IsActivated = false })
+}
+
+func (m *MemoryStore) SoftDeleteUser(ctx context.Context, id string) error {
+	return m.updateUser(id, func(u *User) { u.IsDeleted = true })
+}
+
+func (m *MemoryStore) RestoreUser(ctx context.Context, id string) error {
+	return m.updateUser(id, func(u *User) { u.IsDeleted = false })
+}
+
+func (m *MemoryStore) SetDisabled(ctx context.Context, id string, disabled bool) error {
+	return m.updateUser(id, func(u *User) { u.IsDisabled = disabled })
+}
+
+func (m *MemoryStore) ListUsers(ctx context.Context, filter UserFilter) ([]*User, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	contains := func(s, sub string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	matches := []*User{}
+	for _, u := range m.users {
+		if filter.Email != "" && !contains(u.Email, filter.Email) ||
+			filter.Name != "" && !contains(u.Name, filter.Name) ||
+			filter.Activated != nil && u.IsActivated != *filter.Activated ||
+			filter.Deleted != nil && u.IsDeleted != *filter.Deleted ||
+			filter.Disabled != nil && u.IsDisabled != *filter.Disabled {
+			continue
+		}
+		u.store = m
+		matches = append(matches, &u)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Email != matches[j].Email {
+			return matches[i].Email < matches[j].Email
+		}
+		return matches[i].ID.String() < matches[j].ID.String()
+	})
+
+	total := len(matches)
+	start := min(filter.Offset, total)
+	end := min(start+filter.Limit, total)
+	return matches[start:end], total, nil
+}
+
+func (m *MemoryStore) SetTOTP(ctx context.Context, id string, secret []byte, enabled bool) error {
+	return m.updateUser(id, func(u *User) {
+		u.TOTPSecret = secret
+		u.TOTPEnabled = enabled
+		u.TOTPPending = nil
+	})
+}
+
+func (m *MemoryStore) SetPendingTOTP(ctx context.Context, id string, secret []byte) error {
+	return m.updateUser(id, func(u *User) {
+		u.TOTPPending = secret
+	})
+}
+
+func (m *MemoryStore) ConsumeTOTPStep(ctx context.Context, id string, step int64) error {
+	replayed := false
+	err := m.updateUser(id, func(u *User) {
+		if u.TOTPLastStep >= step {
+			replayed = true
+			return
+		}
+		u.TOTPLastStep = step
+	})
+	if err == nil && replayed {
+		return ErrTOTPReplayed
+	}
+	return err
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, id)
+	return nil
+}
+
+func (m *MemoryStore) InsertToken(ctx context.Context, t *UserOperationToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *t
+	stored.store = nil
+	m.tokens[t.ID.String()] = stored
+	return nil
+}
+
+func (m *MemoryStore) GetToken(ctx context.Context, id string) (*UserOperationToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok {
+		return &UserOperationToken{store: m}, sql.ErrNoRows
+	}
+	t.store = m
+	return &t, nil
+}
+
+func (m *MemoryStore) GetTokenIfValid(ctx context.Context, uid, token string) (*UserOperationToken, error) {
+	t, err := m.GetToken(ctx, token)
+	if err != nil {
+		return t, err
+	}
+	if t.UserID.String() != uid || t.Used || t.Expiry < time.Now().Unix() {
+		return &UserOperationToken{store: m}, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (m *MemoryStore) MarkTokenAsUsed(ctx context.Context, token string) (uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[token]
+	if !ok {
+		return uuid.Nil, sql.ErrNoRows
+	}
+	t.Used = true
+	m.tokens[token] = t
+	return t.UserID, nil
+}
+
+func (m *MemoryStore) ConsumeToken(ctx context.Context, token string, tokenType Token) (uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[token]
+	if !ok || t.TokenType != tokenType || t.Used || t.Expiry < time.Now().Unix() {
+		return uuid.Nil, sql.ErrNoRows
+	}
+	t.Used = true
+	m.tokens[token] = t
+	return t.UserID, nil
+}
+
+func (m *MemoryStore) InvalidateUserTokens(ctx context.Context, uid string, tokenType Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, t := range m.tokens {
+		if t.UserID.String() == uid && t.TokenType == tokenType {
+			t.Used = true
+			m.tokens[id] = t
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertRefreshToken(ctx context.Context, t *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *t
+	stored.store = nil
+	m.refreshTokens[t.ID.String()] = stored
+	return nil
+}
+
+func (m *MemoryStore) GetRefreshToken(ctx context.Context, id string) (*RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.refreshTokens[id]
+	if !ok {
+		return &RefreshToken{store: m}, sql.ErrNoRows
+	}
+	t.store = m
+	return &t, nil
+}
+
+func (m *MemoryStore) MarkRefreshTokenAsUsed(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.refreshTokens[id]
+	if !ok || t.Used {
+		return ErrRefreshTokenReused
+	}
+	t.Used = true
+	m.refreshTokens[id] = t
+	return nil
+}
+
+// revokeRefreshTokens revokes every refresh token matching
+func (m *MemoryStore) revokeRefreshTokens(match func(t *RefreshToken) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, t := range m.refreshTokens {
+		if match(&t) {
+			t.Revoked = true
+			m.refreshTokens[id] = t
+		}
+	}
+}
+
+func (m *MemoryStore) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	m.revokeRefreshTokens(func(t *RefreshToken) bool { return t.FamilyID.String() == family })
+	return nil
+}
+
+func (m *MemoryStore) RevokeUserRefreshTokens(ctx context.Context, uid string) error {
+	m.revokeRefreshTokens(func(t *RefreshToken) bool { return t.UserID.String() == uid })
+	return nil
+}
+
+func (m *MemoryStore) CreateRole(ctx context.Context, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.roles[role]; !ok {
+		m.roles[role] = map[string]bool{}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteRole(ctx context.Context, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.roles, role)
+	for _, roles := range m.userRoles {
+		delete(roles, role)
+	}
+	return nil
+}
+
+func (m *MemoryStore) AddRolePermission(ctx context.Context, role, permission string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	perms, ok := m.roles[role]
+	if !ok {
+		return ErrRoleNotFound
+	}
+	perms[permission] = true
+	return nil
+}
+
+func (m *MemoryStore) RemoveRolePermission(ctx context.Context, role, permission string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.roles[role], permission)
+	return nil
+}
+
+// sortedKeys returns the keys of a set, sorted to match the SQL store
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *MemoryStore) GetRolePermissions(ctx context.Context, role string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return sortedKeys(m.roles[role]), nil
+}
+
+func (m *MemoryStore) GrantRole(ctx context.Context, uid, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.roles[role]; !ok {
+		return ErrRoleNotFound
+	}
+	if _, ok := m.userRoles[uid]; !ok {
+		m.userRoles[uid] = map[string]bool{}
+	}
+	m.userRoles[uid][role] = true
+	return nil
+}
+
+func (m *MemoryStore) RevokeRole(ctx context.Context, uid, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.userRoles[uid], role)
+	return nil
+}
+
+func (m *MemoryStore) GetUserRoles(ctx context.Context, uid string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return sortedKeys(m.userRoles[uid]), nil
+}
+
+func (m *MemoryStore) GetUserPermissions(ctx context.Context, uid string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	perms := map[string]bool{}
+	for role := range m.userRoles[uid] {
+		for perm := range m.roles[role] {
+			perms[perm] = true
+		}
+	}
+	return sortedKeys(perms), nil
+}
+
+func (m *MemoryStore) ReplaceRecoveryCodes(ctx context.Context, uid string, hashes [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, rc := range m.recoveryCodes {
+		if rc.UserID.String() == uid {
+			delete(m.recoveryCodes, id)
+		}
+	}
+	for _, hash := range hashes {
+		rc := RecoveryCode{ID: uuid.New(), UserID: uuid.MustParse(uid), Hash: hash}
+		m.recoveryCodes[rc.ID.String()] = rc
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetRecoveryCodes(ctx context.Context, uid string) ([]*RecoveryCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := []*RecoveryCode{}
+	for _, rc := range m.recoveryCodes {
+		if rc.UserID.String() == uid {
+			codes = append(codes, &rc)
+		}
+	}
+	return codes, nil
+}
+
+func (m *MemoryStore) DeleteRecoveryCode(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.recoveryCodes[id]; !ok {
+		return ErrRecoveryCodeInvalid
+	}
+	delete(m.recoveryCodes, id)
+	return nil
+}
+
+func (m *MemoryStore) CountRecoveryCodes(ctx context.Context, uid string) (int, error) {
+	codes, err := m.GetRecoveryCodes(ctx, uid)
+	return len(codes), err
+}
+
+func (m *MemoryStore) InsertWebAuthnCredential(ctx context.Context, c *WebAuthnCredential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webAuthn[c.ID]; ok {
+		return errors.New("credential already exists")
+	}
+	m.webAuthn[c.ID] = *c
+	return nil
+}
+
+func (m *MemoryStore) GetWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.webAuthn[id]
+	if !ok {
+		return &WebAuthnCredential{}, sql.ErrNoRows
+	}
+	return &c, nil
+}
+
+func (m *MemoryStore) GetUserWebAuthnCredentials(ctx context.Context, uid string) ([]*WebAuthnCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	creds := []*WebAuthnCredential{}
+	for _, c := range m.webAuthn {
+		if c.UserID.String() == uid {
+			creds = append(creds, &c)
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].Created < creds[j].Created })
+	return creds, nil
+}
+
+func (m *MemoryStore) UpdateWebAuthnSignCount(ctx context.Context, id string, count uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.webAuthn[id]
+	if !ok || c.SignCount >= count {
+		return sql.ErrNoRows
+	}
+	c.SignCount = count
+	m.webAuthn[id] = c
+	return nil
+}
+
+func (m *MemoryStore) InsertOAuthClient(ctx context.Context, c *OAuthClient) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.oauthClients[c.ID]; ok {
+		return errors.New("client already exists")
+	}
+	stored := *c
+	stored.RedirectURIs = append([]string{}, c.RedirectURIs...)
+	sort.Strings(stored.RedirectURIs)
+	m.oauthClients[c.ID] = stored
+	return nil
+}
+
+func (m *MemoryStore) GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.oauthClients[id]
+	if !ok {
+		return nil, ErrOAuthClientNotFound
+	}
+	return &c, nil
+}
+
+func (m *MemoryStore) DeleteOAuthClient(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.oauthClients, id)
+	for code, c := range m.oauthCodes {
+		if c.ClientID == id {
+			delete(m.oauthCodes, code)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertOAuthCode(ctx context.Context, c *OAuthCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oauthCodes[c.Code] = *c
+	return nil
+}
+
+func (m *MemoryStore) GetOAuthCode(ctx context.Context, code string) (*OAuthCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.oauthCodes[code]
+	if !ok {
+		return nil, ErrOAuthCodeInvalid
+	}
+	return &c, nil
+}
+
+func (m *MemoryStore) ConsumeOAuthCode(ctx context.Context, code string) (*OAuthCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.oauthCodes[code]
+	if !ok || c.Used || c.Expiry <= time.Now().Unix() {
+		return nil, ErrOAuthCodeInvalid
+	}
+	c.Used = true
+	m.oauthCodes[code] = c
+	return &c, nil
+}
+
+func (m *MemoryStore) LinkIdentity(ctx context.Context, i *Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{i.Issuer, i.Subject}
+	if _, ok := m.identities[key]; ok {
+		return errors.New("identity already linked")
+	}
+	m.identities[key] = *i
+	return nil
+}
+
+func (m *MemoryStore) GetIdentity(ctx context.Context, issuer, subject string) (*Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, ok := m.identities[[2]string{issuer, subject}]
+	if !ok {
+		return nil, ErrIdentityNotFound
+	}
+	return &i, nil
+}
+
+func (m *MemoryStore) GetUserIdentities(ctx context.Context, uid string) ([]*Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	identities := []*Identity{}
+	for _, i := range m.identities {
+		if i.UserID.String() == uid {
+			identities = append(identities, &i)
+		}
+	}
+	sort.Slice(identities, func(a, b int) bool { return identities[a].Issuer < identities[b].Issuer })
+	return identities, nil
+}
+
+func (m *MemoryStore) UnlinkIdentity(ctx context.Context, uid, issuer string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for key, i := range m.identities {
+		if i.UserID.String() == uid && i.Issuer == issuer {
+			delete(m.identities, key)
+			found = true
+		}
+	}
+	if !found {
+		return ErrIdentityNotFound
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertAPIKey(ctx context.Context, k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiKeys[k.ID.String()] = *k
+	return nil
+}
+
+func (m *MemoryStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.apiKeys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &k, nil
+}
+
+func (m *MemoryStore) GetUserAPIKeys(ctx context.Context, uid string) ([]*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []*APIKey{}
+	for _, k := range m.apiKeys {
+		if k.UserID.String() == uid {
+			keys = append(keys, &k)
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].Created != keys[b].Created {
+			return keys[a].Created < keys[b].Created
+		}
+		return keys[a].ID.String() < keys[b].ID.String()
+	})
+	return keys, nil
+}
+
+func (m *MemoryStore) DeleteAPIKey(ctx context.Context, uid, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.apiKeys[id]
+	if !ok || k.UserID.String() != uid {
+		return ErrAPIKeyNotFound
+	}
+	delete(m.apiKeys, id)
+	return nil
+}
+
+func (m *MemoryStore) TouchAPIKey(ctx context.Context, id string, at int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.apiKeys[id]; ok {
+		k.LastUsed = at
+		m.apiKeys[id] = k
+	}
+	return nil
+}
+
+func (m *MemoryStore) AddPasswordHistory(ctx context.Context, uid string, hash []byte, keep int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hashes := append([][]byte{hash}, m.passwords[uid]...)
+	if len(hashes) > keep {
+		hashes = hashes[:keep]
+	}
+	m.passwords[uid] = hashes
+	return nil
+}
+
+func (m *MemoryStore) GetPasswordHistory(ctx context.Context, uid string, n int) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hashes := m.passwords[uid]
+	if len(hashes) > n {
+		hashes = hashes[:n]
+	}
+	return append([][]byte{}, hashes...), nil
+}
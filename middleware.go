@@ -2,21 +2,35 @@ package usermod
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"net/http"
 	"strings"
-
-	"github.com/golang-jwt/jwt"
+	"time"
 )
 
 type CTXvar string
 
 const (
-	CTX_UID_KEY  CTXvar = "uid"
-	CTX_USER_KEY CTXvar = "user"
+	CTX_UID_KEY    CTXvar = "uid"
+	CTX_USER_KEY   CTXvar = "user"
+	CTX_CLAIMS_KEY CTXvar = "claims"
+	CTX_APIKEY_KEY CTXvar = "api_key"
+	// CTX_SESSION_KEY holds the *Session of requests authenticated by cookie
+	CTX_SESSION_KEY CTXvar = "session"
+	// CTX_AUTH_TIME_KEY holds the time the user last proved their identity,
+	// for RequireRecentAuth. API keys never do.
+	CTX_AUTH_TIME_KEY CTXvar = "auth_time"
 )
 
-func BasicAuth(db *sql.DB) func(next http.Handler) http.Handler {
+var ErrReauthenticationRequired = errors.New("recent authentication required")
+
+// RecentAuthMaxAge is how long after logging in users may make sensitive
+// changes, like deleting their account, without confirming their password
+var RecentAuthMaxAge = 5 * time.Minute
+
+// BasicAuth authenticates each request with the user's email and password.
+// Failures count towards the lockout, which may be nil.
+func BasicAuth(store UserStore, lockout *Lockout) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			user, pass, ok := r.BasicAuth()
@@ -24,49 +38,315 @@ func BasicAuth(db *sql.DB) func(next http.Handler) http.Handler {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			uobj, err := AuthenticateByEmail(db, user, []byte(pass))
-			if err != nil {
+			// the code is sent with every request, so it may repeat within its period
+			uobj, err := lockout.login(r.Context(), store, clientIP(r), user, []byte(pass), r.Header.Get(TOTPHeader), false)
+			var locked *LockoutError
+			if errors.As(err, &locked) {
+				writeLockoutError(w, locked)
+				return
+			}
+			if err == ErrInvalidCredentials {
 				jsonError(w, err, http.StatusForbidden)
 				return
 			}
+			if err != nil {
+				jsonError(w, err, http.StatusUnauthorized)
+				return
+			}
 
 			r = r.WithContext(context.WithValue(r.Context(), CTX_USER_KEY, uobj))
 			r = r.WithContext(context.WithValue(r.Context(), CTX_UID_KEY, uobj.ID.String()))
+			r = r.WithContext(context.WithValue(r.Context(), CTX_AUTH_TIME_KEY, time.Now()))
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// TODO implement jwt auth middleware
-func JWTTokenAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		tokens := strings.Split(tokenString, " ")
-		if len(tokens) != 2 || tokens[0] != "Bearer" {
-			http.Error(w, "Unauthorized", http.StatusBadRequest)
-			return
-		}
+// JWTTokenAuth authenticates requests carrying a bearer token issued by
+// CreateToken, loading the full user into the request context the same way
+// BasicAuth does. Revoked tokens are refused, as are access tokens issued
+// to OAuth clients, which only OAuthTokenAuth accepts. Nil tokens are read
+// with TokenConfigFromEnv, and it panics if that fails.
+func JWTTokenAuth(store UserStore, tokens *TokenConfig) func(next http.Handler) http.Handler {
+	return bearerAuth(store, tokens, false)
+}
 
-		token, err := jwt.ParseWithClaims(tokens[1], &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
+// OAuthTokenAuth authenticates requests carrying an access token issued to
+// an OAuth client, and nothing else. The router accepts them at
+// /oauth/userinfo alone, so that clients can't act as the user elsewhere.
+func OAuthTokenAuth(store UserStore, tokens *TokenConfig) func(next http.Handler) http.Handler {
+	return bearerAuth(store, tokens, true)
+}
+
+// bearerAuth accepts either the user's own tokens or those issued to OAuth
+// clients, as client says
+func bearerAuth(store UserStore, tokens *TokenConfig, client bool) func(next http.Handler) http.Handler {
+	if tokens == nil {
+		tokens = mustTokenConfigFromEnv()
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString := r.Header.Get("Authorization")
+			if tokenString == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			parts := strings.Split(tokenString, " ")
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				http.Error(w, "Unauthorized", http.StatusBadRequest)
+				return
+			}
+
+			claims, err := tokens.ValidateToken(r.Context(), parts[1])
+			if err != nil || claims.issuedToClient() != client {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			uobj, err := store.GetUserByID(r.Context(), claims.UserID)
+			if err != nil || !uobj.IsActive() {
+				jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), CTX_USER_KEY, uobj))
+			r = r.WithContext(context.WithValue(r.Context(), CTX_UID_KEY, uobj.ID.String()))
+			r = r.WithContext(context.WithValue(r.Context(), CTX_CLAIMS_KEY, claims))
+			if claims.AuthTime != 0 {
+				r = r.WithContext(context.WithValue(r.Context(), CTX_AUTH_TIME_KEY, time.Unix(claims.AuthTime, 0)))
+			}
+			next.ServeHTTP(w, r)
 		})
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+	}
+}
+
+// APIKeyAuth authenticates requests carrying an api key as their bearer
+// token, populating the same context keys as BasicAuth, and the key itself
+// under CTX_APIKEY_KEY.
+func APIKeyAuth(store Store) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			k, err := VerifyAPIKey(r.Context(), store, key)
+			if err == ErrAPIKeyInvalid {
+				jsonError(w, err, http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			uobj, err := store.GetUserByID(r.Context(), k.UserID.String())
+			if err != nil || !uobj.IsActive() {
+				jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), CTX_USER_KEY, uobj))
+			r = r.WithContext(context.WithValue(r.Context(), CTX_UID_KEY, uobj.ID.String()))
+			r = r.WithContext(context.WithValue(r.Context(), CTX_APIKEY_KEY, k))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Authenticated accepts basic auth, a bearer token or an api key, based on
+// the Authorization header. Requests without an Authorization header fall
+// back to the session cookie when a store is provided. Basic auth failures
+// count towards the lockout, which may be nil.
+func Authenticated(store Store, sessions SessionStore, tokens *TokenConfig, lockout *Lockout) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		basic := BasicAuth(store, lockout)(next)
+		bearer := JWTTokenAuth(store, tokens)(next)
+		apiKey := APIKeyAuth(store)(next)
+		var session http.Handler
+		if sessions != nil {
+			session = SessionAuth(store, sessions)(next)
 		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if strings.HasPrefix(header, "Bearer "+APIKeyPrefix) {
+				apiKey.ServeHTTP(w, r)
+				return
+			}
+			if strings.HasPrefix(header, "Bearer ") {
+				bearer.ServeHTTP(w, r)
+				return
+			}
+			if header == "" && session != nil {
+				if _, err := r.Cookie(SessionCookieName); err == nil {
+					session.ServeHTTP(w, r)
+					return
+				}
+			}
+			basic.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SessionAuth authenticates requests carrying a session cookie created on
+// login. Every authenticated request slides the session expiry forward.
+func SessionAuth(store UserStore, sessions SessionStore) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cookie, err := r.Cookie(SessionCookieName)
+			if err != nil || cookie.Value == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			sess, err := sessions.Get(r.Context(), cookie.Value)
+			if err == ErrSessionNotFound {
+				clearSessionCookie(w, r)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			uobj, err := store.GetUserByID(r.Context(), sess.UserID.String())
+			if err != nil || !uobj.IsActive() {
+				jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+				return
+			}
+
+			expires := time.Now().Add(SessionDefaultExpiry)
+			err = sessions.Touch(r.Context(), sess.ID, expires)
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+			sess.Expiry = expires.Unix()
+			setSessionCookie(w, r, sess)
 
-		claims := token.Claims.(*Claims)
-		r = r.WithContext(context.WithValue(r.Context(), CTX_UID_KEY, claims.UserID))
-		next.ServeHTTP(w, r)
-	})
+			r = r.WithContext(context.WithValue(r.Context(), CTX_USER_KEY, uobj))
+			r = r.WithContext(context.WithValue(r.Context(), CTX_UID_KEY, uobj.ID.String()))
+			r = r.WithContext(context.WithValue(r.Context(), CTX_SESSION_KEY, sess))
+			if sess.AuthTime != 0 {
+				r = r.WithContext(context.WithValue(r.Context(), CTX_AUTH_TIME_KEY, time.Unix(sess.AuthTime, 0)))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-// TODO implement session auth middleware
-func SessionAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	})
+// RequireRole allows the request through when the authenticated user holds
+// any of the roles. It must be mounted after one of the auth middlewares.
+func RequireRole(store RoleStore, roles ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uid, ok := r.Context().Value(CTX_UID_KEY).(string)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			held, err := store.GetUserRoles(r.Context(), uid)
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if !containsAny(held, roles) {
+				jsonErrorFromString(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequirePermission allows the request through when the authenticated user
+// holds every permission, through any of their roles. Holders of AdminRole
+// are allowed everything. It must be mounted after one of the auth
+// middlewares.
+func RequirePermission(store RoleStore, permissions ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			uid, ok := r.Context().Value(CTX_UID_KEY).(string)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			roles, err := store.GetUserRoles(r.Context(), uid)
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if containsAny(roles, []string{AdminRole}) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			held, err := store.GetUserPermissions(r.Context(), uid)
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+			for _, p := range permissions {
+				if !containsAny(held, []string{p}) {
+					jsonErrorFromString(w, "forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScope refuses requests authenticated by an api key lacking one of
+// the scopes. Other requests, and keys without scopes, are let through. It
+// must be mounted after one of the auth middlewares.
+func RequireScope(scopes ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if k, ok := r.Context().Value(CTX_APIKEY_KEY).(*APIKey); ok {
+				for _, scope := range scopes {
+					if !k.HasScope(scope) {
+						jsonErrorFromString(w, "insufficient scope", http.StatusForbidden)
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRecentAuth refuses requests from users who last proved their
+// identity more than maxAge ago. Basic auth proves it on every request;
+// tokens and sessions when the user logged in, which they can repeat
+// through the router's reauthenticate route. Refreshed tokens and api keys
+// are always refused. It must be mounted after one of the auth middlewares.
+func RequireRecentAuth(maxAge time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !recentlyAuthenticated(r, maxAge) {
+				jsonError(w, ErrReauthenticationRequired, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func recentlyAuthenticated(r *http.Request, maxAge time.Duration) bool {
+	at, ok := r.Context().Value(CTX_AUTH_TIME_KEY).(time.Time)
+	return ok && time.Since(at) <= maxAge
+}
+
+func containsAny(held, wanted []string) bool {
+	for _, h := range held {
+		for _, w := range wanted {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -0,0 +1,319 @@
+package usermod
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+var schemaMigrationsTblName = "usermod_schema_migrations"
+
+// Migration is a single schema version. Up and Down hold the statements,
+// already rendered for a dialect.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// migrationTypes is the data migration templates are rendered with, so a
+// single file serves every dialect. Dialect is the dialect's name, for the
+// few statements whose syntax differs.
+type migrationTypes struct {
+	Dialect string
+	UUID    string
+	String  string
+	Binary  string
+	Bool    string
+	BigInt  string
+	Int     string
+}
+
+// LoadMigrations reads migrations named <version>_<name>.up.sql and
+// <version>_<name>.down.sql from fsys, rendering them for the dialect.
+func LoadMigrations(fsys fs.FS, d Dialect) ([]Migration, error) {
+	types := migrationTypes{
+		Dialect: d.Name(),
+		UUID:    d.Type(UUIDColumn),
+		String:  d.Type(StringColumn),
+		Binary:  d.Type(BinaryColumn),
+		Bool:    d.Type(BoolColumn),
+		BigInt:  d.Type(BigIntColumn),
+		Int:     d.Type(IntColumn),
+	}
+
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, f := range files {
+		base := path.Base(f)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", base)
+		}
+		name := strings.TrimSuffix(base, "."+direction+".sql")
+		version, err := strconv.ParseInt(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version: %w", base, err)
+		}
+
+		raw, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(base).Parse(string(raw))
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		if err = tmpl.Execute(&b, types); err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = splitStatements(b.String())
+		} else {
+			m.Down = splitStatements(b.String())
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// splitStatements breaks a migration into statements, since not every
+// driver accepts several statements in one Exec.
+func splitStatements(s string) []string {
+	var statements []string
+	for _, stmt := range strings.Split(s, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// Migrator applies migrations, recording each applied version in the
+// usermod_schema_migrations table. Every migration runs in its own
+// transaction; note that MySQL commits DDL implicitly, so a failing
+// migration there may be partially applied.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for usermod's own schema
+func NewMigrator(db *sql.DB, d Dialect) (*Migrator, error) {
+	sub, err := fs.Sub(migrationFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := LoadMigrations(sub, d)
+	if err != nil {
+		return nil, err
+	}
+	return NewMigratorWithMigrations(db, d, migrations), nil
+}
+
+func NewMigratorWithMigrations(db *sql.DB, d Dialect, migrations []Migration) *Migrator {
+	return &Migrator{db: db, dialect: d, migrations: migrations}
+}
+
+// Migrate brings the database up to the latest schema. It is safe to call
+// on every startup.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	m, err := NewMigrator(db, DetectDialect(db))
+	if err != nil {
+		return err
+	}
+	return m.Up(ctx)
+}
+
+func (m *Migrator) ensureSchemaTable(ctx context.Context) error {
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	version %s PRIMARY KEY,
+	applied_at %s
+)`, schemaMigrationsTblName, m.dialect.Type(BigIntColumn), m.dialect.Type(BigIntColumn))
+	_, err := m.db.ExecContext(ctx, query)
+	return err
+}
+
+// Applied returns the applied versions, in ascending order
+func (m *Migrator) Applied(ctx context.Context) ([]int64, error) {
+	if err := m.ensureSchemaTable(ctx); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT version FROM %s ORDER BY version", schemaMigrationsTblName)
+	rows, err := m.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []int64
+	for rows.Next() {
+		var v int64
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// Version returns the most recently applied version, or 0
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	versions, err := m.Applied(ctx)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	return versions[len(versions)-1], nil
+}
+
+// migrationLockID names usermod's migrations among Postgres advisory locks
+const migrationLockID = 0x75736572
+
+// lock holds a database wide lock until the returned func is called, so
+// that instances starting together don't apply the same migration twice.
+// SQLite databases are rarely shared between instances, and aren't locked.
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	var acquire, release string
+	switch m.dialect.Name() {
+	case "postgres":
+		acquire = fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLockID)
+		release = fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockID)
+	case "mysql":
+		acquire = fmt.Sprintf("SELECT GET_LOCK('%s', -1)", schemaMigrationsTblName)
+		release = fmt.Sprintf("SELECT RELEASE_LOCK('%s')", schemaMigrationsTblName)
+	default:
+		return func() {}, nil
+	}
+
+	// advisory locks belong to a connection, so keep one aside
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.ExecContext(ctx, acquire); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(), release)
+		conn.Close()
+	}, nil
+}
+
+// Up applies every migration that hasn't been applied yet
+func (m *Migrator) Up(ctx context.Context) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	versions, err := m.Applied(ctx)
+	if err != nil {
+		return err
+	}
+	applied := map[int64]bool{}
+	for _, v := range versions {
+		applied[v] = true
+	}
+
+	for _, mig := range m.migrations {
+		if applied[mig.Version] {
+			continue
+		}
+		insert := fmt.Sprintf("INSERT INTO %s (version, applied_at) VALUES ($1, $2)", schemaMigrationsTblName)
+		err = m.run(ctx, mig.Up, insert, mig.Version, time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", mig.Name, err)
+		}
+	}
+	return nil
+}
+
+// Down reverts applied migrations newer than target, newest first. A
+// target of 0 reverts everything.
+func (m *Migrator) Down(ctx context.Context, target int64) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	versions, err := m.Applied(ctx)
+	if err != nil {
+		return err
+	}
+	applied := map[int64]bool{}
+	for _, v := range versions {
+		applied[v] = true
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version <= target || !applied[mig.Version] {
+			continue
+		}
+		remove := fmt.Sprintf("DELETE FROM %s WHERE version = $1", schemaMigrationsTblName)
+		err = m.run(ctx, mig.Down, remove, mig.Version)
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", mig.Name, err)
+		}
+	}
+	return nil
+}
+
+// run executes the statements and the bookkeeping query in one transaction
+func (m *Migrator) run(ctx context.Context, statements []string, record string, args ...any) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, m.dialect.Rebind(record), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
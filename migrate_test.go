@@ -0,0 +1,122 @@
+package usermod_test
+
+import (
+	"context"
+	"fmt"
+	"testing/fstest"
+
+	"github.com/chayim/usermod"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) TestMigrateIdempotent() {
+	ctx := context.Background()
+	m, err := usermod.NewMigrator(s.db, s.store.Dialect())
+	assert.Nil(s.T(), err)
+
+	before, err := m.Version(ctx)
+	assert.Nil(s.T(), err)
+	assert.Greater(s.T(), before, int64(0))
+
+	assert.Nil(s.T(), usermod.Migrate(ctx, s.db))
+	after, err := m.Version(ctx)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), before, after)
+}
+
+func (s *UserModTestSuite) TestMigrateDownUp() {
+	ctx := context.Background()
+	m, err := usermod.NewMigrator(s.db, s.store.Dialect())
+	assert.Nil(s.T(), err)
+
+	assert.Nil(s.T(), m.Down(ctx, 0))
+	version, err := m.Version(ctx)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(0), version)
+	assert.NotNil(s.T(), s.newUserWithoutAssert().Insert())
+
+	assert.Nil(s.T(), m.Up(ctx))
+	assert.Nil(s.T(), s.newUserWithoutAssert().Insert())
+}
+
+func (s *UserModTestSuite) TestMigrateFromCreateAllTables() {
+	ctx := context.Background()
+	m, err := usermod.NewMigrator(s.db, s.store.Dialect())
+	assert.Nil(s.T(), err)
+	assert.Nil(s.T(), m.Down(ctx, 0))
+	_, err = s.db.Exec("DROP TABLE usermod_schema_migrations")
+	assert.Nil(s.T(), err)
+
+	// the tables CreateAllTables made before there were migrations
+	d := s.store.Dialect()
+	for _, stmt := range []string{
+		fmt.Sprintf(`CREATE TABLE users (
+	id %s PRIMARY KEY,
+	name VARCHAR(255),
+	email VARCHAR(255),
+	password %s,
+	phone_number VARCHAR(255),
+	is_activated BOOLEAN DEFAULT FALSE,
+	is_deleted BOOLEAN DEFAULT FALSE
+)`, d.Type(usermod.UUIDColumn), d.Type(usermod.BinaryColumn)),
+		fmt.Sprintf(`CREATE TABLE user_ops_tokens (
+	id %s PRIMARY KEY,
+	user_id %s,
+	expiry int,
+	token_type int,
+	used BOOLEAN DEFAULT FALSE
+)`, d.Type(usermod.UUIDColumn), d.Type(usermod.UUIDColumn)),
+	} {
+		_, err = s.db.Exec(stmt)
+		assert.Nil(s.T(), err)
+	}
+	id := uuid.New()
+	_, err = s.db.Exec(d.Rebind("INSERT INTO users VALUES ($1, $2, $3, $4, $5, $6, $7)"),
+		id.String(), "Legacy", "legacy@ummmfoo.com", []byte("hash"), "", true, false)
+	assert.Nil(s.T(), err)
+
+	assert.Nil(s.T(), usermod.CreateAllTables(s.db)[0])
+	found, err := usermod.GetUserByEmail(s.db, "legacy@ummmfoo.com")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), id, found.ID)
+	version, err := m.Version(ctx)
+	assert.Nil(s.T(), err)
+	assert.Greater(s.T(), version, int64(1))
+}
+
+func (s *UserModTestSuite) TestMigrateFailureRollsBack() {
+	ctx := context.Background()
+	fsys := fstest.MapFS{
+		"9001_things.up.sql":   {Data: []byte("CREATE TABLE things (id {{.UUID}} PRIMARY KEY);")},
+		"9001_things.down.sql": {Data: []byte("DROP TABLE things;")},
+		"9002_broken.up.sql":   {Data: []byte("CREATE TABLE more_things (id {{.Int}});\nNOT SQL AT ALL;")},
+		"9002_broken.down.sql": {Data: []byte("DROP TABLE more_things;")},
+	}
+	migrations, err := usermod.LoadMigrations(fsys, s.store.Dialect())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 2, len(migrations))
+	assert.Equal(s.T(), int64(9001), migrations[0].Version)
+
+	// versions share the schema table with usermod's own, hence 9000+
+	m := usermod.NewMigratorWithMigrations(s.db, s.store.Dialect(), migrations[:1])
+	defer m.Down(ctx, 0)
+
+	m = usermod.NewMigratorWithMigrations(s.db, s.store.Dialect(), migrations)
+	assert.NotNil(s.T(), m.Up(ctx))
+
+	applied, err := m.Applied(ctx)
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), applied, int64(9001))
+	assert.NotContains(s.T(), applied, int64(9002))
+	_, err = s.db.Exec("SELECT * FROM things")
+	assert.Nil(s.T(), err)
+	if s.driver != "mysql" {
+		_, err = s.db.Exec("SELECT * FROM more_things")
+		assert.NotNil(s.T(), err)
+	}
+}
+
+func (s *UserModTestSuite) newUserWithoutAssert() *usermod.User {
+	return usermod.NewUserWithDetails(s.db, "Chayim", "c@ummmfoo.com", testPassword)
+}
@@ -0,0 +1,4 @@
+DROP TABLE sessions;
+DROP TABLE refresh_tokens;
+DROP TABLE user_ops_tokens;
+DROP TABLE users;
@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS users (
+	id {{.UUID}} PRIMARY KEY,
+	name {{.String}},
+	email {{.String}},
+	password {{.Binary}},
+	phone_number {{.String}},
+	is_activated {{.Bool}} DEFAULT FALSE,
+	is_deleted {{.Bool}} DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS user_ops_tokens (
+	id {{.UUID}} PRIMARY KEY,
+	user_id {{.UUID}},
+	expiry {{.BigInt}},
+	token_type {{.Int}},
+	used {{.Bool}} DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id {{.UUID}} PRIMARY KEY,
+	user_id {{.UUID}},
+	family_id {{.UUID}},
+	expiry {{.BigInt}},
+	used {{.Bool}} DEFAULT FALSE,
+	revoked {{.Bool}} DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id {{.String}} PRIMARY KEY,
+	user_id {{.UUID}},
+	expiry {{.BigInt}}
+);
@@ -0,0 +1,15 @@
+CREATE TABLE roles (
+	name {{.String}} PRIMARY KEY
+);
+
+CREATE TABLE role_permissions (
+	role {{.String}},
+	permission {{.String}},
+	PRIMARY KEY (role, permission)
+);
+
+CREATE TABLE user_roles (
+	user_id {{.UUID}},
+	role {{.String}},
+	PRIMARY KEY (user_id, role)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN totp_secret {{.Binary}};
+ALTER TABLE users ADD COLUMN totp_enabled {{.Bool}} DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step {{.BigInt}} DEFAULT 0;
@@ -0,0 +1,5 @@
+CREATE TABLE user_recovery_codes (
+	id {{.UUID}} PRIMARY KEY,
+	user_id {{.UUID}},
+	code_hash {{.Binary}}
+);
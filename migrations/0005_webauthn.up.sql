@@ -0,0 +1,7 @@
+CREATE TABLE webauthn_credentials (
+	id {{.String}} PRIMARY KEY,
+	user_id {{.UUID}},
+	public_key {{.Binary}},
+	sign_count {{.BigInt}},
+	created {{.BigInt}}
+);
@@ -0,0 +1,3 @@
+DROP TABLE oauth_codes;
+DROP TABLE oauth_client_redirect_uris;
+DROP TABLE oauth_clients;
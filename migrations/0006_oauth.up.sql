@@ -0,0 +1,24 @@
+CREATE TABLE oauth_clients (
+	id {{.String}} PRIMARY KEY,
+	name {{.String}},
+	secret_hash {{.Binary}},
+	created {{.BigInt}}
+);
+
+CREATE TABLE oauth_client_redirect_uris (
+	client_id {{.String}},
+	uri {{.String}},
+	PRIMARY KEY (client_id, uri)
+);
+
+CREATE TABLE oauth_codes (
+	code {{.String}} PRIMARY KEY,
+	client_id {{.String}},
+	user_id {{.UUID}},
+	redirect_uri {{.String}},
+	scope {{.String}},
+	nonce {{.String}},
+	code_challenge {{.String}},
+	expiry {{.BigInt}},
+	used {{.Bool}} DEFAULT FALSE
+);
@@ -0,0 +1,8 @@
+CREATE TABLE identities (
+	issuer {{.String}},
+	subject {{.String}},
+	user_id {{.UUID}},
+	email {{.String}},
+	created {{.BigInt}},
+	PRIMARY KEY (issuer, subject)
+);
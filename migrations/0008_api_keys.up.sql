@@ -0,0 +1,10 @@
+CREATE TABLE api_keys (
+	id {{.UUID}} PRIMARY KEY,
+	user_id {{.UUID}},
+	name {{.String}},
+	key_hash {{.Binary}},
+	scopes {{.String}},
+	expires {{.BigInt}},
+	last_used {{.BigInt}},
+	created {{.BigInt}}
+);
@@ -0,0 +1,6 @@
+CREATE TABLE login_attempts (
+	attempt_key {{.String}} PRIMARY KEY,
+	failures {{.Int}},
+	last_failure {{.BigInt}},
+	locked_until {{.BigInt}}
+);
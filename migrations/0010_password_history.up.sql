@@ -0,0 +1,6 @@
+CREATE TABLE password_history (
+	id {{.UUID}} PRIMARY KEY,
+	user_id {{.UUID}},
+	hash {{.Binary}},
+	created {{.BigInt}}
+);
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN totp_pending {{.Binary}};
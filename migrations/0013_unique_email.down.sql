@@ -0,0 +1 @@
+DROP INDEX users_email{{if eq .Dialect "mysql"}} ON users{{end}};
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN is_disabled {{.Bool}} DEFAULT FALSE;
@@ -0,0 +1,262 @@
+package usermod
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	htmltemplate "html/template"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// Channel is the medium a notification is delivered through
+type Channel int
+
+const (
+	EmailChannel Channel = iota
+	SMSChannel
+)
+
+// Notification is a rendered message, ready to be delivered to a user
+type Notification struct {
+	Channel   Channel
+	To        string
+	Subject   string
+	Text      string
+	HTML      string
+	TokenType Token
+}
+
+// Notifier delivers notifications, such as activation and password reset
+// tokens, to users.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// NotifierFunc adapts a function to the Notifier interface, which is handy
+// for plugging in an SMS gateway.
+type NotifierFunc func(ctx context.Context, n *Notification) error
+
+func (f NotifierFunc) Notify(ctx context.Context, n *Notification) error {
+	return f(ctx, n)
+}
+
+var ErrUnsupportedChannel = errors.New("unsupported notification channel")
+
+// ChannelNotifier dispatches notifications to a notifier per channel. A nil
+// notifier for a channel drops notifications sent through it.
+type ChannelNotifier struct {
+	Email Notifier
+	SMS   Notifier
+}
+
+func (c *ChannelNotifier) Notify(ctx context.Context, n *Notification) error {
+	var next Notifier
+	switch n.Channel {
+	case EmailChannel:
+		next = c.Email
+	case SMSChannel:
+		next = c.SMS
+	default:
+		return ErrUnsupportedChannel
+	}
+	if next == nil {
+		return nil
+	}
+	return next.Notify(ctx, n)
+}
+
+// RecordingNotifier keeps every notification in memory, for use in tests
+type RecordingNotifier struct {
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func NewRecordingNotifier() *RecordingNotifier {
+	return &RecordingNotifier{}
+}
+
+func (r *RecordingNotifier) Notify(ctx context.Context, n *Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications = append(r.notifications, *n)
+	return nil
+}
+
+// Notifications returns a copy of everything recorded so far
+func (r *RecordingNotifier) Notifications() []Notification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Notification(nil), r.notifications...)
+}
+
+// Last returns the most recent notification, if any
+func (r *RecordingNotifier) Last() (Notification, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.notifications) == 0 {
+		return Notification{}, false
+	}
+	return r.notifications[len(r.notifications)-1], true
+}
+
+// MessageTemplate renders the messages sent for a token type. Any nil
+// template is skipped, so leaving SMS nil disables text messages.
+type MessageTemplate struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	HTML    *htmltemplate.Template
+	SMS     *texttemplate.Template
+}
+
+// TemplateData is passed to every message template
+type TemplateData struct {
+	User    *User
+	Token   string
+	Expires time.Time
+}
+
+func textTemplate(name, s string) *texttemplate.Template {
+	return texttemplate.Must(texttemplate.New(name).Parse(s))
+}
+
+func htmlTemplate(name, s string) *htmltemplate.Template {
+	return htmltemplate.Must(htmltemplate.New(name).Parse(s))
+}
+
+// DefaultTemplates are used unless the router is configured WithTemplates
+var DefaultTemplates = map[Token]*MessageTemplate{
+	ActivationToken: {
+		Subject: textTemplate("subject", "Activate your account"),
+		Text: textTemplate("text", `Hi {{.User.Name}},
+
+Use the following token to activate your account: {{.Token}}
+
+This token expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.
+`),
+		HTML: htmlTemplate("html", `<p>Hi {{.User.Name}},</p>
+<p>Use the following token to activate your account: <code>{{.Token}}</code></p>
+<p>This token expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.</p>
+`),
+		SMS: textTemplate("sms", "Your activation token is {{.Token}}"),
+	},
+	ForgotPaswordToken: {
+		Subject: textTemplate("subject", "Reset your password"),
+		Text: textTemplate("text", `Hi {{.User.Name}},
+
+Use the following token to reset your password: {{.Token}}
+
+If you did not ask to reset your password, you can ignore this message.
+This token expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.
+`),
+		HTML: htmlTemplate("html", `<p>Hi {{.User.Name}},</p>
+<p>Use the following token to reset your password: <code>{{.Token}}</code></p>
+<p>If you did not ask to reset your password, you can ignore this message.
+This token expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.</p>
+`),
+		SMS: textTemplate("sms", "Your password reset token is {{.Token}}"),
+	},
+	MagicLinkToken: {
+		Subject: textTemplate("subject", "Log in to your account"),
+		Text: textTemplate("text", `Hi {{.User.Name}},
+
+Use the following token to log in: {{.Token}}
+
+If you did not ask to log in, you can ignore this message.
+This token expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.
+`),
+		HTML: htmlTemplate("html", `<p>Hi {{.User.Name}},</p>
+<p>Use the following token to log in: <code>{{.Token}}</code></p>
+<p>If you did not ask to log in, you can ignore this message.
+This token expires on {{.Expires.Format "2006-01-02 15:04 MST"}}.</p>
+`),
+	},
+	AccountLockedNotice: {
+		Subject: textTemplate("subject", "Your account has been locked"),
+		Text: textTemplate("text", `Hi {{.User.Name}},
+
+Your account was locked after too many failed login attempts, until {{.Expires.Format "2006-01-02 15:04 MST"}}.
+
+If this wasn't you, consider resetting your password.
+`),
+		HTML: htmlTemplate("html", `<p>Hi {{.User.Name}},</p>
+<p>Your account was locked after too many failed login attempts, until {{.Expires.Format "2006-01-02 15:04 MST"}}.</p>
+<p>If this wasn't you, consider resetting your password.</p>
+`),
+	},
+}
+
+func renderText(t *texttemplate.Template, data *TemplateData) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
+
+func renderHTML(t *htmltemplate.Template, data *TemplateData) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
+
+// RenderNotifications builds the notifications for a token: an email when
+// the user has an email address, and a text message when the user has a
+// phone number and the template has an SMS body.
+func RenderNotifications(templates map[Token]*MessageTemplate, u *User, t *UserOperationToken) ([]*Notification, error) {
+	data := &TemplateData{User: u, Token: t.ID.String(), Expires: time.Unix(t.Expiry, 0)}
+	return renderNotifications(templates, t.TokenType, data)
+}
+
+// renderNotifications renders the template for tokenType, including those
+// of notices without a token
+func renderNotifications(templates map[Token]*MessageTemplate, tokenType Token, data *TemplateData) ([]*Notification, error) {
+	u := data.User
+	tmpl, ok := templates[tokenType]
+	if !ok {
+		return nil, nil
+	}
+
+	var notifications []*Notification
+	if u.Email != "" && (tmpl.Text != nil || tmpl.HTML != nil) {
+		subject, err := renderText(tmpl.Subject, data)
+		if err != nil {
+			return nil, err
+		}
+		text, err := renderText(tmpl.Text, data)
+		if err != nil {
+			return nil, err
+		}
+		html, err := renderHTML(tmpl.HTML, data)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, &Notification{
+			Channel:   EmailChannel,
+			To:        u.Email,
+			Subject:   subject,
+			Text:      text,
+			HTML:      html,
+			TokenType: tokenType,
+		})
+	}
+
+	if u.PhoneNumber != "" && tmpl.SMS != nil {
+		text, err := renderText(tmpl.SMS, data)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, &Notification{
+			Channel:   SMSChannel,
+			To:        u.PhoneNumber,
+			Text:      text,
+			TokenType: tokenType,
+		})
+	}
+	return notifications, nil
+}
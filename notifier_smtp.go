@@ -0,0 +1,91 @@
+package usermod
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier delivers email notifications through an SMTP server.
+type SMTPNotifier struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func NewSMTPNotifier(addr, from string, auth smtp.Auth) *SMTPNotifier {
+	return &SMTPNotifier{Addr: addr, From: from, Auth: auth}
+}
+
+func (s *SMTPNotifier) Notify(ctx context.Context, n *Notification) error {
+	if n.Channel != EmailChannel {
+		return ErrUnsupportedChannel
+	}
+	msg, err := s.message(n)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{n.To}, msg)
+}
+
+// headerValue strips line breaks, so values can't inject extra headers
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+func writeQuotedPrintable(b *bytes.Buffer, s string) error {
+	w := quotedprintable.NewWriter(b)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (s *SMTPNotifier) message(n *Notification) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerValue(s.From))
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue(n.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(n.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if n.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		err := writeQuotedPrintable(&b, n.Text)
+		return b.Bytes(), err
+	}
+
+	rb := make([]byte, 12)
+	if _, err := rand.Read(rb); err != nil {
+		return nil, err
+	}
+	boundary := hex.EncodeToString(rb)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{{"text/plain", n.Text}, {"text/html", n.HTML}}
+	for _, p := range parts {
+		if p.body == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", p.contentType)
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&b, p.body); err != nil {
+			return nil, err
+		}
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes(), nil
+}
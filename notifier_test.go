@@ -0,0 +1,177 @@
+package usermod_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSMTPServer accepts mail on a local port, keeping each message body
+type fakeSMTPServer struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []string
+	rcpts    []string
+}
+
+func newFakeSMTPServer() (*fakeSMTPServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &fakeSMTPServer{ln: ln}
+	go srv.serve()
+	return srv, nil
+}
+
+func (f *fakeSMTPServer) Addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeSMTPServer) Close() {
+	f.ln.Close()
+}
+
+func (f *fakeSMTPServer) Messages() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+func (f *fakeSMTPServer) Rcpts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.rcpts...)
+}
+
+func (f *fakeSMTPServer) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	reply("220 localhost fake smtp")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			f.mu.Lock()
+			f.rcpts = append(f.rcpts, strings.TrimSpace(line[len("RCPT TO:"):]))
+			f.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var body strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				body.WriteString(l)
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, body.String())
+			f.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *UserModTestSuite) TestSMTPNotifier() {
+	srv, err := newFakeSMTPServer()
+	assert.Nil(s.T(), err)
+	defer srv.Close()
+
+	n := usermod.NewSMTPNotifier(srv.Addr(), "noreply@ummmfoo.com", nil)
+	err = n.Notify(context.Background(), &usermod.Notification{
+		Channel: usermod.EmailChannel,
+		To:      "c@ummmfoo.com",
+		Subject: "Hello\r\nBcc: evil@ummmfoo.com",
+		Text:    "plain body",
+		HTML:    "<p>html body</p>",
+	})
+	assert.Nil(s.T(), err)
+
+	msgs := srv.Messages()
+	assert.Equal(s.T(), 1, len(msgs))
+	assert.Contains(s.T(), msgs[0], "To: c@ummmfoo.com")
+	assert.Contains(s.T(), msgs[0], "multipart/alternative")
+	assert.Contains(s.T(), msgs[0], "plain body")
+	assert.Contains(s.T(), msgs[0], "<p>html body</p>")
+	assert.NotContains(s.T(), msgs[0], "\r\nBcc:")
+	assert.Equal(s.T(), []string{"<c@ummmfoo.com>"}, srv.Rcpts())
+
+	err = n.Notify(context.Background(), &usermod.Notification{Channel: usermod.SMSChannel})
+	assert.Equal(s.T(), usermod.ErrUnsupportedChannel, err)
+}
+
+func (s *UserModTestSuite) TestRenderNotifications() {
+	u := usermod.NewUserWithPhoneNumber(s.db, "Chayim", "c@ummmfoo.com", testPassword, "41677791231")
+	t := usermod.NewUserOperationTokenWithExpires(s.db, u.ID, usermod.ForgotPaswordToken, time.Now().Add(time.Hour))
+
+	notifications, err := usermod.RenderNotifications(usermod.DefaultTemplates, u, t)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 2, len(notifications))
+
+	email := notifications[0]
+	assert.Equal(s.T(), usermod.EmailChannel, email.Channel)
+	assert.Equal(s.T(), u.Email, email.To)
+	assert.Equal(s.T(), "Reset your password", email.Subject)
+	assert.Contains(s.T(), email.Text, t.ID.String())
+	assert.Contains(s.T(), email.HTML, t.ID.String())
+
+	sms := notifications[1]
+	assert.Equal(s.T(), usermod.SMSChannel, sms.Channel)
+	assert.Equal(s.T(), u.PhoneNumber, sms.To)
+	assert.Contains(s.T(), sms.Text, t.ID.String())
+
+	// user names are escaped in html
+	u.Name = "<script>"
+	notifications, err = usermod.RenderNotifications(usermod.DefaultTemplates, u, t)
+	assert.Nil(s.T(), err)
+	assert.NotContains(s.T(), notifications[0].HTML, "<script>")
+}
+
+func (s *UserModTestSuite) TestChannelNotifier() {
+	email := usermod.NewRecordingNotifier()
+	sms := usermod.NewRecordingNotifier()
+	n := &usermod.ChannelNotifier{Email: email, SMS: sms}
+
+	ctx := context.Background()
+	assert.Nil(s.T(), n.Notify(ctx, &usermod.Notification{Channel: usermod.EmailChannel, To: "a"}))
+	assert.Nil(s.T(), n.Notify(ctx, &usermod.Notification{Channel: usermod.SMSChannel, To: "b"}))
+
+	assert.Equal(s.T(), 1, len(email.Notifications()))
+	assert.Equal(s.T(), "a", email.Notifications()[0].To)
+	assert.Equal(s.T(), 1, len(sms.Notifications()))
+	assert.Equal(s.T(), "b", sms.Notifications()[0].To)
+}
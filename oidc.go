@@ -0,0 +1,368 @@
+package usermod
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrOAuthClientNotFound = errors.New("oauth client not found")
+var ErrOAuthCodeInvalid = errors.New("invalid authorization code")
+
+var oauthClientTblName = "oauth_clients"
+var oauthRedirectURITblName = "oauth_client_redirect_uris"
+var oauthCodeTblName = "oauth_codes"
+
+// OAuthCodeExpiry is how long an authorization code may be exchanged for
+var OAuthCodeExpiry = time.Minute
+
+// OIDCScopes are the scopes the provider understands. Each adds claims to
+// the ID token and userinfo response: profile adds name, email adds email
+// and email_verified, phone adds phone_number.
+var OIDCScopes = []string{"openid", "profile", "email", "phone"}
+
+// OIDCProviderConfig makes usermod an OpenID Connect provider. Issuer is
+// the URL the router is mounted at. ID tokens are signed with the router's
+// TokenConfig, whose current key must be asymmetric. Unauthenticated users
+// are redirected to LoginURL, with the authorization request in the
+// return_to parameter, or refused when it is empty.
+type OIDCProviderConfig struct {
+	Issuer        string
+	LoginURL      string
+	IDTokenExpiry time.Duration
+}
+
+// OAuthClient is a relying party. Public clients, such as single page
+// apps, have no secret and rely on PKCE alone.
+type OAuthClient struct {
+	ID           string
+	Name         string
+	SecretHash   []byte
+	RedirectURIs []string
+	Created      int64
+}
+
+func (c *OAuthClient) IsPublic() bool {
+	return len(c.SecretHash) == 0
+}
+
+func (c *OAuthClient) allowsRedirect(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *OAuthClient) checkSecret(secret string) bool {
+	return bcrypt.CompareHashAndPassword(c.SecretHash, []byte(secret)) == nil
+}
+
+// OAuthCode is an authorization code, waiting to be exchanged for tokens
+// by the client it was issued to.
+type OAuthCode struct {
+	Code          string
+	ClientID      string
+	UserID        uuid.UUID
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	Expiry        int64
+	Used          bool
+}
+
+// OAuthStore persists OpenID Connect clients and authorization codes
+type OAuthStore interface {
+	InsertOAuthClient(ctx context.Context, c *OAuthClient) error
+	GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error)
+	DeleteOAuthClient(ctx context.Context, id string) error
+	InsertOAuthCode(ctx context.Context, c *OAuthCode) error
+	GetOAuthCode(ctx context.Context, code string) (*OAuthCode, error)
+	ConsumeOAuthCode(ctx context.Context, code string) (*OAuthCode, error)
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64url.EncodeToString(b), nil
+}
+
+// RegisterOAuthClient creates a client allowed to redirect to the given
+// uris. Confidential clients get a secret, which is returned here only.
+func RegisterOAuthClient(ctx context.Context, store OAuthStore, name string, redirectURIs []string, public bool) (*OAuthClient, string, error) {
+	if len(redirectURIs) == 0 {
+		return nil, "", errors.New("at least one redirect uri is required")
+	}
+	c := OAuthClient{ID: uuid.New().String(), Name: name, RedirectURIs: redirectURIs, Created: time.Now().Unix()}
+	secret := ""
+	if !public {
+		var err error
+		if secret, err = randomToken(32); err != nil {
+			return nil, "", err
+		}
+		if c.SecretHash, err = bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost); err != nil {
+			return nil, "", err
+		}
+	}
+	return &c, secret, store.InsertOAuthClient(ctx, &c)
+}
+
+// verifyPKCE checks the verifier against an S256 challenge
+func verifyPKCE(challenge, verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	expected := b64url.EncodeToString(sum[:])
+	return challenge != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// IDTokenClaims are the claims of an ID token, also returned by userinfo
+type IDTokenClaims struct {
+	Nonce         string `json:"nonce,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	PhoneNumber   string `json:"phone_number,omitempty"`
+	jwt.StandardClaims
+}
+
+// userClaims fills in the claims the scope allows
+func userClaims(u *User, scope string) IDTokenClaims {
+	c := IDTokenClaims{StandardClaims: jwt.StandardClaims{Subject: u.ID.String()}}
+	if hasScope(scope, "profile") {
+		c.Name = u.Name
+	}
+	if hasScope(scope, "email") {
+		verified := u.IsActivated
+		c.Email = u.Email
+		c.EmailVerified = &verified
+	}
+	if hasScope(scope, "phone") {
+		c.PhoneNumber = u.PhoneNumber
+	}
+	return c
+}
+
+func (cfg *OIDCProviderConfig) idTokenExpiry() time.Duration {
+	if cfg.IDTokenExpiry > 0 {
+		return cfg.IDTokenExpiry
+	}
+	return time.Hour
+}
+
+// CreateIDToken signs an ID token for the client with the current key,
+// which clients verify through the published key set
+func (cfg *OIDCProviderConfig) CreateIDToken(keys *KeySet, u *User, code *OAuthCode) (string, error) {
+	if keys.Current().IsSymmetric() {
+		return "", ErrSymmetricKey
+	}
+	now := time.Now()
+	claims := userClaims(u, code.Scope)
+	claims.Nonce = code.Nonce
+	claims.Issuer = cfg.Issuer
+	claims.Audience = code.ClientID
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(cfg.idTokenExpiry()).Unix()
+
+	return keys.Sign(claims)
+}
+
+// createAccessToken is a usermod token limited to the client and the
+// granted scope, which only OAuthTokenAuth accepts
+func (c *TokenConfig) createAccessToken(u *User, code *OAuthCode) (string, error) {
+	claims, err := c.newClaims(u)
+	if err != nil {
+		return "", err
+	}
+	claims.Scope = code.Scope
+	claims.Audience = code.ClientID
+	return c.Keys.Sign(claims)
+}
+
+// issuedToClient reports whether the token was issued to an OAuth client,
+// as an access or ID token, rather than to the user
+func (c *Claims) issuedToClient() bool {
+	return c.Audience != "" || c.Scope != ""
+}
+
+// JWK is a public key in the JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// PublicKey decodes RSA, P-256 EC and Ed25519 keys
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid rsa jwk")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid ec jwk")
+		}
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid okp jwk")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported jwk type %s", k.Kty)
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func rsaJWK(key *rsa.PublicKey, kid string) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func (s *SQLStore) InsertOAuthClient(ctx context.Context, c *OAuthClient) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("INSERT INTO %s (id, name, secret_hash, created) VALUES ($1, $2, $3, $4)", oauthClientTblName)
+	if _, err = tx.ExecContext(ctx, s.dialect.Rebind(query), c.ID, c.Name, c.SecretHash, c.Created); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("INSERT INTO %s (client_id, uri) VALUES ($1, $2)", oauthRedirectURITblName)
+	for _, uri := range c.RedirectURIs {
+		if _, err = tx.ExecContext(ctx, s.dialect.Rebind(query), c.ID, uri); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	c := OAuthClient{}
+	query := fmt.Sprintf("SELECT id, name, secret_hash, created FROM %s WHERE id = $1", oauthClientTblName)
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id).Scan(&c.ID, &c.Name, &c.SecretHash, &c.Created)
+	if err == sql.ErrNoRows {
+		return nil, ErrOAuthClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query = fmt.Sprintf("SELECT uri FROM %s WHERE client_id = $1 ORDER BY uri", oauthRedirectURITblName)
+	c.RedirectURIs, err = s.strings(ctx, query, id)
+	return &c, err
+}
+
+func (s *SQLStore) DeleteOAuthClient(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		fmt.Sprintf("DELETE FROM %s WHERE client_id = $1", oauthCodeTblName),
+		fmt.Sprintf("DELETE FROM %s WHERE client_id = $1", oauthRedirectURITblName),
+		fmt.Sprintf("DELETE FROM %s WHERE id = $1", oauthClientTblName),
+	} {
+		if _, err = tx.ExecContext(ctx, s.dialect.Rebind(q), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) InsertOAuthCode(ctx context.Context, c *OAuthCode) error {
+	query := fmt.Sprintf("INSERT INTO %s (code, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expiry, used) "+
+		"VALUES (%s)", oauthCodeTblName, placeholders(9))
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), c.Code, c.ClientID, c.UserID.String(), c.RedirectURI,
+		c.Scope, c.Nonce, c.CodeChallenge, c.Expiry, c.Used)
+	return err
+}
+
+// GetOAuthCode returns a code whether or not it is still valid, failing
+// with ErrOAuthCodeInvalid when it doesn't exist
+func (s *SQLStore) GetOAuthCode(ctx context.Context, code string) (*OAuthCode, error) {
+	c := OAuthCode{}
+	query := fmt.Sprintf("SELECT code, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expiry, used "+
+		"FROM %s WHERE code = $1", oauthCodeTblName)
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), code).Scan(&c.Code, &c.ClientID, &c.UserID,
+		&c.RedirectURI, &c.Scope, &c.Nonce, &c.CodeChallenge, &c.Expiry, &c.Used)
+	if err == sql.ErrNoRows {
+		return nil, ErrOAuthCodeInvalid
+	}
+	return &c, err
+}
+
+// ConsumeOAuthCode atomically marks a valid, unused code as used and
+// returns it, failing with ErrOAuthCodeInvalid otherwise
+func (s *SQLStore) ConsumeOAuthCode(ctx context.Context, code string) (*OAuthCode, error) {
+	query := fmt.Sprintf("UPDATE %s SET used = $1 WHERE code = $2 AND used = $3 AND expiry > $4", oauthCodeTblName)
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), true, code, false, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrOAuthCodeInvalid
+	}
+	return s.GetOAuthCode(ctx, code)
+}
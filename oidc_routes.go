@@ -0,0 +1,284 @@
+package usermod
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type OIDCDiscoveryJSON struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type OAuthTokenJSON struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+type OAuthClientJSON struct {
+	ID           string   `json:"client_id,omitempty"`
+	Secret       string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Public       bool     `json:"public"`
+}
+
+// oauthError responds in the format RFC 6749 requires of the token endpoint
+func oauthError(w http.ResponseWriter, code, description string, status int) {
+	b, _ := json.Marshal(map[string]string{"error": code, "error_description": description})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// redirectWith sends the user agent back to the client with params added
+// to the redirect uri
+func redirectWith(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// oidcLogin sends users without credentials to the configured login page,
+// and authenticates everyone else as usual
+func (rr *Router) oidcLogin(auth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authed := auth(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := r.Cookie(SessionCookieName)
+			if rr.oidc.LoginURL != "" && r.Header.Get("Authorization") == "" && err != nil {
+				redirectWith(w, r, rr.oidc.LoginURL, url.Values{"return_to": {r.URL.RequestURI()}})
+				return
+			}
+			authed.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (rr *Router) OIDCDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := strings.TrimSuffix(rr.oidc.Issuer, "/")
+	writeJSON(w, OIDCDiscoveryJSON{
+		Issuer:                            rr.oidc.Issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/oauth/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   OIDCScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{rr.tokens.Keys.Current().Method.Alg()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "name", "email", "email_verified", "phone_number"},
+	})
+}
+
+// Authorize issues an authorization code to the logged in user, for the
+// client to exchange at the token endpoint. Clients are trusted, so the
+// user isn't asked for consent. PKCE is required of every client.
+func (rr *Router) Authorize(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+	q := r.URL.Query()
+
+	// without a known client and redirect uri, errors can't be redirected
+	client, err := rr.store.GetOAuthClient(r.Context(), q.Get("client_id"))
+	if err != nil {
+		jsonErrorFromString(w, "invalid client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !client.allowsRedirect(redirectURI) {
+		jsonErrorFromString(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	state := q.Get("state")
+	fail := func(code, description string) {
+		redirectWith(w, r, redirectURI, url.Values{"error": {code}, "error_description": {description}, "state": {state}})
+	}
+	if q.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the code response type is supported")
+		return
+	}
+	scope := q.Get("scope")
+	if !hasScope(scope, "openid") {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "an S256 code_challenge is required")
+		return
+	}
+
+	granted := []string{}
+	for _, s := range OIDCScopes {
+		if hasScope(scope, s) {
+			granted = append(granted, s)
+		}
+	}
+	code, err := randomToken(32)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = rr.store.InsertOAuthCode(r.Context(), &OAuthCode{
+		Code:          code,
+		ClientID:      client.ID,
+		UserID:        u.ID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(granted, " "),
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: q.Get("code_challenge"),
+		Expiry:        time.Now().Add(OAuthCodeExpiry).Unix(),
+	})
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	redirectWith(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+}
+
+// clientCredentials reads client_secret_basic or client_secret_post
+// credentials, or just the client id of a public client
+func clientCredentials(r *http.Request) (string, string) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		return id, secret
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+// OAuthToken exchanges an authorization code for an access and ID token
+func (rr *Router) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request", err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type", "only authorization_code is supported", http.StatusBadRequest)
+		return
+	}
+
+	id, secret := clientCredentials(r)
+	client, err := rr.store.GetOAuthClient(r.Context(), id)
+	if err != nil || (!client.IsPublic() && !client.checkSecret(secret)) {
+		oauthError(w, "invalid_client", "client authentication failed", http.StatusUnauthorized)
+		return
+	}
+
+	// the code is only consumed once the request is known to come from
+	// the client it was issued to, so that anyone else presenting it can't
+	// burn it
+	code, err := rr.store.GetOAuthCode(r.Context(), r.PostForm.Get("code"))
+	if err != nil || code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") ||
+		!verifyPKCE(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		oauthError(w, "invalid_grant", "invalid authorization code", http.StatusBadRequest)
+		return
+	}
+	code, err = rr.store.ConsumeOAuthCode(r.Context(), code.Code)
+	if err != nil {
+		oauthError(w, "invalid_grant", "invalid authorization code", http.StatusBadRequest)
+		return
+	}
+	u, err := rr.store.GetUserByID(r.Context(), code.UserID.String())
+	if err != nil || !u.IsActive() {
+		oauthError(w, "invalid_grant", "invalid user", http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := rr.oidc.CreateIDToken(rr.tokens.Keys, u, code)
+	if err != nil {
+		oauthError(w, "server_error", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := rr.tokens.createAccessToken(u, code)
+	if err != nil {
+		oauthError(w, "server_error", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, OAuthTokenJSON{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(rr.tokens.expiry().Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	})
+}
+
+// UserInfo returns the claims the access token's scope allows
+func (rr *Router) UserInfo(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+	claims := r.Context().Value(CTX_CLAIMS_KEY).(*Claims)
+	writeJSON(w, userClaims(u, claims.Scope))
+}
+
+// AdminCreateOAuthClient registers a client, responding with its secret,
+// which can't be retrieved later
+func (rr *Router) AdminCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	cj := OAuthClientJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &cj)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	for _, uri := range cj.RedirectURIs {
+		if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+			jsonErrorFromString(w, "invalid redirect uri "+uri, http.StatusBadRequest)
+			return
+		}
+	}
+
+	client, secret, err := RegisterOAuthClient(r.Context(), rr.store, cj.Name, cj.RedirectURIs, cj.Public)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	cj.ID, cj.Secret, cj.RedirectURIs = client.ID, secret, client.RedirectURIs
+	writeJSON(w, cj)
+}
+
+func (rr *Router) AdminDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	err := rr.store.DeleteOAuthClient(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
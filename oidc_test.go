@@ -0,0 +1,341 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chayim/usermod"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+// noRedirects lets tests inspect the redirects sent to the user agent
+var noRedirects = &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+// newOIDCProvider serves a router configured as a provider, whose issuer
+// is the server's own url
+func (s *UserModTestSuite) newOIDCProvider(loginURL string) (*httptest.Server, string) {
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(s.T(), err)
+
+	issuer := ts.URL + "/api"
+	r := chi.NewRouter()
+	keys := usermod.NewKeySet(usermod.NewRSAKey("test-key", key))
+	r.Mount("/api", usermod.NewRouter(s.store,
+		usermod.WithTokenConfig(usermod.NewTokenConfig(keys, 0)),
+		usermod.WithOIDCProvider(usermod.OIDCProviderConfig{
+			Issuer:   issuer,
+			LoginURL: loginURL,
+		})))
+	handler = r
+	return ts, issuer
+}
+
+func pkce() (string, string) {
+	verifier := base64.RawURLEncoding.EncodeToString([]byte(strings.Repeat("v", 43)))
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (s *UserModTestSuite) authorize(issuer, bearer string, params url.Values) *http.Response {
+	r, _ := http.NewRequest(http.MethodGet, issuer+"/oauth/authorize?"+params.Encode(), nil)
+	if bearer != "" {
+		r.Header.Add("Authorization", "Bearer "+bearer)
+	}
+	w, err := noRedirects.Do(r)
+	assert.Nil(s.T(), err)
+	return w
+}
+
+func (s *UserModTestSuite) exchangeCode(issuer, clientID, secret string, form url.Values) (*http.Response, usermod.OAuthTokenJSON) {
+	form.Set("grant_type", "authorization_code")
+	r, _ := http.NewRequest(http.MethodPost, issuer+"/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(clientID, secret)
+	w, err := http.DefaultClient.Do(r)
+	assert.Nil(s.T(), err)
+	tok := usermod.OAuthTokenJSON{}
+	if w.StatusCode == http.StatusOK {
+		assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&tok))
+	}
+	return w, tok
+}
+
+func (s *UserModTestSuite) jwksKey(issuer string) (string, *rsa.PublicKey) {
+	w, err := http.Get(issuer + "/.well-known/jwks.json")
+	assert.Nil(s.T(), err)
+	set := usermod.JWKSet{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&set))
+	assert.Len(s.T(), set.Keys, 1)
+	n, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].N)
+	e, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].E)
+	return set.Keys[0].Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+}
+
+func (s *UserModTestSuite) TestOIDCDiscovery() {
+	ts, issuer := s.newOIDCProvider("")
+	defer ts.Close()
+
+	w, err := http.Get(issuer + "/.well-known/openid-configuration")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	d := usermod.OIDCDiscoveryJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&d))
+	assert.Equal(s.T(), issuer, d.Issuer)
+	assert.Equal(s.T(), issuer+"/oauth/authorize", d.AuthorizationEndpoint)
+	assert.Equal(s.T(), issuer+"/oauth/token", d.TokenEndpoint)
+	assert.Equal(s.T(), issuer+"/.well-known/jwks.json", d.JWKSURI)
+	assert.Equal(s.T(), []string{"RS256"}, d.IDTokenSigningAlgValuesSupported)
+	assert.Equal(s.T(), []string{"S256"}, d.CodeChallengeMethodsSupported)
+
+	kid, _ := s.jwksKey(issuer)
+	assert.Equal(s.T(), "test-key", kid)
+}
+
+func (s *UserModTestSuite) TestOIDCAuthorizationCodeFlow() {
+	ts, issuer := s.newOIDCProvider("")
+	defer ts.Close()
+
+	admin := s.newAdmin()
+	body, _ := json.Marshal(usermod.OAuthClientJSON{Name: "app", RedirectURIs: []string{"https://app.example.com/cb"}})
+	r, _ := http.NewRequest(http.MethodPost, issuer+"/admin/oauth/clients", bytes.NewReader(body))
+	r.SetBasicAuth(admin.Email, string(testPassword))
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	client := usermod.OAuthClientJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&client))
+	assert.NotEqual(s.T(), "", client.Secret)
+
+	u := usermod.NewUserWithPhoneNumber(s.db, "Chayim", "oidc@ummmfoo.com", testPassword, "+15555550100")
+	assert.Nil(s.T(), u.Insert())
+	assert.Nil(s.T(), usermod.Activate(s.db, u.ID.String()))
+	token := s.loginAt(issuer, u, testPassword)
+
+	verifier, challenge := pkce()
+	w = s.authorize(issuer, token, url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {"https://app.example.com/cb"},
+		"scope":                 {"openid profile email phone unknown"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	})
+	assert.Equal(s.T(), http.StatusFound, w.StatusCode)
+	loc, _ := url.Parse(w.Header.Get("Location"))
+	assert.Equal(s.T(), "app.example.com", loc.Host)
+	assert.Equal(s.T(), "xyz", loc.Query().Get("state"))
+	code := loc.Query().Get("code")
+	assert.NotEqual(s.T(), "", code)
+
+	form := url.Values{"code": {code}, "redirect_uri": {"https://app.example.com/cb"}, "code_verifier": {verifier}}
+	w, _ = s.exchangeCode(issuer, client.ID, "wrong", form)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+
+	// a code presented with the wrong redirect uri or verifier is refused,
+	// but still works for the client
+	for _, wrong := range []url.Values{
+		{"code": {code}, "redirect_uri": {"https://evil.example.com/cb"}, "code_verifier": {verifier}},
+		{"code": {code}, "redirect_uri": {"https://app.example.com/cb"}, "code_verifier": {"not-the-verifier"}},
+		{"code": {code}, "redirect_uri": {"https://app.example.com/cb"}},
+	} {
+		w, _ = s.exchangeCode(issuer, client.ID, client.Secret, wrong)
+		assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+	}
+	w, tok := s.exchangeCode(issuer, client.ID, client.Secret, form)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	assert.Equal(s.T(), "Bearer", tok.TokenType)
+	assert.Equal(s.T(), "openid profile email phone", tok.Scope)
+
+	// the id token verifies against the published key
+	kid, pub := s.jwksKey(issuer)
+	claims := usermod.IDTokenClaims{}
+	parsed, err := jwt.ParseWithClaims(tok.IDToken, &claims, func(t *jwt.Token) (interface{}, error) {
+		assert.Equal(s.T(), kid, t.Header["kid"])
+		return pub, nil
+	})
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), parsed.Valid)
+	assert.Equal(s.T(), issuer, claims.Issuer)
+	assert.Equal(s.T(), client.ID, claims.Audience)
+	assert.Equal(s.T(), u.ID.String(), claims.Subject)
+	assert.Equal(s.T(), "n-0S6", claims.Nonce)
+	assert.Equal(s.T(), "Chayim", claims.Name)
+	assert.Equal(s.T(), u.Email, claims.Email)
+	assert.True(s.T(), *claims.EmailVerified)
+	assert.Equal(s.T(), "+15555550100", claims.PhoneNumber)
+
+	r, _ = http.NewRequest(http.MethodGet, issuer+"/oauth/userinfo", nil)
+	r.Header.Add("Authorization", "Bearer "+tok.AccessToken)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	info := usermod.IDTokenClaims{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(s.T(), u.ID.String(), info.Subject)
+	assert.Equal(s.T(), u.Email, info.Email)
+
+	// client tokens don't act as the user anywhere else, nor user tokens
+	// as a client's
+	for _, bearer := range []string{tok.AccessToken, tok.IDToken} {
+		r, _ = http.NewRequest(http.MethodGet, issuer+"/user", nil)
+		r.Header.Add("Authorization", "Bearer "+bearer)
+		w, _ = http.DefaultClient.Do(r)
+		assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+	}
+	own := s.loginAt(issuer, u, testPassword)
+	assert.NotEqual(s.T(), "", own)
+	r, _ = http.NewRequest(http.MethodGet, issuer+"/oauth/userinfo", nil)
+	r.Header.Add("Authorization", "Bearer "+own)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+
+	// codes are single use
+	w, _ = s.exchangeCode(issuer, client.ID, client.Secret, form)
+	assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestOIDCPublicClient() {
+	ts, issuer := s.newOIDCProvider("https://login.example.com/")
+	defer ts.Close()
+
+	client, secret, err := usermod.RegisterOAuthClient(context.Background(), s.store, "spa",
+		[]string{"https://spa.example.com/cb"}, true)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "", secret)
+	assert.True(s.T(), client.IsPublic())
+
+	u := s.newActivatedUser()
+	token := s.loginAt(issuer, u, testPassword)
+	verifier, challenge := pkce()
+	params := func(mod func(v url.Values)) url.Values {
+		v := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {client.ID},
+			"redirect_uri":          {"https://spa.example.com/cb"},
+			"scope":                 {"openid email"},
+			"state":                 {"abc"},
+			"code_challenge":        {challenge},
+			"code_challenge_method": {"S256"},
+		}
+		mod(v)
+		return v
+	}
+
+	tests := []struct {
+		name       string
+		bearer     string
+		params     url.Values
+		statusCode int
+		location   string
+		errorCode  string
+	}{{
+		name:       "not logged in",
+		params:     params(func(v url.Values) {}),
+		statusCode: http.StatusFound,
+		location:   "login.example.com",
+	}, {
+		name:       "unknown client",
+		bearer:     token,
+		params:     params(func(v url.Values) { v.Set("client_id", "nope") }),
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "unregistered redirect",
+		bearer:     token,
+		params:     params(func(v url.Values) { v.Set("redirect_uri", "https://evil.example.com/cb") }),
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "no openid scope",
+		bearer:     token,
+		params:     params(func(v url.Values) { v.Set("scope", "email") }),
+		statusCode: http.StatusFound,
+		location:   "spa.example.com",
+		errorCode:  "invalid_scope",
+	}, {
+		name:       "no pkce",
+		bearer:     token,
+		params:     params(func(v url.Values) { v.Del("code_challenge") }),
+		statusCode: http.StatusFound,
+		location:   "spa.example.com",
+		errorCode:  "invalid_request",
+	}, {
+		name:       "plain pkce",
+		bearer:     token,
+		params:     params(func(v url.Values) { v.Set("code_challenge_method", "plain") }),
+		statusCode: http.StatusFound,
+		location:   "spa.example.com",
+		errorCode:  "invalid_request",
+	}}
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			w := s.authorize(issuer, tt.bearer, tt.params)
+			assert.Equal(t, tt.statusCode, w.StatusCode)
+			if tt.location != "" {
+				loc, _ := url.Parse(w.Header.Get("Location"))
+				assert.Equal(t, tt.location, loc.Host)
+				assert.Equal(t, tt.errorCode, loc.Query().Get("error"))
+			}
+		})
+	}
+
+	exchange := func(verifier string) *http.Response {
+		w := s.authorize(issuer, token, params(func(v url.Values) {}))
+		loc, _ := url.Parse(w.Header.Get("Location"))
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {loc.Query().Get("code")},
+			"redirect_uri":  {"https://spa.example.com/cb"},
+			"client_id":     {client.ID},
+			"code_verifier": {verifier},
+		}
+		w, err := http.PostForm(issuer+"/oauth/token", form)
+		assert.Nil(s.T(), err)
+		return w
+	}
+
+	// public clients are held to PKCE alone
+	assert.Equal(s.T(), http.StatusBadRequest, exchange("not-the-verifier").StatusCode)
+
+	// nor can another client spend their codes
+	other, _, err := usermod.RegisterOAuthClient(context.Background(), s.store, "other",
+		[]string{"https://spa.example.com/cb"}, true)
+	assert.Nil(s.T(), err)
+	w := s.authorize(issuer, token, params(func(v url.Values) {}))
+	loc, _ := url.Parse(w.Header.Get("Location"))
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {loc.Query().Get("code")},
+		"redirect_uri":  {"https://spa.example.com/cb"},
+		"code_verifier": {verifier},
+	}
+	form.Set("client_id", other.ID)
+	w, _ = http.PostForm(issuer+"/oauth/token", form)
+	assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+	form.Set("client_id", client.ID)
+	w, _ = http.PostForm(issuer+"/oauth/token", form)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	w = exchange(verifier)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	tok := usermod.OAuthTokenJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&tok))
+	assert.Equal(s.T(), "openid email", tok.Scope)
+}
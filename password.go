@@ -0,0 +1,212 @@
+package usermod
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrPasswordMismatch = errors.New("password does not match")
+var ErrUnknownHash = errors.New("unknown password hash")
+var ErrInvalidHash = errors.New("invalid password hash parameters")
+
+// PasswordHasher hashes passwords into self describing strings, which name
+// the algorithm and its parameters
+type PasswordHasher interface {
+	Hash(password []byte) ([]byte, error)
+	// Verify fails with ErrPasswordMismatch for the wrong password, and
+	// ErrUnknownHash for hashes made by another algorithm
+	Verify(hash, password []byte) error
+	// NeedsRehash is true for hashes made by another algorithm, or with
+	// other parameters
+	NeedsRehash(hash []byte) bool
+}
+
+// DefaultPasswordHasher hashes new passwords. Hashes made by any other
+// hasher are still verified, and replaced on the user's next login.
+var DefaultPasswordHasher PasswordHasher = NewArgon2idHasher(DefaultArgon2idParams)
+
+// Argon2idParams are argon2id's costs. Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams follow the OWASP recommendation of 19 MiB and two
+// iterations
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2idHasher stores hashes in the PHC string format, such as
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+type Argon2idHasher struct {
+	Params Argon2idParams
+}
+
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{Params: params}
+}
+
+var argon2idPrefix = []byte("$argon2id$")
+
+// The parameters a stored hash may ask for. Below them argon2 panics or a
+// short key matches too many passwords, and above them verifying is a
+// denial of service.
+const (
+	argon2idMaxMemory     = 4 * 1024 * 1024
+	argon2idMaxIterations = 100
+	argon2idMinSalt       = 8
+	argon2idMaxSalt       = 64
+	argon2idMinKey        = 16
+	argon2idMaxKey        = 64
+)
+
+func (h *Argon2idHasher) Hash(password []byte) ([]byte, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	p := h.Params
+	key := argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations,
+		p.Parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// parse reads the parameters, salt and key from a PHC string, failing with
+// ErrInvalidHash when they are out of range
+func (h *Argon2idHasher) parse(hash []byte) (Argon2idParams, []byte, []byte, error) {
+	p := Argon2idParams{}
+	if !bytes.HasPrefix(hash, argon2idPrefix) {
+		return p, nil, nil, ErrUnknownHash
+	}
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+	if p.Parallelism == 0 || p.Memory < 8*uint32(p.Parallelism) || p.Memory > argon2idMaxMemory ||
+		p.Iterations == 0 || p.Iterations > argon2idMaxIterations ||
+		p.SaltLength < argon2idMinSalt || p.SaltLength > argon2idMaxSalt ||
+		p.KeyLength < argon2idMinKey || p.KeyLength > argon2idMaxKey {
+		return p, nil, nil, ErrInvalidHash
+	}
+	return p, salt, key, nil
+}
+
+func (h *Argon2idHasher) Verify(hash, password []byte) error {
+	p, salt, key, err := h.parse(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash []byte) bool {
+	p, _, _, err := h.parse(hash)
+	return err != nil || p != h.Params
+}
+
+// BcryptHasher stores hashes in bcrypt's own format, such as
+// $2a$10$<salt and key>. bcrypt ignores passwords past 72 bytes, so longer
+// ones are refused rather than truncated.
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{Cost: cost}
+}
+
+func isBcrypt(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2a$")) || bytes.HasPrefix(hash, []byte("$2b$")) ||
+		bytes.HasPrefix(hash, []byte("$2y$"))
+}
+
+func (h *BcryptHasher) Hash(password []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(password, h.Cost)
+}
+
+func (h *BcryptHasher) Verify(hash, password []byte) error {
+	if !isBcrypt(hash) {
+		return ErrUnknownHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func (h *BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return !isBcrypt(hash) || err != nil || cost != h.Cost
+}
+
+// knownHashers verify hashes made before DefaultPasswordHasher was changed.
+// Both read their parameters from the hash, so theirs don't matter.
+var knownHashers = []PasswordHasher{
+	NewArgon2idHasher(DefaultArgon2idParams),
+	NewBcryptHasher(bcrypt.DefaultCost),
+}
+
+// dummyPasswordHash is verified in place of a hash that doesn't exist, so
+// that failing for want of a user or code takes as long as failing with one
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := EncryptPassword([]byte("usermod dummy"))
+	return hash
+})
+
+// verifyPassword checks the password against a hash made by any known
+// hasher, and reports whether the hash should be replaced with one made by
+// DefaultPasswordHasher
+func verifyPassword(hash, password []byte) (bool, error) {
+	if len(hash) == 0 {
+		return false, ErrPasswordMismatch
+	}
+	err := DefaultPasswordHasher.Verify(hash, password)
+	for _, h := range knownHashers {
+		if err != ErrUnknownHash {
+			break
+		}
+		err = h.Verify(hash, password)
+	}
+	if err != nil {
+		return false, err
+	}
+	return DefaultPasswordHasher.NeedsRehash(hash), nil
+}
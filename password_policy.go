@@ -0,0 +1,346 @@
+package usermod
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+var passwordHistoryTblName = "password_history"
+
+// PasswordViolation is one way a password fails the policy. Codes are
+// stable, so that clients can show their own messages.
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every way a password fails the policy
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return "password rejected: " + strings.Join(messages, ", ")
+}
+
+func (e *PasswordPolicyError) add(code, format string, args ...any) {
+	e.Violations = append(e.Violations, PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// PasswordPolicy is enforced by the router wherever a password is set.
+// Lengths are in characters, and MinStrength is a PasswordStrength score.
+// History refuses the current password and the History before it, and
+// Breaches, when set, passwords known from data breaches.
+type PasswordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	RequireUpper     bool
+	RequireLower     bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	MinStrength      int
+	DisallowPersonal bool
+	History          int
+	Breaches         BreachChecker
+}
+
+// NewPasswordPolicy follows NIST's advice of long passwords without
+// composition rules: at least 8 characters, a strength of 2, no personal
+// details, and no reuse of the last 5 passwords
+func NewPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        128,
+		MinStrength:      2,
+		DisallowPersonal: true,
+		History:          5,
+	}
+}
+
+// personalDetails are the parts of the user's email and name long enough
+// to matter
+func personalDetails(u *User) []string {
+	var details []string
+	local, _, _ := strings.Cut(u.Email, "@")
+	for _, s := range append([]string{u.Email, local}, strings.Fields(u.Name)...) {
+		if utf8.RuneCountInString(s) >= 3 {
+			details = append(details, strings.ToLower(s))
+		}
+	}
+	return details
+}
+
+// Validate checks the password for u against everything but the history,
+// returning a *PasswordPolicyError
+func (p *PasswordPolicy) Validate(password []byte, u *User) error {
+	pw := string(password)
+	e := &PasswordPolicyError{}
+	if n := utf8.RuneCountInString(pw); n < p.MinLength {
+		e.add("too_short", "must be at least %d characters", p.MinLength)
+	} else if p.MaxLength > 0 && n > p.MaxLength {
+		e.add("too_long", "must be at most %d characters", p.MaxLength)
+	}
+
+	classes := []struct {
+		required bool
+		is       func(rune) bool
+		code     string
+		message  string
+	}{
+		{p.RequireUpper, unicode.IsUpper, "missing_upper", "must contain an uppercase letter"},
+		{p.RequireLower, unicode.IsLower, "missing_lower", "must contain a lowercase letter"},
+		{p.RequireDigit, unicode.IsDigit, "missing_digit", "must contain a digit"},
+		{p.RequireSymbol, isSymbol, "missing_symbol", "must contain a symbol"},
+	}
+	for _, c := range classes {
+		if c.required && strings.IndexFunc(pw, c.is) < 0 {
+			e.add(c.code, c.message)
+		}
+	}
+
+	details := personalDetails(u)
+	if p.DisallowPersonal {
+		lower := strings.ToLower(pw)
+		for _, d := range details {
+			if strings.Contains(lower, d) {
+				e.add("personal_details", "must not contain your name or email")
+				break
+			}
+		}
+	}
+	if p.MinStrength > 0 && pw != "" && PasswordStrength(pw, details...) < p.MinStrength {
+		e.add("too_weak", "is too easy to guess")
+	}
+
+	if len(e.Violations) > 0 {
+		return e
+	}
+	return nil
+}
+
+// CheckHistory refuses the user's current password, and those in their
+// history, returning a *PasswordPolicyError
+func (p *PasswordPolicy) CheckHistory(ctx context.Context, store PasswordHistoryStore, u *User, password []byte) error {
+	if p.History <= 0 {
+		return nil
+	}
+	hashes, err := store.GetPasswordHistory(ctx, u.ID.String(), p.History)
+	if err != nil {
+		return err
+	}
+	for _, hash := range append([][]byte{u.Password}, hashes...) {
+		if _, err := verifyPassword(hash, password); err == nil {
+			e := &PasswordPolicyError{}
+			e.add("reused", "must not be one of your last %d passwords", p.History)
+			return e
+		}
+	}
+	return nil
+}
+
+// CheckBreached refuses passwords known to Breaches, returning a
+// *PasswordPolicyError
+func (p *PasswordPolicy) CheckBreached(ctx context.Context, password []byte) error {
+	if p.Breaches == nil {
+		return nil
+	}
+	breached, err := p.Breaches.IsBreached(ctx, password)
+	if err != nil || !breached {
+		return err
+	}
+	e := &PasswordPolicyError{}
+	e.add("breached", "has appeared in a data breach")
+	return e
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+}
+
+// commonPasswords are guessed first, alone or as part of a longer password
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234", "111111",
+	"1234567", "dragon", "123123", "baseball", "abc123", "football", "monkey", "letmein",
+	"696969", "shadow", "master", "666666", "qwertyuiop", "123321", "mustang", "1234567890",
+	"michael", "654321", "superman", "1qaz2wsx", "7777777", "121212", "000000", "qazwsx",
+	"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel", "starwars",
+	"klaster", "112233", "george", "computer", "michelle", "jessica", "pepper", "1111",
+	"zxcvbn", "555555", "11111111", "131313", "freedom", "777777", "pass", "maggie",
+	"159753", "aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+	"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access", "yankees",
+	"987654321", "dallas", "austin", "thunder", "taylor", "matrix", "welcome", "admin",
+	"login", "passw0rd", "asdf", "qwer", "changeme", "secret",
+}
+
+// charsetSize is the number of characters an attacker must try for each
+// position, given the classes the password draws from
+func charsetSize(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0.0
+	for _, c := range []struct {
+		used bool
+		size float64
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			size += c.size
+		}
+	}
+	return size
+}
+
+// PasswordStrength estimates how hard the password is to guess, from 0 to
+// 4, in the manner of zxcvbn. Common passwords and the user's own details
+// count as a single guess from a short list, and characters that repeat or
+// continue a sequence, like aaa or 1234, add little.
+func PasswordStrength(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+	guesses := 1.0
+	words := append([]string{}, commonPasswords...)
+	for _, in := range userInputs {
+		words = append(words, strings.ToLower(in))
+	}
+	// longer words first, so that password isn't taken for pass
+	sort.SliceStable(words, func(a, b int) bool {
+		return len(words[a]) > len(words[b])
+	})
+	for _, word := range words {
+		if lower == word {
+			return 0
+		}
+		if len(word) >= 4 && strings.Contains(lower, word) {
+			lower = strings.ReplaceAll(lower, word, "\x00")
+			guesses *= 100
+		}
+	}
+
+	charset := charsetSize(password)
+	prev := rune(-1)
+	for _, r := range lower {
+		switch {
+		case r == 0:
+		case prev > 0 && (r == prev || r == prev+1 || r == prev-1):
+			guesses *= 2
+		default:
+			guesses *= charset
+		}
+		prev = r
+	}
+
+	switch log := math.Log10(guesses); {
+	case log < 3:
+		return 0
+	case log < 6:
+		return 1
+	case log < 8:
+		return 2
+	case log < 10:
+		return 3
+	}
+	return 4
+}
+
+// writePasswordError responds with the violations of a rejected password
+func writePasswordError(w http.ResponseWriter, err *PasswordPolicyError) {
+	b, _ := json.Marshal(struct {
+		Message string `json:"error"`
+		*PasswordPolicyError
+	}{err.Error(), err})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(b)
+}
+
+// PasswordHistoryStore remembers the hashes of the user's passwords, newest
+// first, keeping only the latest
+type PasswordHistoryStore interface {
+	AddPasswordHistory(ctx context.Context, uid string, hash []byte, keep int) error
+	GetPasswordHistory(ctx context.Context, uid string, n int) ([][]byte, error)
+}
+
+func (s *SQLStore) AddPasswordHistory(ctx context.Context, uid string, hash []byte, keep int) error {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (id, user_id, hash, created) VALUES ($1, $2, $3, $4)", passwordHistoryTblName)
+	_, err = s.db.ExecContext(ctx, s.dialect.Rebind(query), id.String(), uid, hash, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("SELECT id FROM %s WHERE user_id = $1 ORDER BY created DESC, id DESC", passwordHistoryTblName)
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), uid)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("DELETE FROM %s WHERE id = $1", passwordHistoryTblName)
+	for i := keep; i < len(ids); i++ {
+		if _, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), ids[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) GetPasswordHistory(ctx context.Context, uid string, n int) ([][]byte, error) {
+	query := fmt.Sprintf("SELECT hash FROM %s WHERE user_id = $1 ORDER BY created DESC, id DESC", passwordHistoryTblName)
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := [][]byte{}
+	for rows.Next() && len(hashes) < n {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
@@ -0,0 +1,127 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/chayim/usermod"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// violationCodes returns the codes of a rejected password, or nil
+func violationCodes(err error) []string {
+	rejected := &usermod.PasswordPolicyError{}
+	if !errors.As(err, &rejected) {
+		return nil
+	}
+	var codes []string
+	for _, v := range rejected.Violations {
+		codes = append(codes, v.Code)
+	}
+	return codes
+}
+
+func (s *UserModTestSuite) TestPasswordPolicy() {
+	u := &usermod.User{Name: "Chayim Kirshen", Email: "chayim@ummmfoo.com"}
+	strict := usermod.NewPasswordPolicy()
+	strict.RequireUpper, strict.RequireLower, strict.RequireDigit, strict.RequireSymbol = true, true, true, true
+
+	tests := []struct {
+		name     string
+		policy   *usermod.PasswordPolicy
+		password string
+		codes    []string
+	}{
+		{"empty", usermod.NewPasswordPolicy(), "", []string{"too_short"}},
+		{"short", usermod.NewPasswordPolicy(), "x7#kq", []string{"too_short"}},
+		{"common", usermod.NewPasswordPolicy(), "password123", []string{"too_weak"}},
+		{"sequence", usermod.NewPasswordPolicy(), "abcdefgh1234", []string{"too_weak"}},
+		{"email", usermod.NewPasswordPolicy(), "chayim@ummmfoo.com", []string{"personal_details", "too_weak"}},
+		{"name", usermod.NewPasswordPolicy(), "kirshen rules ok", []string{"personal_details"}},
+		{"passphrase", usermod.NewPasswordPolicy(), "correct horse battery", nil},
+		{"classes", strict, "correct horse battery", []string{"missing_upper", "missing_digit", "missing_symbol"}},
+		{"all classes", strict, "Correct horse battery 9!", nil},
+	}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.codes, violationCodes(tc.policy.Validate([]byte(tc.password), u)))
+		})
+	}
+
+	assert.Equal(s.T(), 0, usermod.PasswordStrength("qwerty"))
+	assert.Less(s.T(), usermod.PasswordStrength("aaaaaaaaaaaa"), 2)
+	assert.Less(s.T(), usermod.PasswordStrength("chayim123", "chayim"), 2)
+	assert.Equal(s.T(), 4, usermod.PasswordStrength("correct horse battery staple"))
+}
+
+func (s *UserModTestSuite) TestPasswordPolicyRoutes() {
+	// rejected passwords list every violation
+	b, _ := json.Marshal(usermod.CreateUserJSON{Name: "Weak", Email: "weak@ummmfoo.com", Password: "weak"})
+	w, _ := http.Post(s.ts.URL+"/api/user", "application/json", bytes.NewReader(b))
+	assert.Equal(s.T(), http.StatusBadRequest, w.StatusCode)
+	rejected := usermod.PasswordPolicyError{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&rejected))
+	assert.Equal(s.T(), "too_short", rejected.Violations[0].Code)
+
+	u := s.newActivatedUser()
+	current := testPassword
+	change := func(password string) int {
+		b, _ := json.Marshal(usermod.PasswordJSON{OldPassword: current, NewPassword: []byte(password)})
+		r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/change_password", bytes.NewReader(b))
+		r.SetBasicAuth(u.Email, string(current))
+		w, _ := http.DefaultClient.Do(r)
+		if w.StatusCode == http.StatusOK {
+			current = []byte(password)
+		}
+		return w.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusBadRequest, change(string(testPassword)))
+	assert.Equal(s.T(), http.StatusOK, change("first new passphrase"))
+	assert.Equal(s.T(), http.StatusOK, change("second new passphrase"))
+	assert.Equal(s.T(), http.StatusBadRequest, change(string(testPassword)))
+	assert.Equal(s.T(), http.StatusBadRequest, change("first new passphrase"))
+	assert.Equal(s.T(), http.StatusBadRequest, change("short"))
+
+	// a rejected reset leaves the token for another try
+	token := s.newUserOperationsToken(u)
+	reset := func(password string) int {
+		b, _ := json.Marshal(usermod.ResetPasswordJSON{Token: token.ID.String(), Password: password})
+		w, _ := http.Post(s.ts.URL+"/api/user/reset_password", "application/json", bytes.NewReader(b))
+		return w.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusBadRequest, reset("second new passphrase"))
+	assert.Equal(s.T(), http.StatusOK, reset("third new passphrase"))
+	assert.Equal(s.T(), http.StatusNotFound, reset("fourth new passphrase"))
+}
+
+func (s *UserModTestSuite) TestPasswordHistoryStores() {
+	ctx := context.Background()
+	stores := map[string]usermod.PasswordHistoryStore{
+		"sql":    s.store,
+		"memory": usermod.NewMemoryStore(),
+	}
+	for name, store := range stores {
+		s.T().Run(name, func(t *testing.T) {
+			uid := uuid.NewString()
+			hashes, err := store.GetPasswordHistory(ctx, uid, 5)
+			assert.Nil(t, err)
+			assert.Len(t, hashes, 0)
+
+			for _, h := range []string{"one", "two", "three"} {
+				assert.Nil(t, store.AddPasswordHistory(ctx, uid, []byte(h), 2))
+			}
+			hashes, err = store.GetPasswordHistory(ctx, uid, 5)
+			assert.Nil(t, err)
+			assert.Equal(t, [][]byte{[]byte("three"), []byte("two")}, hashes)
+
+			hashes, err = store.GetPasswordHistory(ctx, uid, 1)
+			assert.Nil(t, err)
+			assert.Equal(t, [][]byte{[]byte("three")}, hashes)
+		})
+	}
+}
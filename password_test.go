@@ -0,0 +1,115 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func (s *UserModTestSuite) TestPasswordHashers() {
+	argon := usermod.NewArgon2idHasher(usermod.DefaultArgon2idParams)
+	bc := usermod.NewBcryptHasher(bcrypt.MinCost)
+	tests := []struct {
+		name   string
+		hasher usermod.PasswordHasher
+		other  usermod.PasswordHasher
+		prefix string
+	}{
+		{"argon2id", argon, bc, "$argon2id$v=19$m=19456,t=2,p=1$"},
+		{"bcrypt", bc, argon, "$2a$04$"},
+	}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			hash, err := tc.hasher.Hash(testPassword)
+			assert.Nil(t, err)
+			assert.True(t, strings.HasPrefix(string(hash), tc.prefix), string(hash))
+			assert.Nil(t, tc.hasher.Verify(hash, testPassword))
+			assert.Equal(t, usermod.ErrPasswordMismatch, tc.hasher.Verify(hash, []byte("wrong")))
+			assert.False(t, tc.hasher.NeedsRehash(hash))
+
+			assert.Equal(t, usermod.ErrUnknownHash, tc.other.Verify(hash, testPassword))
+			assert.True(t, tc.other.NeedsRehash(hash))
+		})
+	}
+
+	// changed costs are rehashed
+	hash, _ := argon.Hash(testPassword)
+	params := usermod.DefaultArgon2idParams
+	params.Iterations = 3
+	assert.True(s.T(), usermod.NewArgon2idHasher(params).NeedsRehash(hash))
+	hash, _ = bc.Hash(testPassword)
+	assert.True(s.T(), usermod.NewBcryptHasher(bcrypt.DefaultCost).NeedsRehash(hash))
+
+	// stored parameters are checked before argon2 runs with them
+	salt, key := strings.Repeat("A", 22), strings.Repeat("A", 43)
+	invalid := []struct {
+		name string
+		hash string
+	}{
+		{"no memory", "$argon2id$v=19$m=0,t=2,p=1$" + salt + "$" + key},
+		{"too little memory", "$argon2id$v=19$m=15,t=2,p=2$" + salt + "$" + key},
+		{"too much memory", "$argon2id$v=19$m=4194305,t=2,p=1$" + salt + "$" + key},
+		{"no iterations", "$argon2id$v=19$m=19456,t=0,p=1$" + salt + "$" + key},
+		{"too many iterations", "$argon2id$v=19$m=19456,t=101,p=1$" + salt + "$" + key},
+		{"no parallelism", "$argon2id$v=19$m=19456,t=2,p=0$" + salt + "$" + key},
+		{"short salt", "$argon2id$v=19$m=19456,t=2,p=1$AAAA$" + key},
+		{"long salt", "$argon2id$v=19$m=19456,t=2,p=1$" + strings.Repeat("A", 88) + "$" + key},
+		{"no key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$"},
+		{"short key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$AAAA"},
+		{"long key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + strings.Repeat("A", 88)},
+	}
+	for _, tc := range invalid {
+		s.T().Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, usermod.ErrInvalidHash, argon.Verify([]byte(tc.hash), testPassword))
+			assert.True(t, argon.NeedsRehash([]byte(tc.hash)))
+		})
+	}
+	// parallelism past a byte doesn't wrap around
+	assert.Equal(s.T(), usermod.ErrUnknownHash, argon.Verify([]byte("$argon2id$v=19$m=19456,t=2,p=257$"+salt+"$"+key), testPassword))
+
+	// bcrypt would ignore the end of long passwords
+	_, err := bc.Hash(bytes.Repeat([]byte("a"), 73))
+	assert.NotNil(s.T(), err)
+	hasher := usermod.DefaultPasswordHasher
+	usermod.DefaultPasswordHasher = bc
+	defer func() { usermod.DefaultPasswordHasher = hasher }()
+	u := usermod.NewUserInStore(s.store, "Long", "long@ummmfoo.com", bytes.Repeat([]byte("a"), 73))
+	assert.NotNil(s.T(), u.Insert())
+}
+
+func (s *UserModTestSuite) TestRehashOnLogin() {
+	hasher := usermod.DefaultPasswordHasher
+	usermod.DefaultPasswordHasher = usermod.NewBcryptHasher(bcrypt.MinCost)
+	u := s.newActivatedUser()
+	usermod.DefaultPasswordHasher = hasher
+
+	stored, err := s.store.GetUserByID(context.Background(), u.ID.String())
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), strings.HasPrefix(string(stored.Password), "$2a$04$"))
+
+	// a wrong password leaves the hash alone
+	assert.Equal(s.T(), "", s.login(u, []byte("wrong")))
+	stored, _ = s.store.GetUserByID(context.Background(), u.ID.String())
+	assert.True(s.T(), strings.HasPrefix(string(stored.Password), "$2a$04$"))
+
+	assert.NotEqual(s.T(), "", s.login(u, testPassword))
+	stored, _ = s.store.GetUserByID(context.Background(), u.ID.String())
+	assert.True(s.T(), strings.HasPrefix(string(stored.Password), "$argon2id$"))
+	assert.NotEqual(s.T(), "", s.login(u, testPassword))
+
+	// basic auth upgrades hashes the same way
+	usermod.DefaultPasswordHasher = usermod.NewBcryptHasher(bcrypt.MinCost)
+	defer func() { usermod.DefaultPasswordHasher = hasher }()
+	r, _ := http.NewRequest(http.MethodGet, s.ts.URL+"/auth", nil)
+	r.SetBasicAuth(u.Email, string(testPassword))
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	stored, _ = s.store.GetUserByID(context.Background(), u.ID.String())
+	assert.True(s.T(), strings.HasPrefix(string(stored.Password), "$2a$04$"))
+}
@@ -0,0 +1,154 @@
+package usermod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrRateLimited = errors.New("too many requests")
+
+// RateLimit allows Limit requests within any Window. A zero Limit allows
+// every request.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimitStore counts requests in a sliding window. Allow records the
+// request unless the key already made limit.Limit within the window, in
+// which case it returns how long until the oldest of them leaves it.
+type RateLimitStore interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+// RateLimitKey picks what a request is counted against. An empty key
+// isn't counted.
+type RateLimitKey func(r *http.Request) (string, error)
+
+// RateLimitByIP counts requests against the client's address
+func RateLimitByIP(r *http.Request) (string, error) {
+	return "ip:" + clientIP(r), nil
+}
+
+// RateLimitMaxBody caps the body RateLimitByEmail reads, before the request
+// is counted
+var RateLimitMaxBody int64 = 64 << 10
+
+// RateLimitByEmail counts requests against the email they target, given
+// either as the email query parameter or the email field of a JSON body.
+// The body is left for the handler to read, and refused when it is larger
+// than RateLimitMaxBody.
+func RateLimitByEmail(r *http.Request) (string, error) {
+	email := r.URL.Query().Get("email")
+	if email == "" && r.Body != nil {
+		b, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, RateLimitMaxBody))
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		body := struct {
+			Email string `json:"email"`
+		}{}
+		// malformed bodies are left for the handler to refuse
+		_ = json.Unmarshal(b, &body)
+		email = body.Email
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", nil
+	}
+	return "email:" + email, nil
+}
+
+// Throttle refuses requests with 429 and a Retry-After header once their
+// key exceeds the limit. name keeps the counts of different routes apart.
+func Throttle(store RateLimitStore, name string, limit RateLimit, key RateLimitKey) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit.Limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k, err := key(r)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				jsonError(w, err, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				jsonError(w, err, http.StatusBadRequest)
+				return
+			}
+			if k == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ok, retry, err := store.Allow(r.Context(), name+":"+k, limit)
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				setRetryAfter(w, retry)
+				jsonError(w, ErrRateLimited, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimits throttles the router's unauthenticated routes that create
+// users, send them messages, check their recovery codes or issue passkey
+// challenges, both per client address and per target email. Activation is only limited per address,
+// as its token names no email.
+type RateLimits struct {
+	Store                 RateLimitStore
+	CreateUserByIP        RateLimit
+	CreateUserByEmail     RateLimit
+	ForgotPasswordByIP    RateLimit
+	ForgotPasswordByEmail RateLimit
+	MagicLinkByIP         RateLimit
+	MagicLinkByEmail      RateLimit
+	ActivateByIP          RateLimit
+	RecoverByIP           RateLimit
+	RecoverByEmail        RateLimit
+	WebAuthnLoginByIP     RateLimit
+	WebAuthnLoginByEmail  RateLimit
+}
+
+// NewRateLimits allows each address 20 requests an hour to each route, and
+// 60 activations or passkey logins, and each email 5 requests an hour, or
+// 10 recoveries since the lockout already stops an account's wrong codes
+// at 5, and 20 passkey logins
+func NewRateLimits(store RateLimitStore) *RateLimits {
+	perIP := RateLimit{Limit: 20, Window: time.Hour}
+	perEmail := RateLimit{Limit: 5, Window: time.Hour}
+	return &RateLimits{
+		Store:                 store,
+		CreateUserByIP:        perIP,
+		CreateUserByEmail:     perEmail,
+		ForgotPasswordByIP:    perIP,
+		ForgotPasswordByEmail: perEmail,
+		MagicLinkByIP:         perIP,
+		MagicLinkByEmail:      perEmail,
+		ActivateByIP:          RateLimit{Limit: 60, Window: time.Hour},
+		RecoverByIP:           perIP,
+		RecoverByEmail:        RateLimit{Limit: 10, Window: time.Hour},
+		WebAuthnLoginByIP:     RateLimit{Limit: 60, Window: time.Hour},
+		WebAuthnLoginByEmail:  RateLimit{Limit: 20, Window: time.Hour},
+	}
+}
+
+// throttle applies the per address and per email limits of a route
+func (l *RateLimits) throttle(name string, byIP, byEmail RateLimit) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		next = Throttle(l.Store, name, byEmail, RateLimitByEmail)(next)
+		return Throttle(l.Store, name, byIP, RateLimitByIP)(next)
+	}
+}
@@ -0,0 +1,76 @@
+package usermod
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryRateLimitStore keeps request times in process memory, which suits
+// tests and single instance deployments. Every SweepInterval, Allow forgets
+// the keys whose requests have all left their window.
+type MemoryRateLimitStore struct {
+	SweepInterval time.Duration
+
+	mu        sync.Mutex
+	requests  map[string]*memoryRateLimitLog
+	lastSweep time.Time
+}
+
+// memoryRateLimitLog remembers the window a key was last counted in, so
+// that sweeps know when its requests expire
+type memoryRateLimitLog struct {
+	times  []time.Time
+	window time.Duration
+}
+
+// forget drops the requests that left the window, oldest first
+func (l *memoryRateLimitLog) forget(now time.Time) {
+	for len(l.times) > 0 && !l.times[0].After(now.Add(-l.window)) {
+		l.times = l.times[1:]
+	}
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{SweepInterval: time.Minute, requests: map[string]*memoryRateLimitLog{}}
+}
+
+func (s *MemoryRateLimitStore) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= s.SweepInterval {
+		s.sweep(now)
+	}
+
+	l, ok := s.requests[key]
+	if !ok {
+		l = &memoryRateLimitLog{}
+		s.requests[key] = l
+	}
+	l.window = limit.Window
+	l.forget(now)
+	if len(l.times) >= limit.Limit {
+		return false, l.times[0].Add(limit.Window).Sub(now), nil
+	}
+	l.times = append(l.times, now)
+	return true, 0, nil
+}
+
+// Len returns the number of keys remembered, including those whose requests
+// left their window since the last sweep
+func (s *MemoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, l := range s.requests {
+		l.forget(now)
+		if len(l.times) == 0 {
+			delete(s.requests, key)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,59 @@
+package usermod
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisRateLimitStore keeps request times in redis sorted sets, shared by
+// every instance of the application.
+type RedisRateLimitStore struct {
+	client *redis.Client
+}
+
+var redisRateLimitPrefix = "usermod:rate_limit:"
+
+// allowScript trims the requests that left the window, and records this
+// one if there is room. It returns the milliseconds to wait, or 0 when the
+// request is allowed.
+var allowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	return 0
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return math.max(tonumber(oldest[2]) + window - now, 1)
+`)
+
+// NewRedisRateLimitStore connects to the redis server at url. An empty url
+// falls back to CACHE_URL.
+func NewRedisRateLimitStore(url string) (*RedisRateLimitStore, error) {
+	if url == "" {
+		url = CacheURL()
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisRateLimitStoreWithClient(redis.NewClient(opts)), nil
+}
+
+func NewRedisRateLimitStoreWithClient(client *redis.Client) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client}
+}
+
+func (s *RedisRateLimitStore) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	wait, err := allowScript.Run(ctx, s.client, []string{redisRateLimitPrefix + key},
+		time.Now().UnixMilli(), limit.Window.Milliseconds(), limit.Limit, uuid.NewString()).Int64()
+	if err != nil {
+		return false, 0, err
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
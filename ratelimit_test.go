@@ -0,0 +1,138 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chayim/usermod"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) TestRateLimits() {
+	limits := &usermod.RateLimits{
+		Store:                 usermod.NewMemoryRateLimitStore(),
+		CreateUserByEmail:     usermod.RateLimit{Limit: 1, Window: time.Hour},
+		ForgotPasswordByIP:    usermod.RateLimit{Limit: 4, Window: time.Hour},
+		ForgotPasswordByEmail: usermod.RateLimit{Limit: 2, Window: time.Hour},
+		RecoverByEmail:        usermod.RateLimit{Limit: 1, Window: time.Hour},
+		WebAuthnLoginByEmail:  usermod.RateLimit{Limit: 1, Window: time.Hour},
+	}
+	ts := httptest.NewServer(usermod.NewRouter(s.store, usermod.WithRateLimits(limits), usermod.WithTokenConfig(s.tokens),
+		usermod.WithWebAuthn(testWebAuthn)))
+	defer ts.Close()
+
+	forgot := func(email string) *http.Response {
+		w, _ := http.Post(ts.URL+"/user/forgot_password?email="+email, "", nil)
+		return w
+	}
+	u := s.newActivatedUser()
+	assert.Equal(s.T(), http.StatusOK, forgot(u.Email).StatusCode)
+	assert.Equal(s.T(), http.StatusOK, forgot(u.Email).StatusCode)
+	w := forgot(u.Email)
+	assert.Equal(s.T(), http.StatusTooManyRequests, w.StatusCode)
+	assert.Equal(s.T(), "3600", w.Header.Get("Retry-After"))
+
+	// emails are counted apart, but share the address's limit, which counts
+	// every request
+	assert.Equal(s.T(), http.StatusNotFound, forgot("nobody@ummmfoo.com").StatusCode)
+	assert.Equal(s.T(), http.StatusTooManyRequests, forgot("someone@ummmfoo.com").StatusCode)
+
+	// the body is still read by the handler
+	create := func(email string) int {
+		b, _ := json.Marshal(map[string]string{"name": "Rate", "email": email, "password": "correct horse battery"})
+		w, _ := http.Post(ts.URL+"/user", "application/json", bytes.NewReader(b))
+		return w.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusCreated, create("rate@ummmfoo.com"))
+	assert.Equal(s.T(), http.StatusTooManyRequests, create("RATE@ummmfoo.com"))
+
+	// recovery codes are hashed, so guessing them is limited too
+	recover := func() int {
+		b, _ := json.Marshal(usermod.RecoverJSON{Email: "rate@ummmfoo.com", Code: "aaaaa-aaaaa", Password: "a new passphrase"})
+		w, _ := http.Post(ts.URL+"/user/recover", "application/json", bytes.NewReader(b))
+		return w.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusUnauthorized, recover())
+	assert.Equal(s.T(), http.StatusTooManyRequests, recover())
+
+	// as does issuing passkey challenges, which are stored
+	passkey := func() int {
+		b, _ := json.Marshal(usermod.WebAuthnLoginJSON{Email: "rate@ummmfoo.com"})
+		w, _ := http.Post(ts.URL+"/webauthn/login/begin", "application/json", bytes.NewReader(b))
+		return w.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusOK, passkey())
+	assert.Equal(s.T(), http.StatusTooManyRequests, passkey())
+
+	// but not without limit
+	huge := bytes.Repeat([]byte(" "), int(usermod.RateLimitMaxBody)+1)
+	w, _ = http.Post(ts.URL+"/user", "application/json", bytes.NewReader(huge))
+	assert.Equal(s.T(), http.StatusRequestEntityTooLarge, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestMemoryRateLimitStoreForgets() {
+	ctx := context.Background()
+	store := usermod.NewMemoryRateLimitStore()
+	store.SweepInterval = 10 * time.Millisecond
+	limit := usermod.RateLimit{Limit: 1, Window: 10 * time.Millisecond}
+	for _, key := range []string{"a", "b", "c"} {
+		ok, _, err := store.Allow(ctx, key, limit)
+		assert.Nil(s.T(), err)
+		assert.True(s.T(), ok)
+	}
+	assert.Equal(s.T(), 3, store.Len())
+
+	// a sweep drops every key whose requests left the window
+	time.Sleep(20 * time.Millisecond)
+	ok, _, err := store.Allow(ctx, "d", usermod.RateLimit{Limit: 1, Window: time.Hour})
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), 1, store.Len())
+}
+
+func (s *UserModTestSuite) TestRateLimitStores() {
+	ctx := context.Background()
+	mr := miniredis.RunT(s.T())
+	stores := map[string]usermod.RateLimitStore{
+		"redis":  usermod.NewRedisRateLimitStoreWithClient(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		"memory": usermod.NewMemoryRateLimitStore(),
+	}
+	for name, store := range stores {
+		s.T().Run(name, func(t *testing.T) {
+			limit := usermod.RateLimit{Limit: 2, Window: time.Minute}
+			for i := 0; i < 2; i++ {
+				ok, _, err := store.Allow(ctx, "key", limit)
+				assert.Nil(t, err)
+				assert.True(t, ok)
+			}
+			ok, retry, err := store.Allow(ctx, "key", limit)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			assert.InDelta(t, time.Minute, retry, float64(time.Second))
+
+			ok, _, err = store.Allow(ctx, "other", limit)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+
+			// requests are forgotten once they leave the window
+			limit = usermod.RateLimit{Limit: 1, Window: 10 * time.Millisecond}
+			ok, _, err = store.Allow(ctx, "short", limit)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			ok, _, err = store.Allow(ctx, "short", limit)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			time.Sleep(20 * time.Millisecond)
+			ok, _, err = store.Allow(ctx, "short", limit)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
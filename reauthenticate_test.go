@@ -0,0 +1,132 @@
+package usermod_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+// loginSession logs in, returning the tokens and the session cookie
+func (s *UserModTestSuite) loginSession(u *usermod.User, password []byte) (usermod.TokenJSON, *http.Cookie) {
+	b, _ := json.Marshal(usermod.LoginJSON{Email: u.Email, Password: string(password)})
+	w, _ := http.Post(s.ts.URL+"/api/login", "application/json", bytes.NewReader(b))
+	tok := usermod.TokenJSON{}
+	json.NewDecoder(w.Body).Decode(&tok)
+	return tok, sessionCookie(w)
+}
+
+// sessionCookie returns the last session cookie set, which replaces any
+// before it
+func sessionCookie(w *http.Response) *http.Cookie {
+	var found *http.Cookie
+	for _, c := range w.Cookies() {
+		if c.Name == usermod.SessionCookieName {
+			found = c
+		}
+	}
+	return found
+}
+
+// authedRequest sends body as the holder of a bearer token or a session
+// cookie
+func (s *UserModTestSuite) authedRequest(method, path, bearer string, cookie *http.Cookie, body any) *http.Response {
+	b, _ := json.Marshal(body)
+	r, _ := http.NewRequest(method, s.ts.URL+"/api"+path, bytes.NewReader(b))
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w, _ := http.DefaultClient.Do(r)
+	return w
+}
+
+func (s *UserModTestSuite) TestRecentAuthentication() {
+	u := s.newActivatedUser()
+	tok, cookie := s.loginSession(u, testPassword)
+	changeEmail := func(bearer string, cookie *http.Cookie, email string) int {
+		return s.authedRequest(http.MethodPatch, "/user", bearer, cookie, usermod.UpdateJSON{Email: email}).StatusCode
+	}
+
+	// freshly issued tokens and sessions may make sensitive changes
+	assert.Equal(s.T(), http.StatusOK, changeEmail(tok.Token, nil, "stepped-up@ummmfoo.com"))
+	u.Email = "stepped-up@ummmfoo.com"
+
+	// refreshed tokens don't know when the user logged in
+	b, _ := json.Marshal(usermod.RefreshJSON{RefreshToken: tok.RefreshToken})
+	w, _ := http.Post(s.ts.URL+"/api/token/refresh", "application/json", bytes.NewReader(b))
+	refreshed := usermod.TokenJSON{}
+	json.NewDecoder(w.Body).Decode(&refreshed)
+	assert.Equal(s.T(), http.StatusUnauthorized, changeEmail(refreshed.Token, nil, "refreshed@ummmfoo.com"))
+	// other changes need no step up
+	w = s.authedRequest(http.MethodPatch, "/user", refreshed.Token, nil, usermod.UpdateJSON{Name: "Refreshed"})
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	w = s.authedRequest(http.MethodDelete, "/user", refreshed.Token, nil, nil)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+	// nor can it add a way to sign in
+	for _, path := range []string{"/user/api_keys", "/user/recovery_codes", "/user/totp/enroll",
+		"/webauthn/register/begin", "/webauthn/register/finish"} {
+		w = s.authedRequest(http.MethodPost, path, refreshed.Token, nil, nil)
+		assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode, path)
+	}
+
+	w = s.authedRequest(http.MethodPost, "/user/reauthenticate", refreshed.Token, nil, usermod.ReauthenticateJSON{Password: "notthepassword"})
+	assert.Equal(s.T(), http.StatusForbidden, w.StatusCode)
+	w = s.authedRequest(http.MethodPost, "/user/reauthenticate", refreshed.Token, nil, usermod.ReauthenticateJSON{Password: string(testPassword)})
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	stepped := usermod.TokenJSON{}
+	json.NewDecoder(w.Body).Decode(&stepped)
+	assert.Equal(s.T(), http.StatusOK, changeEmail(stepped.Token, nil, "refreshed@ummmfoo.com"))
+	u.Email = "refreshed@ummmfoo.com"
+
+	// sessions age like tokens, and are replaced on reauthentication
+	maxAge := usermod.RecentAuthMaxAge
+	usermod.RecentAuthMaxAge = -time.Second
+	assert.Equal(s.T(), http.StatusUnauthorized, changeEmail("", cookie, "session@ummmfoo.com"))
+	usermod.RecentAuthMaxAge = maxAge
+	w = s.authedRequest(http.MethodPost, "/user/reauthenticate", "", cookie, usermod.ReauthenticateJSON{Password: string(testPassword)})
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	replaced := sessionCookie(w)
+	assert.NotNil(s.T(), replaced)
+	assert.NotEqual(s.T(), cookie.Value, replaced.Value)
+	assert.Equal(s.T(), http.StatusUnauthorized, changeEmail("", cookie, "session@ummmfoo.com"))
+	assert.Equal(s.T(), http.StatusOK, changeEmail("", replaced, "session@ummmfoo.com"))
+
+	w = s.authedRequest(http.MethodDelete, "/user", "", replaced, nil)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestChangePasswordSignsOutElsewhere() {
+	u := s.newActivatedUser()
+	mine, cookie := s.loginSession(u, testPassword)
+	other, otherCookie := s.loginSession(u, testPassword)
+
+	change := usermod.PasswordJSON{OldPassword: testPassword, NewPassword: []byte("a brand new passphrase")}
+	w := s.authedRequest(http.MethodPost, "/change_password", "", cookie, change)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	renewed := sessionCookie(w)
+	assert.NotNil(s.T(), renewed)
+	tok := usermod.TokenJSON{}
+	json.NewDecoder(w.Body).Decode(&tok)
+
+	// the caller carries on with the session and tokens they were given
+	assert.Equal(s.T(), http.StatusOK, s.authedRequest(http.MethodGet, "/user", "", renewed, nil).StatusCode)
+	assert.Equal(s.T(), http.StatusOK, s.authedRequest(http.MethodGet, "/user", tok.Token, nil, nil).StatusCode)
+
+	for _, c := range []*http.Cookie{cookie, otherCookie} {
+		assert.Equal(s.T(), http.StatusUnauthorized, s.authedRequest(http.MethodGet, "/user", "", c, nil).StatusCode)
+	}
+	for _, t := range []string{mine.Token, other.Token} {
+		assert.Equal(s.T(), http.StatusUnauthorized, s.authedRequest(http.MethodGet, "/user", t, nil, nil).StatusCode)
+	}
+	for _, rt := range []string{mine.RefreshToken, other.RefreshToken} {
+		b, _ := json.Marshal(usermod.RefreshJSON{RefreshToken: rt})
+		w, _ := http.Post(s.ts.URL+"/api/token/refresh", "application/json", bytes.NewReader(b))
+		assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+	}
+}
@@ -0,0 +1,184 @@
+package usermod
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var ErrRecoveryCodeInvalid = errors.New("invalid recovery code")
+
+// RecoveryCodeCount is the number of codes issued at a time
+var RecoveryCodeCount = 10
+
+var recoveryCodeTblName = "user_recovery_codes"
+
+// RecoveryCode is a single use code, hashed with DefaultPasswordHasher like
+// a password
+type RecoveryCode struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+	Hash   []byte
+}
+
+// RecoveryCodeStore persists recovery codes. Replacing a user's codes
+// discards any that remain.
+type RecoveryCodeStore interface {
+	ReplaceRecoveryCodes(ctx context.Context, uid string, hashes [][]byte) error
+	GetRecoveryCodes(ctx context.Context, uid string) ([]*RecoveryCode, error)
+	DeleteRecoveryCode(ctx context.Context, id string) error
+	CountRecoveryCodes(ctx context.Context, uid string) (int, error)
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCode returns ten random base32 characters, grouped for reading
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+	return code[:5] + "-" + code[5:10], nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes, returning the
+// new codes in plain text. They can't be recovered from the store later.
+func GenerateRecoveryCodes(ctx context.Context, store RecoveryCodeStore, uid string) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := EncryptPassword([]byte(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes[i], hashes[i] = code, hash
+	}
+	return codes, store.ReplaceRecoveryCodes(ctx, uid, hashes)
+}
+
+// UseRecoveryCode checks the code against the user's remaining codes, and
+// deletes it if it matches.
+func UseRecoveryCode(ctx context.Context, store RecoveryCodeStore, uid, code string) error {
+	rc, err := findRecoveryCode(ctx, store, uid, code)
+	if err != nil {
+		return err
+	}
+	// losing a race for the same code fails like any other invalid code
+	return store.DeleteRecoveryCode(ctx, rc.ID.String())
+}
+
+// findRecoveryCode returns the user's remaining code matching code, without
+// using it up
+func findRecoveryCode(ctx context.Context, store RecoveryCodeStore, uid, code string) (*RecoveryCode, error) {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return nil, ErrRecoveryCodeInvalid
+	}
+	stored, err := store.GetRecoveryCodes(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	rc := matchRecoveryCode(stored, code)
+	if rc == nil {
+		return nil, ErrRecoveryCodeInvalid
+	}
+	return rc, nil
+}
+
+// matchRecoveryCode compares the normalized code with every stored code,
+// and a dummy for each one short of a full set, so that the time taken
+// reveals neither how many codes are left nor whether the user exists.
+func matchRecoveryCode(stored []*RecoveryCode, code string) *RecoveryCode {
+	var found *RecoveryCode
+	for i := 0; i < max(len(stored), RecoveryCodeCount); i++ {
+		if i >= len(stored) {
+			verifyPassword(dummyPasswordHash(), []byte(code))
+			continue
+		}
+		if _, err := verifyPassword(stored[i].Hash, []byte(code)); err == nil && found == nil {
+			found = stored[i]
+		}
+	}
+	return found
+}
+
+func (s *SQLStore) ReplaceRecoveryCodes(ctx context.Context, uid string, hashes [][]byte) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1", recoveryCodeTblName)
+	if _, err = tx.ExecContext(ctx, s.dialect.Rebind(query), uid); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("INSERT INTO %s (id, user_id, code_hash) VALUES ($1, $2, $3)", recoveryCodeTblName)
+	for _, hash := range hashes {
+		if _, err = tx.ExecContext(ctx, s.dialect.Rebind(query), uuid.New().String(), uid, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetRecoveryCodes(ctx context.Context, uid string) ([]*RecoveryCode, error) {
+	query := fmt.Sprintf("SELECT id, user_id, code_hash FROM %s WHERE user_id = $1", recoveryCodeTblName)
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []*RecoveryCode{}
+	for rows.Next() {
+		rc := RecoveryCode{}
+		if err = rows.Scan(&rc.ID, &rc.UserID, &rc.Hash); err != nil {
+			return nil, err
+		}
+		codes = append(codes, &rc)
+	}
+	return codes, rows.Err()
+}
+
+// DeleteRecoveryCode fails with ErrRecoveryCodeInvalid if the code was
+// already used, so that each code is only accepted once.
+func (s *SQLStore) DeleteRecoveryCode(ctx context.Context, id string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", recoveryCodeTblName)
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecoveryCodeInvalid
+	}
+	return nil
+}
+
+func (s *SQLStore) CountRecoveryCodes(ctx context.Context, uid string) (int, error) {
+	var count int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id = $1", recoveryCodeTblName)
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), uid).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,109 @@
+package usermod
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+type RecoveryCodesJSON struct {
+	Codes []string `json:"codes"`
+}
+
+type RecoverJSON struct {
+	Email    string `json:"email"`
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+// GenerateRecoveryCodes issues a fresh set of recovery codes, replacing any
+// the user had left. The codes are only ever shown in this response.
+func (rr *Router) GenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+
+	codes, err := GenerateRecoveryCodes(r.Context(), rr.store, u.ID.String())
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, RecoveryCodesJSON{Codes: codes})
+}
+
+// Recover sets a new password for a user who can't receive a reset email,
+// given one of their recovery codes. Like ResetPassword, it logs the user
+// out everywhere.
+func (rr *Router) Recover(w http.ResponseWriter, r *http.Request) {
+	rj := RecoverJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &rj)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	if rj.Email == "" || rj.Code == "" || rj.Password == "" {
+		jsonErrorFromString(w, "email, code and password must be specified", http.StatusBadRequest)
+		return
+	}
+
+	// unknown users fail like bad codes, after as long, so that emails
+	// can't be probed
+	u, err := rr.store.GetActiveUserByEmail(r.Context(), rj.Email)
+	if err != nil || !u.IsActive() {
+		u = nil
+	}
+	var rc *RecoveryCode
+	err = rr.lockout.Guard(r.Context(), u, clientIP(r), func() error {
+		if u == nil {
+			matchRecoveryCode(nil, normalizeRecoveryCode(rj.Code))
+			return ErrRecoveryCodeInvalid
+		}
+		var err error
+		rc, err = findRecoveryCode(r.Context(), rr.store, u.ID.String(), rj.Code)
+		return err
+	})
+	var locked *LockoutError
+	if errors.As(err, &locked) {
+		writeLockoutError(w, locked)
+		return
+	}
+	if err == ErrRecoveryCodeInvalid {
+		jsonError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// only the holder of a code learns how the password breaks the policy,
+	// and the code is used up once it doesn't
+	if !rr.checkPassword(w, r, u, []byte(rj.Password)) {
+		return
+	}
+	err = rr.store.DeleteRecoveryCode(r.Context(), rc.ID.String())
+	if err == ErrRecoveryCodeInvalid {
+		jsonError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = rr.setPassword(r.Context(), u, []byte(rj.Password))
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = rr.signOutEverywhere(r.Context(), u.ID)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,191 @@
+package usermod
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefreshToken is a long lived, single use token that can be exchanged for a
+// new access token. Every exchange rotates the refresh token, and all tokens
+// descending from the same login share a FamilyID so that replaying an already
+// rotated token revokes the whole family.
+type RefreshToken struct {
+	ID       uuid.UUID `json:"id"`
+	UserID   uuid.UUID `json:"-"`
+	FamilyID uuid.UUID `json:"-"`
+	Expiry   int64     `json:"-"`
+	Used     bool      `json:"-"`
+	Revoked  bool      `json:"-"`
+	store    RefreshTokenStore
+}
+
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+var ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+
+var RefreshTokenDefaultExpiry = time.Hour * 24 * 30 // default expire 30 days
+var refreshTokenTblName = "refresh_tokens"
+
+var refreshTokenColumns = "id, user_id, family_id, expiry, used, revoked"
+
+// NewRefreshToken creates a refresh token starting a new family, used when a
+// user logs in.
+func NewRefreshToken(db *sql.DB, user uuid.UUID) *RefreshToken {
+	return NewRefreshTokenInStore(NewSQLStore(db), user, uuid.New())
+}
+
+func NewRefreshTokenInFamily(db *sql.DB, user, family uuid.UUID) *RefreshToken {
+	return NewRefreshTokenInStore(NewSQLStore(db), user, family)
+}
+
+// NewRefreshTokenInStore creates a refresh token, not yet inserted, backed by
+// any RefreshTokenStore
+func NewRefreshTokenInStore(store RefreshTokenStore, user, family uuid.UUID) *RefreshToken {
+	return &RefreshToken{
+		ID:       uuid.New(),
+		UserID:   user,
+		FamilyID: family,
+		Expiry:   time.Now().Add(RefreshTokenDefaultExpiry).Unix(),
+		store:    store,
+	}
+}
+
+func (t *RefreshToken) TableName() string {
+	return refreshTokenTblName
+}
+
+func (t *RefreshToken) scanInto(row *sql.Row) error {
+	return row.Scan(&t.ID, &t.UserID, &t.FamilyID, &t.Expiry, &t.Used, &t.Revoked)
+}
+
+func (t *RefreshToken) Insert() error {
+	return t.store.InsertRefreshToken(context.Background(), t)
+}
+
+func GetRefreshToken(db *sql.DB, token string) (*RefreshToken, error) {
+	return NewSQLStore(db).GetRefreshToken(context.Background(), token)
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descending from the
+// same login.
+func RevokeRefreshTokenFamily(db *sql.DB, family string) error {
+	return NewSQLStore(db).RevokeRefreshTokenFamily(context.Background(), family)
+}
+
+// RevokeUserRefreshTokens revokes every refresh token issued to the user,
+// logging them out of all devices.
+func RevokeUserRefreshTokens(db *sql.DB, uid string) error {
+	return NewSQLStore(db).RevokeUserRefreshTokens(context.Background(), uid)
+}
+
+// RotateRefreshToken consumes a refresh token and returns its user along
+// with the replacement token. Presenting a token that was already rotated is
+// treated as theft, and revokes the entire family.
+func RotateRefreshToken(db *sql.DB, token string) (*User, *RefreshToken, error) {
+	return rotateRefreshToken(context.Background(), NewSQLStore(db), token)
+}
+
+func rotateRefreshToken(ctx context.Context, store Store, token string) (*User, *RefreshToken, error) {
+	t, err := store.GetRefreshToken(ctx, token)
+	if err != nil {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+	if t.Revoked || t.Expiry < time.Now().Unix() {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+
+	if t.Used {
+		err = ErrRefreshTokenReused
+	} else {
+		err = store.MarkRefreshTokenAsUsed(ctx, t.ID.String())
+	}
+	if err == ErrRefreshTokenReused {
+		if rerr := store.RevokeRefreshTokenFamily(ctx, t.FamilyID.String()); rerr != nil {
+			return nil, nil, rerr
+		}
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u, err := store.GetUserByID(ctx, t.UserID.String())
+	if err != nil || !u.IsActive() {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+
+	next := NewRefreshTokenInStore(store, t.UserID, t.FamilyID)
+	if err = next.Insert(); err != nil {
+		return nil, nil, err
+	}
+	return u, next, nil
+}
+
+func (s *SQLStore) InsertRefreshToken(ctx context.Context, t *RefreshToken) error {
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", refreshTokenTblName, refreshTokenColumns, placeholders(6))
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, t.ID.String(), t.UserID.String(), t.FamilyID.String(), t.Expiry, t.Used, t.Revoked)
+	return err
+}
+
+func (s *SQLStore) GetRefreshToken(ctx context.Context, token string) (*RefreshToken, error) {
+	t := RefreshToken{store: s}
+	query := fmt.Sprintf("SELECT %s from %s WHERE id = $1", refreshTokenColumns, refreshTokenTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return &t, err
+	}
+	res := stmt.QueryRowContext(ctx, token)
+	if res.Err() != nil {
+		return &t, res.Err()
+	}
+	return &t, t.scanInto(res)
+}
+
+// MarkRefreshTokenAsUsed flags the token as used, returning
+// ErrRefreshTokenReused if it had already been used by a concurrent or
+// earlier request.
+func (s *SQLStore) MarkRefreshTokenAsUsed(ctx context.Context, id string) error {
+	query := fmt.Sprintf("UPDATE %s SET used = $1 WHERE id = $2 AND used = $3", refreshTokenTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return err
+	}
+	res, err := stmt.ExecContext(ctx, true, id, false)
+	if err != nil {
+		return err
+	}
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
+func (s *SQLStore) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	query := fmt.Sprintf("UPDATE %s SET revoked = $1 WHERE family_id = $2", refreshTokenTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, true, family)
+	return err
+}
+
+func (s *SQLStore) RevokeUserRefreshTokens(ctx context.Context, uid string) error {
+	query := fmt.Sprintf("UPDATE %s SET revoked = $1 WHERE user_id = $2", refreshTokenTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, true, uid)
+	return err
+}
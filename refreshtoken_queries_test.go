@@ -0,0 +1,62 @@
+package usermod_test
+
+import (
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) newRefreshToken(user *usermod.User) *usermod.RefreshToken {
+	t := usermod.NewRefreshToken(s.db, user.ID)
+	err := t.Insert()
+	assert.Nil(s.T(), err)
+	return t
+}
+
+func (s *UserModTestSuite) TestRefreshTokenCreateGet() {
+	user := s.newActivatedUser()
+	t := s.newRefreshToken(user)
+
+	res, err := usermod.GetRefreshToken(s.db, t.ID.String())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), t.ID, res.ID)
+	assert.Equal(s.T(), t.FamilyID, res.FamilyID)
+	assert.False(s.T(), res.Used)
+	assert.False(s.T(), res.Revoked)
+}
+
+func (s *UserModTestSuite) TestRefreshTokenRotate() {
+	user := s.newActivatedUser()
+	t := s.newRefreshToken(user)
+
+	u, next, err := usermod.RotateRefreshToken(s.db, t.ID.String())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.ID, u.ID)
+	assert.NotEqual(s.T(), t.ID, next.ID)
+	assert.Equal(s.T(), t.FamilyID, next.FamilyID)
+
+	old, _ := usermod.GetRefreshToken(s.db, t.ID.String())
+	assert.True(s.T(), old.Used)
+
+	_, _, err = usermod.RotateRefreshToken(s.db, "not-a-token")
+	assert.Equal(s.T(), usermod.ErrRefreshTokenInvalid, err)
+}
+
+func (s *UserModTestSuite) TestRefreshTokenReuseRevokesFamily() {
+	user := s.newActivatedUser()
+	t := s.newRefreshToken(user)
+	other := s.newRefreshToken(user)
+
+	_, next, err := usermod.RotateRefreshToken(s.db, t.ID.String())
+	assert.Nil(s.T(), err)
+
+	_, _, err = usermod.RotateRefreshToken(s.db, t.ID.String())
+	assert.Equal(s.T(), usermod.ErrRefreshTokenReused, err)
+
+	// the legitimate successor is now unusable too
+	_, _, err = usermod.RotateRefreshToken(s.db, next.ID.String())
+	assert.Equal(s.T(), usermod.ErrRefreshTokenInvalid, err)
+
+	// other logins are unaffected
+	_, _, err = usermod.RotateRefreshToken(s.db, other.ID.String())
+	assert.Nil(s.T(), err)
+}
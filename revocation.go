@@ -0,0 +1,103 @@
+package usermod
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RevocationStore records access tokens that are refused before they
+// expire, either individually by their jti, or all of a user's tokens
+// issued before a watermark.
+type RevocationStore interface {
+	// Revoke refuses the token with the jti until it expires
+	Revoke(ctx context.Context, jti string, expires time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+	// RevokeUser refuses the user's tokens issued before the watermark.
+	// It is forgotten at expires, once those tokens have expired anyway.
+	RevokeUser(ctx context.Context, uid string, before, expires time.Time) error
+	// RevokedBefore returns the user's watermark, or the zero time
+	RevokedBefore(ctx context.Context, uid string) (time.Time, error)
+}
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+// newTokenID returns a jti. Version 7 uuids carry their creation time,
+// finer than iat, so that a login moments after a watermark isn't refused
+// along with the tokens before it.
+func newTokenID() (string, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// v7Time is when a version 7 uuid was made. Ids made within a millisecond
+// are ordered by their 12 bit sequence, which is spread across the
+// millisecond so that a later id always has a later time.
+func v7Time(id uuid.UUID) time.Time {
+	var ms int64
+	for _, b := range id[:6] {
+		ms = ms<<8 | int64(b)
+	}
+	seq := int64(id[6]&0x0f)<<8 | int64(id[7])
+	return time.UnixMilli(ms).Add(time.Duration(seq * int64(time.Millisecond) >> 12))
+}
+
+// issued is when the token was created, from its jti when it has one
+func (c *Claims) issued() time.Time {
+	if id, err := uuid.Parse(c.Id); err == nil && id.Version() == 7 {
+		return v7Time(id)
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
+// ValidateToken parses the token and refuses it if it was revoked
+func (c *TokenConfig) ValidateToken(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := c.ParseToken(tokenString)
+	if err != nil || c.Revocations == nil {
+		return claims, err
+	}
+	if claims.Id != "" {
+		revoked, err := c.Revocations.IsRevoked(ctx, claims.Id)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	before, err := c.Revocations.RevokedBefore(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !before.IsZero() && !claims.issued().After(before) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// RevokeToken refuses a single token, such as on logout
+func (c *TokenConfig) RevokeToken(ctx context.Context, claims *Claims) error {
+	if c.Revocations == nil || claims.Id == "" {
+		return nil
+	}
+	return c.Revocations.Revoke(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0))
+}
+
+// RevokeUserTokens refuses every token issued to the user until now. The
+// watermark is drawn from the same clock as jtis, so tokens issued once it
+// returns are accepted, even within the same millisecond.
+func (c *TokenConfig) RevokeUserTokens(ctx context.Context, uid string) error {
+	if c.Revocations == nil {
+		return nil
+	}
+	id, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+	return c.Revocations.RevokeUser(ctx, uid, v7Time(id), time.Now().Add(c.expiry()))
+}
@@ -0,0 +1,77 @@
+package usermod
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type watermark struct {
+	before  time.Time
+	expires time.Time
+}
+
+// MemoryRevocationStore keeps revocations in process memory, which suits
+// tests and single instance deployments.
+type MemoryRevocationStore struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+	users  map[string]watermark
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{tokens: map[string]time.Time{}, users: map[string]watermark{}}
+}
+
+// prune forgets expired revocations, and must be called with mu held
+func (s *MemoryRevocationStore) prune(now time.Time) {
+	for jti, expires := range s.tokens {
+		if !expires.After(now) {
+			delete(s.tokens, jti)
+		}
+	}
+	for uid, wm := range s.users {
+		if !wm.expires.After(now) {
+			delete(s.users, uid)
+		}
+	}
+}
+
+func (s *MemoryRevocationStore) Revoke(ctx context.Context, jti string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	s.tokens[jti] = expires
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.tokens[jti]
+	return ok && expires.After(time.Now()), nil
+}
+
+func (s *MemoryRevocationStore) RevokeUser(ctx context.Context, uid string, before, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	if wm, ok := s.users[uid]; ok && wm.before.After(before) {
+		if expires.After(wm.expires) {
+			s.users[uid] = watermark{before: wm.before, expires: expires}
+		}
+		return nil
+	}
+	s.users[uid] = watermark{before: before, expires: expires}
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokedBefore(ctx context.Context, uid string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wm, ok := s.users[uid]
+	if !ok || !wm.expires.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return wm.before, nil
+}
@@ -0,0 +1,91 @@
+package usermod
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisRevocationStore keeps revocations in redis, so that every instance
+// of the application refuses the same tokens. Keys expire with the tokens
+// they refuse.
+type RedisRevocationStore struct {
+	client *redis.Client
+}
+
+var redisRevokedTokenPrefix = "usermod:revoked_token:"
+var redisRevokedUserPrefix = "usermod:revoked_user:"
+
+// NewRedisRevocationStore connects to the redis server at url. An empty url
+// falls back to CACHE_URL.
+func NewRedisRevocationStore(url string) (*RedisRevocationStore, error) {
+	if url == "" {
+		url = CacheURL()
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisRevocationStoreWithClient(redis.NewClient(opts)), nil
+}
+
+func NewRedisRevocationStoreWithClient(client *redis.Client) *RedisRevocationStore {
+	return &RedisRevocationStore{client: client}
+}
+
+func (s *RedisRevocationStore) Revoke(ctx context.Context, jti string, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil
+	}
+	return s.client.Set(ctx, redisRevokedTokenPrefix+jti, 1, ttl).Err()
+}
+
+func (s *RedisRevocationStore) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := s.client.Exists(ctx, redisRevokedTokenPrefix+jti).Result()
+	return n > 0, err
+}
+
+// revokeUserScript keeps the later of the stored and the new watermark, and
+// the later expiry. Nanoseconds don't fit in a lua number, so they are
+// compared as decimal strings, by length and then by digit.
+var revokeUserScript = redis.NewScript(`
+local old = redis.call('GET', KEYS[1])
+if old and (#old > #ARGV[1] or (#old == #ARGV[1] and old >= ARGV[1])) then
+	if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// RevokeUser stores the watermark in nanoseconds. An earlier watermark
+// than the stored one is ignored, so that revocations arriving out of
+// order can't let tokens back in.
+func (s *RedisRevocationStore) RevokeUser(ctx context.Context, uid string, before, expires time.Time) error {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return nil
+	}
+	return revokeUserScript.Run(ctx, s.client, []string{redisRevokedUserPrefix + uid},
+		strconv.FormatInt(before.UnixNano(), 10), ttl.Milliseconds()).Err()
+}
+
+func (s *RedisRevocationStore) RevokedBefore(ctx context.Context, uid string) (time.Time, error) {
+	v, err := s.client.Get(ctx, redisRevokedUserPrefix+uid).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	ns, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ns), nil
+}
@@ -0,0 +1,169 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chayim/usermod"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// bearerStatus requests the JWT protected endpoint with the token
+func (s *UserModTestSuite) bearerStatus(token string) int {
+	r, _ := http.NewRequest(http.MethodGet, s.ts.URL+"/auth2", nil)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w, _ := http.DefaultClient.Do(r)
+	return w.StatusCode
+}
+
+func (s *UserModTestSuite) TestLogoutRevokesToken() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	other := s.login(u, testPassword)
+	assert.Equal(s.T(), http.StatusOK, s.bearerStatus(token))
+
+	r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/logout", nil)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	assert.Equal(s.T(), http.StatusUnauthorized, s.bearerStatus(token))
+	assert.Equal(s.T(), http.StatusOK, s.bearerStatus(other))
+
+	claims, err := usermod.ParseToken(token)
+	assert.Nil(s.T(), err)
+	assert.NotEqual(s.T(), "", claims.Id)
+}
+
+func (s *UserModTestSuite) TestRevokeUserTokens() {
+	admin := s.newAdmin()
+	newPassword := []byte("a different passphrase")
+	tests := []struct {
+		name     string
+		revoke   func(u *usermod.User, token string)
+		password []byte
+	}{{
+		name:     "password change",
+		password: newPassword,
+		revoke: func(u *usermod.User, token string) {
+			b, _ := json.Marshal(usermod.PasswordJSON{OldPassword: testPassword, NewPassword: newPassword})
+			r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/change_password", bytes.NewReader(b))
+			r.Header.Add("Authorization", "Bearer "+token)
+			w, _ := http.DefaultClient.Do(r)
+			assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+		},
+	}, {
+		name:     "deactivation",
+		password: testPassword,
+		revoke: func(u *usermod.User, token string) {
+			path := "/users/" + u.ID.String()
+			assert.Equal(s.T(), http.StatusOK, s.adminRequest(admin, http.MethodPost, path+"/deactivate").StatusCode)
+			assert.Equal(s.T(), http.StatusOK, s.adminRequest(admin, http.MethodPost, path+"/activate").StatusCode)
+		},
+	}, {
+		name:     "deletion",
+		password: testPassword,
+		revoke: func(u *usermod.User, token string) {
+			r, _ := http.NewRequest(http.MethodDelete, s.ts.URL+"/api/user", nil)
+			r.Header.Add("Authorization", "Bearer "+token)
+			w, _ := http.DefaultClient.Do(r)
+			assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+			path := "/users/" + u.ID.String()
+			assert.Equal(s.T(), http.StatusOK, s.adminRequest(admin, http.MethodPost, path+"/restore").StatusCode)
+		},
+	}}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			u := s.newActivatedUser()
+			token := s.login(u, testPassword)
+			assert.Equal(t, http.StatusOK, s.bearerStatus(token))
+
+			tc.revoke(u, token)
+			assert.Equal(t, http.StatusUnauthorized, s.bearerStatus(token))
+
+			// tokens issued after the watermark are accepted
+			assert.Equal(t, http.StatusOK, s.bearerStatus(s.login(u, tc.password)))
+			assert.Nil(t, u.DeleteByUID(u.ID.String()))
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestRevokeUserTokensWithinMillisecond() {
+	ctx := context.Background()
+	u := s.newActivatedUser()
+	// many rounds fall within a millisecond, and the watermark still
+	// separates the tokens before it from those after
+	for i := 0; i < 100; i++ {
+		before, err := s.tokens.CreateToken(u, nil)
+		assert.Nil(s.T(), err)
+		assert.Nil(s.T(), s.tokens.RevokeUserTokens(ctx, u.ID.String()))
+		after, err := s.tokens.CreateToken(u, nil)
+		assert.Nil(s.T(), err)
+
+		_, err = s.tokens.ValidateToken(ctx, before)
+		assert.Equal(s.T(), usermod.ErrTokenRevoked, err)
+		_, err = s.tokens.ValidateToken(ctx, after)
+		assert.Nil(s.T(), err)
+	}
+}
+
+func (s *UserModTestSuite) TestRevocationStores() {
+	ctx := context.Background()
+	mr := miniredis.RunT(s.T())
+	stores := map[string]usermod.RevocationStore{
+		"redis":  usermod.NewRedisRevocationStoreWithClient(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		"memory": usermod.NewMemoryRevocationStore(),
+	}
+	for name, store := range stores {
+		s.T().Run(name, func(t *testing.T) {
+			now := time.Now()
+			revoked, err := store.IsRevoked(ctx, "jti")
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			assert.Nil(t, store.Revoke(ctx, "jti", now.Add(time.Minute)))
+			assert.Nil(t, store.Revoke(ctx, "expired", now.Add(-time.Minute)))
+			revoked, err = store.IsRevoked(ctx, "jti")
+			assert.Nil(t, err)
+			assert.True(t, revoked)
+			revoked, err = store.IsRevoked(ctx, "expired")
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			before, err := store.RevokedBefore(ctx, "uid")
+			assert.Nil(t, err)
+			assert.True(t, before.IsZero())
+
+			watermark := now
+			assert.Nil(t, store.RevokeUser(ctx, "uid", watermark, now.Add(time.Minute)))
+			before, err = store.RevokedBefore(ctx, "uid")
+			assert.Nil(t, err)
+			assert.True(t, watermark.Equal(before))
+
+			// a watermark arriving late doesn't lower the stored one, at
+			// any distance
+			for _, earlier := range []time.Time{watermark.Add(-time.Nanosecond), watermark.Add(-time.Hour), time.Unix(0, 1)} {
+				assert.Nil(t, store.RevokeUser(ctx, "uid", earlier, now.Add(time.Minute)))
+				before, err = store.RevokedBefore(ctx, "uid")
+				assert.Nil(t, err)
+				assert.True(t, watermark.Equal(before))
+			}
+			later := watermark.Add(time.Nanosecond)
+			assert.Nil(t, store.RevokeUser(ctx, "uid", later, now.Add(time.Minute)))
+			before, err = store.RevokedBefore(ctx, "uid")
+			assert.Nil(t, err)
+			assert.True(t, later.Equal(before))
+
+			assert.Nil(t, store.RevokeUser(ctx, "expired", watermark, now.Add(-time.Minute)))
+			before, err = store.RevokedBefore(ctx, "expired")
+			assert.Nil(t, err)
+			assert.True(t, before.IsZero())
+		})
+	}
+}
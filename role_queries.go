@@ -0,0 +1,122 @@
+package usermod
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+// AdminRole is granted every permission by RequirePermission
+var AdminRole = "admin"
+
+var roleTblName = "roles"
+var rolePermissionTblName = "role_permissions"
+var userRoleTblName = "user_roles"
+
+func (s *SQLStore) CreateRole(ctx context.Context, role string) error {
+	query := s.dialect.InsertIgnore(roleTblName, "name", "$1", "name")
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), role)
+	return err
+}
+
+// DeleteRole removes the role, its permissions and every grant of it
+func (s *SQLStore) DeleteRole(ctx context.Context, role string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		fmt.Sprintf("DELETE FROM %s WHERE role = $1", userRoleTblName),
+		fmt.Sprintf("DELETE FROM %s WHERE role = $1", rolePermissionTblName),
+		fmt.Sprintf("DELETE FROM %s WHERE name = $1", roleTblName),
+	} {
+		if _, err = tx.ExecContext(ctx, s.dialect.Rebind(q), role); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) roleExists(ctx context.Context, role string) error {
+	var name string
+	query := fmt.Sprintf("SELECT name FROM %s WHERE name = $1", roleTblName)
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), role).Scan(&name)
+	if err == sql.ErrNoRows {
+		return ErrRoleNotFound
+	}
+	return err
+}
+
+func (s *SQLStore) AddRolePermission(ctx context.Context, role, permission string) error {
+	if err := s.roleExists(ctx, role); err != nil {
+		return err
+	}
+	query := s.dialect.InsertIgnore(rolePermissionTblName, "role, permission", "$1, $2", "role, permission")
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), role, permission)
+	return err
+}
+
+func (s *SQLStore) RemoveRolePermission(ctx context.Context, role, permission string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE role = $1 AND permission = $2", rolePermissionTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), role, permission)
+	return err
+}
+
+func (s *SQLStore) GetRolePermissions(ctx context.Context, role string) ([]string, error) {
+	query := fmt.Sprintf("SELECT permission FROM %s WHERE role = $1 ORDER BY permission", rolePermissionTblName)
+	return s.strings(ctx, query, role)
+}
+
+func (s *SQLStore) GrantRole(ctx context.Context, uid, role string) error {
+	if err := s.roleExists(ctx, role); err != nil {
+		return err
+	}
+	query := s.dialect.InsertIgnore(userRoleTblName, "user_id, role", "$1, $2", "user_id, role")
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), uid, role)
+	return err
+}
+
+func (s *SQLStore) RevokeRole(ctx context.Context, uid, role string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND role = $2", userRoleTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), uid, role)
+	return err
+}
+
+func (s *SQLStore) GetUserRoles(ctx context.Context, uid string) ([]string, error) {
+	query := fmt.Sprintf("SELECT role FROM %s WHERE user_id = $1 ORDER BY role", userRoleTblName)
+	return s.strings(ctx, query, uid)
+}
+
+func (s *SQLStore) GetUserPermissions(ctx context.Context, uid string) ([]string, error) {
+	query := fmt.Sprintf(`SELECT DISTINCT rp.permission FROM %s rp
+		JOIN %s ur ON ur.role = rp.role
+		WHERE ur.user_id = $1`, rolePermissionTblName, userRoleTblName)
+	perms, err := s.strings(ctx, query, uid)
+	sort.Strings(perms)
+	return perms, err
+}
+
+// strings runs a query selecting a single string column
+func (s *SQLStore) strings(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		var v string
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,98 @@
+package usermod_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/chayim/usermod"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) TestStoreRoles() {
+	ctx := context.Background()
+	for name, store := range s.stores() {
+		s.T().Run(name, func(t *testing.T) {
+			uid := uuid.New().String()
+
+			assert.Equal(t, usermod.ErrRoleNotFound, store.GrantRole(ctx, uid, "editor"))
+			assert.Equal(t, usermod.ErrRoleNotFound, store.AddRolePermission(ctx, "editor", "users:read"))
+
+			assert.Nil(t, store.CreateRole(ctx, "editor"))
+			assert.Nil(t, store.CreateRole(ctx, "editor"))
+			assert.Nil(t, store.CreateRole(ctx, "viewer"))
+			assert.Nil(t, store.AddRolePermission(ctx, "editor", "users:write"))
+			assert.Nil(t, store.AddRolePermission(ctx, "editor", "users:read"))
+			assert.Nil(t, store.AddRolePermission(ctx, "editor", "users:read"))
+			assert.Nil(t, store.AddRolePermission(ctx, "viewer", "users:read"))
+
+			perms, err := store.GetRolePermissions(ctx, "editor")
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"users:read", "users:write"}, perms)
+
+			assert.Nil(t, store.GrantRole(ctx, uid, "editor"))
+			assert.Nil(t, store.GrantRole(ctx, uid, "editor"))
+			assert.Nil(t, store.GrantRole(ctx, uid, "viewer"))
+
+			roles, err := store.GetUserRoles(ctx, uid)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"editor", "viewer"}, roles)
+
+			perms, err = store.GetUserPermissions(ctx, uid)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"users:read", "users:write"}, perms)
+
+			assert.Nil(t, store.RevokeRole(ctx, uid, "editor"))
+			perms, _ = store.GetUserPermissions(ctx, uid)
+			assert.Equal(t, []string{"users:read"}, perms)
+
+			assert.Nil(t, store.RemoveRolePermission(ctx, "viewer", "users:read"))
+			perms, _ = store.GetUserPermissions(ctx, uid)
+			assert.Equal(t, []string{}, perms)
+
+			assert.Nil(t, store.DeleteRole(ctx, "viewer"))
+			roles, _ = store.GetUserRoles(ctx, uid)
+			assert.Equal(t, []string{}, roles)
+			assert.Nil(t, store.DeleteRole(ctx, "editor"))
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestRequireRoleAndPermission() {
+	ctx := context.Background()
+	u := s.newActivatedUser()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(u.Email+":"+string(testPassword)))
+
+	get := func(path string) int {
+		r, _ := http.NewRequest(http.MethodGet, s.ts.URL+path, nil)
+		r.Header.Add("Authorization", auth)
+		w, _ := http.DefaultClient.Do(r)
+		return w.StatusCode
+	}
+
+	assert.Equal(s.T(), http.StatusForbidden, get("/role"))
+	assert.Equal(s.T(), http.StatusForbidden, get("/permission"))
+
+	assert.Nil(s.T(), s.store.CreateRole(ctx, "editor"))
+	assert.Nil(s.T(), s.store.AddRolePermission(ctx, "editor", "users:read"))
+	assert.Nil(s.T(), s.store.GrantRole(ctx, u.ID.String(), "editor"))
+
+	assert.Equal(s.T(), http.StatusOK, get("/role"))
+	assert.Equal(s.T(), http.StatusOK, get("/permission"))
+
+	// roles are embedded in issued tokens
+	claims, err := usermod.ParseToken(s.login(u, testPassword))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), []string{"editor"}, claims.Roles)
+
+	assert.Nil(s.T(), s.store.RevokeRole(ctx, u.ID.String(), "editor"))
+	assert.Equal(s.T(), http.StatusForbidden, get("/permission"))
+
+	// admins hold every permission
+	assert.Nil(s.T(), s.store.CreateRole(ctx, usermod.AdminRole))
+	assert.Nil(s.T(), s.store.GrantRole(ctx, u.ID.String(), usermod.AdminRole))
+	assert.Equal(s.T(), http.StatusOK, get("/permission"))
+	assert.Equal(s.T(), http.StatusForbidden, get("/role"))
+}
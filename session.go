@@ -0,0 +1,69 @@
+package usermod
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is a server side login, identified to the browser by an opaque
+// cookie. AuthTime is when the user logged in, in unix seconds; sessions
+// are only created on login, so stores set it on Create.
+type Session struct {
+	ID       string    `json:"-"`
+	UserID   uuid.UUID `json:"-"`
+	Expiry   int64     `json:"-"`
+	AuthTime int64     `json:"-"`
+}
+
+// SessionStore persists sessions. Get must return ErrSessionNotFound for
+// sessions that do not exist or have expired.
+type SessionStore interface {
+	Create(ctx context.Context, uid uuid.UUID, expires time.Time) (*Session, error)
+	Get(ctx context.Context, id string) (*Session, error)
+	Touch(ctx context.Context, id string, expires time.Time) error
+	Delete(ctx context.Context, id string) error
+	DeleteUserSessions(ctx context.Context, uid uuid.UUID) error
+}
+
+var ErrSessionNotFound = errors.New("session not found")
+
+var SessionCookieName = "usermod_session"
+var SessionDefaultExpiry = time.Hour * 24 // default expire 24 hours, extended on use
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, s *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    s.ID,
+		Path:     "/",
+		Expires:  time.Unix(s.Expiry, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,77 @@
+package usermod
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemorySessionStore keeps sessions in process memory, which suits tests
+// and single instance deployments.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]Session{}}
+}
+
+func (s *MemorySessionStore) Create(ctx context.Context, uid uuid.UUID, expires time.Time) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sess := Session{ID: id, UserID: uid, Expiry: expires.Unix(), AuthTime: time.Now().Unix()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = sess
+	return &sess, nil
+}
+
+func (s *MemorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if sess.Expiry < time.Now().Unix() {
+		delete(s.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	return &sess, nil
+}
+
+func (s *MemorySessionStore) Touch(ctx context.Context, id string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	sess.Expiry = expires.Unix()
+	s.sessions[id] = sess
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteUserSessions(ctx context.Context, uid uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.UserID == uid {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package usermod
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisSessionStore keeps sessions in redis, relying on key expiry to clean
+// up stale sessions.
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+var redisSessionPrefix = "usermod:session:"
+var redisUserSessionsPrefix = "usermod:user_sessions:"
+
+// CacheURL returns the redis url configured through CACHE_URL
+func CacheURL() string {
+	url := os.Getenv("CACHE_URL")
+	if url == "" {
+		url = "redis://localhost:6379"
+	}
+	return url
+}
+
+// NewRedisSessionStore connects to the redis server at url. An empty url
+// falls back to CACHE_URL.
+func NewRedisSessionStore(url string) (*RedisSessionStore, error) {
+	if url == "" {
+		url = CacheURL()
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisSessionStoreWithClient(redis.NewClient(opts)), nil
+}
+
+func NewRedisSessionStoreWithClient(client *redis.Client) *RedisSessionStore {
+	return &RedisSessionStore{client: client}
+}
+
+func (s *RedisSessionStore) Create(ctx context.Context, uid uuid.UUID, expires time.Time) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{ID: id, UserID: uid, Expiry: expires.Unix(), AuthTime: time.Now().Unix()}
+
+	userKey := redisUserSessionsPrefix + uid.String()
+	value := uid.String() + " " + strconv.FormatInt(sess.AuthTime, 10)
+	_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, redisSessionPrefix+id, value, time.Until(expires))
+		p.SAdd(ctx, userKey, id)
+		p.ExpireAt(ctx, userKey, expires)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *RedisSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	key := redisSessionPrefix + id
+	value, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := s.client.TTL(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	uid, authTime := parseRedisSession(value)
+	parsed, err := uuid.Parse(uid)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ID: id, UserID: parsed, Expiry: time.Now().Add(ttl).Unix(), AuthTime: authTime}, nil
+}
+
+// parseRedisSession splits a session's value into the user's id and the
+// time they logged in. Sessions stored before the time was kept have none.
+func parseRedisSession(value string) (string, int64) {
+	uid, authTime, _ := strings.Cut(value, " ")
+	t, _ := strconv.ParseInt(authTime, 10, 64)
+	return uid, t
+}
+
+// Touch extends the session, and the index of the user's sessions with it.
+// Sessions share a lifetime, so the most recently touched session always
+// outlives the others.
+func (s *RedisSessionStore) Touch(ctx context.Context, id string, expires time.Time) error {
+	key := redisSessionPrefix + id
+	value, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	uid, _ := parseRedisSession(value)
+	_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ExpireAt(ctx, key, expires)
+		p.ExpireAt(ctx, redisUserSessionsPrefix+uid, expires)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisSessionStore) Delete(ctx context.Context, id string) error {
+	key := redisSessionPrefix + id
+	value, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	uid, _ := parseRedisSession(value)
+	_, err = s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, key)
+		p.SRem(ctx, redisUserSessionsPrefix+uid, id)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisSessionStore) DeleteUserSessions(ctx context.Context, uid uuid.UUID) error {
+	userKey := redisUserSessionsPrefix + uid.String()
+	ids, err := s.client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{userKey}
+	for _, id := range ids {
+		keys = append(keys, redisSessionPrefix+id)
+	}
+	return s.client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,78 @@
+package usermod
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SQLSessionStore keeps sessions in the same database as the users table.
+// Its table is created by Migrate.
+type SQLSessionStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+var sessionTblName = "sessions"
+
+// NewSQLSessionStore creates a store, detecting the dialect from the driver
+func NewSQLSessionStore(db *sql.DB) *SQLSessionStore {
+	return NewSQLSessionStoreWithDialect(db, DetectDialect(db))
+}
+
+func NewSQLSessionStoreWithDialect(db *sql.DB, dialect Dialect) *SQLSessionStore {
+	return &SQLSessionStore{db: db, dialect: dialect}
+}
+
+func (s *SQLSessionStore) TableName() string {
+	return sessionTblName
+}
+
+func (s *SQLSessionStore) Create(ctx context.Context, uid uuid.UUID, expires time.Time) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{ID: id, UserID: uid, Expiry: expires.Unix(), AuthTime: time.Now().Unix()}
+
+	query := fmt.Sprintf("INSERT INTO %s (id, user_id, expiry, auth_time) VALUES ($1, $2, $3, $4)", s.TableName())
+	_, err = s.db.ExecContext(ctx, s.dialect.Rebind(query), sess.ID, sess.UserID.String(), sess.Expiry, sess.AuthTime)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *SQLSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	sess := Session{}
+	query := fmt.Sprintf("SELECT id, user_id, expiry, auth_time from %s WHERE id = $1 AND expiry >= $2", s.TableName())
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id, time.Now().Unix()).Scan(&sess.ID, &sess.UserID, &sess.Expiry, &sess.AuthTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *SQLSessionStore) Touch(ctx context.Context, id string, expires time.Time) error {
+	query := fmt.Sprintf("UPDATE %s SET expiry = $1 WHERE id = $2", s.TableName())
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), expires.Unix(), id)
+	return err
+}
+
+func (s *SQLSessionStore) Delete(ctx context.Context, id string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", s.TableName())
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), id)
+	return err
+}
+
+func (s *SQLSessionStore) DeleteUserSessions(ctx context.Context, uid uuid.UUID) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1", s.TableName())
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), uid.String())
+	return err
+}
@@ -0,0 +1,77 @@
+package usermod_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/chayim/usermod"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) sessionStores() map[string]usermod.SessionStore {
+	mr := miniredis.RunT(s.T())
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return map[string]usermod.SessionStore{
+		"sql":    usermod.NewSQLSessionStore(s.db),
+		"redis":  usermod.NewRedisSessionStoreWithClient(client),
+		"memory": usermod.NewMemorySessionStore(),
+	}
+}
+
+func (s *UserModTestSuite) TestSessionStores() {
+	ctx := context.Background()
+	for name, store := range s.sessionStores() {
+		s.T().Run(name, func(t *testing.T) {
+			uid := uuid.New()
+			sess, err := store.Create(ctx, uid, time.Now().Add(time.Hour))
+			assert.Nil(t, err)
+			assert.NotEqual(t, "", sess.ID)
+
+			found, err := store.Get(ctx, sess.ID)
+			assert.Nil(t, err)
+			assert.Equal(t, uid, found.UserID)
+			assert.Equal(t, sess.AuthTime, found.AuthTime)
+			assert.InDelta(t, time.Now().Unix(), found.AuthTime, 1)
+
+			_, err = store.Get(ctx, "not-a-session")
+			assert.Equal(t, usermod.ErrSessionNotFound, err)
+
+			err = store.Touch(ctx, sess.ID, time.Now().Add(2*time.Hour))
+			assert.Nil(t, err)
+			found, err = store.Get(ctx, sess.ID)
+			assert.Nil(t, err)
+			assert.Greater(t, found.Expiry, time.Now().Add(time.Hour).Unix())
+
+			err = store.Delete(ctx, sess.ID)
+			assert.Nil(t, err)
+			_, err = store.Get(ctx, sess.ID)
+			assert.Equal(t, usermod.ErrSessionNotFound, err)
+
+			s1, _ := store.Create(ctx, uid, time.Now().Add(time.Hour))
+			s2, _ := store.Create(ctx, uid, time.Now().Add(time.Hour))
+			other, _ := store.Create(ctx, uuid.New(), time.Now().Add(time.Hour))
+			err = store.DeleteUserSessions(ctx, uid)
+			assert.Nil(t, err)
+			_, err = store.Get(ctx, s1.ID)
+			assert.Equal(t, usermod.ErrSessionNotFound, err)
+			_, err = store.Get(ctx, s2.ID)
+			assert.Equal(t, usermod.ErrSessionNotFound, err)
+			_, err = store.Get(ctx, other.ID)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestSQLSessionExpired() {
+	ctx := context.Background()
+	store := usermod.NewSQLSessionStore(s.db)
+	sess, err := store.Create(ctx, uuid.New(), time.Now().Add(-time.Minute))
+	assert.Nil(s.T(), err)
+
+	_, err = store.Get(ctx, sess.ID)
+	assert.Equal(s.T(), usermod.ErrSessionNotFound, err)
+}
@@ -0,0 +1,122 @@
+package usermod
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+)
+
+// UserStore persists users. Passwords are handed to the store already
+// hashed.
+type UserStore interface {
+	InsertUser(ctx context.Context, u *User) error
+	GetUserByID(ctx context.Context, id string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetActiveUserByEmail(ctx context.Context, email string) (*User, error)
+	UpdateUser(ctx context.Context, id, name, email, phone string) error
+	SetPassword(ctx context.Context, id string, hash []byte) error
+	Activate(ctx context.Context, id string) error
+	Deactivate(ctx context.Context, id string) error
+	SoftDeleteUser(ctx context.Context, id string) error
+	RestoreUser(ctx context.Context, id string) error
+	SetDisabled(ctx context.Context, id string, disabled bool) error
+	DeleteUser(ctx context.Context, id string) error
+	ListUsers(ctx context.Context, filter UserFilter) ([]*User, int, error)
+	SetTOTP(ctx context.Context, id string, secret []byte, enabled bool) error
+	SetPendingTOTP(ctx context.Context, id string, secret []byte) error
+	ConsumeTOTPStep(ctx context.Context, id string, step int64) error
+}
+
+// UserFilter narrows ListUsers. Email and Name match case insensitive
+// substrings, nil booleans match either state. Users are ordered by email.
+type UserFilter struct {
+	Email     string
+	Name      string
+	Activated *bool
+	Deleted   *bool
+	Disabled  *bool
+	Limit     int
+	Offset    int
+}
+
+// TokenStore persists user operation tokens, such as activation and
+// password reset tokens.
+type TokenStore interface {
+	InsertToken(ctx context.Context, t *UserOperationToken) error
+	GetToken(ctx context.Context, id string) (*UserOperationToken, error)
+	GetTokenIfValid(ctx context.Context, uid, token string) (*UserOperationToken, error)
+	MarkTokenAsUsed(ctx context.Context, token string) (uuid.UUID, error)
+	ConsumeToken(ctx context.Context, token string, tokenType Token) (uuid.UUID, error)
+	InvalidateUserTokens(ctx context.Context, uid string, tokenType Token) error
+}
+
+// RefreshTokenStore persists refresh tokens.
+type RefreshTokenStore interface {
+	InsertRefreshToken(ctx context.Context, t *RefreshToken) error
+	GetRefreshToken(ctx context.Context, id string) (*RefreshToken, error)
+	MarkRefreshTokenAsUsed(ctx context.Context, id string) error
+	RevokeRefreshTokenFamily(ctx context.Context, family string) error
+	RevokeUserRefreshTokens(ctx context.Context, uid string) error
+}
+
+// RoleStore persists roles, the permissions they carry and the users they
+// are granted to. Granting a role, or adding a permission to it, fails with
+// ErrRoleNotFound unless the role was created first.
+type RoleStore interface {
+	CreateRole(ctx context.Context, role string) error
+	DeleteRole(ctx context.Context, role string) error
+	AddRolePermission(ctx context.Context, role, permission string) error
+	RemoveRolePermission(ctx context.Context, role, permission string) error
+	GetRolePermissions(ctx context.Context, role string) ([]string, error)
+	GrantRole(ctx context.Context, uid, role string) error
+	RevokeRole(ctx context.Context, uid, role string) error
+	GetUserRoles(ctx context.Context, uid string) ([]string, error)
+	GetUserPermissions(ctx context.Context, uid string) ([]string, error)
+}
+
+// Store is everything the router needs persisted. Sessions returns the
+// session store used unless the router is configured WithSessionStore, and
+// LoginAttempts the failed login counters unless it is configured
+// WithLockout.
+type Store interface {
+	UserStore
+	TokenStore
+	RefreshTokenStore
+	RoleStore
+	RecoveryCodeStore
+	WebAuthnStore
+	OAuthStore
+	IdentityStore
+	APIKeyStore
+	PasswordHistoryStore
+	Sessions() SessionStore
+	LoginAttempts() LoginAttemptStore
+}
+
+// SQLStore is the database/sql implementation of Store.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLStore creates a store, detecting the dialect from the driver
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return NewSQLStoreWithDialect(db, DetectDialect(db))
+}
+
+func NewSQLStoreWithDialect(db *sql.DB, dialect Dialect) *SQLStore {
+	return &SQLStore{db: db, dialect: dialect}
+}
+
+func (s *SQLStore) Dialect() Dialect {
+	return s.dialect
+}
+
+func (s *SQLStore) Sessions() SessionStore {
+	return NewSQLSessionStoreWithDialect(s.db, s.dialect)
+}
+
+func (s *SQLStore) LoginAttempts() LoginAttemptStore {
+	return NewSQLLoginAttemptStoreWithDialect(s.db, s.dialect)
+}
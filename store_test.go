@@ -0,0 +1,179 @@
+package usermod_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) stores() map[string]usermod.Store {
+	return map[string]usermod.Store{
+		"sql":    s.store,
+		"memory": usermod.NewMemoryStore(),
+	}
+}
+
+func (s *UserModTestSuite) TestStoreUsers() {
+	ctx := context.Background()
+	for name, store := range s.stores() {
+		s.T().Run(name, func(t *testing.T) {
+			u := usermod.NewUserInStore(store, "Chayim", name+"@ummmfoo.com", testPassword)
+			assert.Nil(t, u.Insert())
+
+			found, err := store.GetUserByID(ctx, u.ID.String())
+			assert.Nil(t, err)
+			assert.Equal(t, u.Email, found.Email)
+			assert.False(t, found.IsActivated)
+
+			_, err = store.GetActiveUserByEmail(ctx, u.Email)
+			assert.NotNil(t, err)
+			assert.Nil(t, store.Activate(ctx, u.ID.String()))
+			found, err = store.GetActiveUserByEmail(ctx, u.Email)
+			assert.Nil(t, err)
+			assert.True(t, found.IsActivated)
+
+			// users returned by the store can be updated in place
+			assert.Nil(t, found.Update("Bob Dobbs", "", ""))
+			assert.Nil(t, found.ChangePassword([]byte("potatofurby")))
+			found, err = store.GetUserByEmail(ctx, u.Email)
+			assert.Nil(t, err)
+			assert.Equal(t, "Bob Dobbs", found.Name)
+			assert.NotEqual(t, string(u.Password), string(found.Password))
+
+			assert.NotNil(t, store.UpdateUser(ctx, uuid.New().String(), "a", "b", "c"))
+
+			// emails belong to a single user
+			other := usermod.NewUserInStore(store, "Other", u.Email, testPassword)
+			assert.Equal(t, usermod.ErrEmailTaken, other.Insert())
+			other = usermod.NewUserInStore(store, "Other", "other-"+name+"@ummmfoo.com", testPassword)
+			assert.Nil(t, other.Insert())
+			assert.Equal(t, usermod.ErrEmailTaken, store.UpdateUser(ctx, other.ID.String(), "Other", u.Email, ""))
+
+			assert.Nil(t, store.SetTOTP(ctx, u.ID.String(), []byte("secret"), true))
+			assert.Nil(t, store.ConsumeTOTPStep(ctx, u.ID.String(), 10))
+			assert.Equal(t, usermod.ErrTOTPReplayed, store.ConsumeTOTPStep(ctx, u.ID.String(), 10))
+			assert.Nil(t, store.ConsumeTOTPStep(ctx, u.ID.String(), 11))
+			found, _ = store.GetUserByID(ctx, u.ID.String())
+			assert.True(t, found.TOTPEnabled)
+			assert.Equal(t, []byte("secret"), found.TOTPSecret)
+			assert.Equal(t, int64(11), found.TOTPLastStep)
+
+			assert.Nil(t, found.Deactivate())
+			found, _ = store.GetUserByID(ctx, u.ID.String())
+			assert.False(t, found.IsActivated)
+
+			assert.Nil(t, store.SoftDeleteUser(ctx, u.ID.String()))
+			found, _ = store.GetUserByID(ctx, u.ID.String())
+			assert.True(t, found.IsDeleted)
+
+			assert.Nil(t, store.DeleteUser(ctx, u.ID.String()))
+			_, err = store.GetUserByID(ctx, u.ID.String())
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestStoreTokens() {
+	ctx := context.Background()
+	for name, store := range s.stores() {
+		s.T().Run(name, func(t *testing.T) {
+			uid := uuid.New()
+			tok := usermod.NewUserOperationTokenInStore(store, uid, usermod.ForgotPaswordToken, time.Now().Add(time.Hour))
+			assert.Nil(t, tok.Insert())
+
+			found, err := store.GetToken(ctx, tok.ID.String())
+			assert.Nil(t, err)
+			assert.Equal(t, tok.ID, found.ID)
+
+			_, err = store.GetTokenIfValid(ctx, uid.String(), tok.ID.String())
+			assert.Nil(t, err)
+			_, err = store.GetTokenIfValid(ctx, uuid.New().String(), tok.ID.String())
+			assert.NotNil(t, err)
+
+			_, err = store.ConsumeToken(ctx, tok.ID.String(), usermod.ActivationToken)
+			assert.NotNil(t, err)
+			consumed, err := store.ConsumeToken(ctx, tok.ID.String(), usermod.ForgotPaswordToken)
+			assert.Nil(t, err)
+			assert.Equal(t, uid, consumed)
+			_, err = store.ConsumeToken(ctx, tok.ID.String(), usermod.ForgotPaswordToken)
+			assert.NotNil(t, err)
+
+			other := usermod.NewUserOperationTokenInStore(store, uid, usermod.ActivationToken, time.Now().Add(time.Hour))
+			assert.Nil(t, other.Insert())
+			assert.Nil(t, store.InvalidateUserTokens(ctx, uid.String(), usermod.ActivationToken))
+			found, _ = store.GetToken(ctx, other.ID.String())
+			assert.True(t, found.Used)
+
+			rt := usermod.NewRefreshTokenInStore(store, uid, uuid.New())
+			assert.Nil(t, rt.Insert())
+			assert.Nil(t, store.MarkRefreshTokenAsUsed(ctx, rt.ID.String()))
+			assert.Equal(t, usermod.ErrRefreshTokenReused, store.MarkRefreshTokenAsUsed(ctx, rt.ID.String()))
+			assert.Nil(t, store.RevokeUserRefreshTokens(ctx, uid.String()))
+			foundRT, err := store.GetRefreshToken(ctx, rt.ID.String())
+			assert.Nil(t, err)
+			assert.True(t, foundRT.Revoked)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestMemoryStoreRouter() {
+	store := usermod.NewMemoryStore()
+	ts := httptest.NewServer(usermod.NewRouter(store))
+	defer ts.Close()
+
+	u := usermod.NewUserInStore(store, "Chayim", "c@ummmfoo.com", testPassword)
+	assert.Nil(s.T(), u.Insert())
+	assert.Nil(s.T(), store.Activate(context.Background(), u.ID.String()))
+
+	b, _ := json.Marshal(usermod.LoginJSON{Email: u.Email, Password: string(testPassword)})
+	r, _ := http.NewRequest(http.MethodPost, ts.URL+"/login", bytes.NewReader(b))
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	tok := usermod.TokenJSON{}
+	json.NewDecoder(w.Body).Decode(&tok)
+
+	r, _ = http.NewRequest(http.MethodGet, ts.URL+"/user", nil)
+	r.Header.Add("Authorization", "Bearer "+tok.Token)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestStoreListUsers() {
+	ctx := context.Background()
+	yes := true
+	for name, store := range s.stores() {
+		s.T().Run(name, func(t *testing.T) {
+			for _, email := range []string{"b@ummmfoo.com", "a@ummmfoo.com", "c@other.com"} {
+				u := usermod.NewUserInStore(store, "Chayim", email, testPassword)
+				assert.Nil(t, u.Insert())
+				if email != "c@other.com" {
+					assert.Nil(t, store.Activate(ctx, u.ID.String()))
+				}
+			}
+
+			users, total, err := store.ListUsers(ctx, usermod.UserFilter{Email: "UMMM", Limit: 1, Offset: 1})
+			assert.Nil(t, err)
+			assert.Equal(t, 2, total)
+			assert.Equal(t, 1, len(users))
+			assert.Equal(t, "b@ummmfoo.com", users[0].Email)
+
+			users, total, err = store.ListUsers(ctx, usermod.UserFilter{Activated: &yes, Limit: 10})
+			assert.Nil(t, err)
+			assert.Equal(t, 2, total)
+			assert.Equal(t, "a@ummmfoo.com", users[0].Email)
+
+			assert.Nil(t, store.SoftDeleteUser(ctx, users[0].ID.String()))
+			assert.Nil(t, store.RestoreUser(ctx, users[0].ID.String()))
+			found, _ := store.GetUserByID(ctx, users[0].ID.String())
+			assert.False(t, found.IsDeleted)
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package usermod
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"time"
@@ -8,29 +10,148 @@ import (
 	"github.com/golang-jwt/jwt"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+var ErrJWTSecretMissing = errors.New("JWT_SECRET is not set")
 
 type Claims struct {
-	Email  string `json:"email"`
-	UserID string `json:"user_id"`
+	Email  string   `json:"email"`
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles,omitempty"`
+	// Scope is set on access tokens issued to OpenID Connect clients
+	Scope string `json:"scope,omitempty"`
+	// AuthTime is when the user logged in, and is missing from refreshed
+	// tokens
+	AuthTime int64 `json:"auth_time,omitempty"`
 	jwt.StandardClaims
 }
 
-func CreateToken(u *User) (string, error) {
+// TokenConfig signs and verifies access tokens. Expiry defaults to 15
+// minutes. Tokens in Revocations are refused by ValidateToken; it should be
+// shared by every TokenConfig verifying the same tokens.
+type TokenConfig struct {
+	Keys        *KeySet
+	Expiry      time.Duration
+	Revocations RevocationStore
+}
+
+// NewTokenConfig keeps revocations in memory
+func NewTokenConfig(keys *KeySet, expiry time.Duration) *TokenConfig {
+	return &TokenConfig{Keys: keys, Expiry: expiry, Revocations: NewMemoryRevocationStore()}
+}
+
+// TokenConfigFromEnv signs with HS256 using JWT_SECRET, and expires tokens
+// after JWT_EXPIRATION minutes. Revocations are kept in redis when
+// CACHE_URL is set, and in memory otherwise. It is used when no
+// TokenConfig is given, and fails when JWT_SECRET is empty or CACHE_URL
+// can't be parsed.
+func TokenConfigFromEnv() (*TokenConfig, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, ErrJWTSecretMissing
+	}
 	mins, err := strconv.Atoi(os.Getenv("JWT_EXPIRATION"))
 	if err != nil || mins <= 0 {
 		mins = 15
 	}
+	cfg := NewTokenConfig(NewKeySet(NewHMACKey("", []byte(secret))), time.Duration(mins)*time.Minute)
+	if os.Getenv("CACHE_URL") != "" {
+		revocations, err := NewRedisRevocationStore("")
+		if err != nil {
+			return nil, fmt.Errorf("revocation store: %w", err)
+		}
+		cfg.Revocations = revocations
+	}
+	return cfg, nil
+}
+
+// mustTokenConfigFromEnv is TokenConfigFromEnv for constructors that have
+// no error to return
+func mustTokenConfigFromEnv() *TokenConfig {
+	cfg, err := TokenConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+func (c *TokenConfig) expiry() time.Duration {
+	if c.Expiry > 0 {
+		return c.Expiry
+	}
+	return 15 * time.Minute
+}
+
+// CreateToken embeds the user's roles in the token, for services that
+// authorize from the token alone. RequireRole and RequirePermission always
+// consult the store, so revoking a role takes effect immediately. The
+// token is taken to be issued on login, for RequireRecentAuth.
+func (c *TokenConfig) CreateToken(u *User, roles []string) (string, error) {
+	return c.createToken(u, roles, time.Now())
+}
+
+// createToken records authTime as the user's login, unless it is zero
+func (c *TokenConfig) createToken(u *User, roles []string, authTime time.Time) (string, error) {
+	claims, err := c.newClaims(u)
+	if err != nil {
+		return "", err
+	}
+	claims.Roles = roles
+	if !authTime.IsZero() {
+		claims.AuthTime = authTime.Unix()
+	}
+	return c.Keys.Sign(claims)
+}
 
-	// Token expires in 15 minutes
-	expirationTime := time.Now().Add(time.Duration(mins) * time.Minute)
-	claims := &Claims{
+// newClaims identifies the user, and the token itself by its jti
+func (c *TokenConfig) newClaims(u *User) (*Claims, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Claims{
 		Email:  u.Email,
 		UserID: u.ID.String(),
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(c.expiry()).Unix(),
 		},
+	}, nil
+}
+
+// ParseToken validates a token created by CreateToken and returns its
+// claims, without checking whether it was revoked.
+func (c *TokenConfig) ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	if err := c.Keys.Parse(tokenString, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// CreateToken signs a token with the environment's configuration.
+//
+// Deprecated: use TokenConfig.CreateToken.
+func CreateToken(u *User) (string, error) {
+	return CreateTokenWithRoles(u, nil)
+}
+
+// Deprecated: use TokenConfig.CreateToken.
+func CreateTokenWithRoles(u *User, roles []string) (string, error) {
+	cfg, err := TokenConfigFromEnv()
+	if err != nil {
+		return "", err
+	}
+	return cfg.CreateToken(u, roles)
+}
+
+// ParseToken validates a token with the environment's configuration.
+//
+// Deprecated: use TokenConfig.ParseToken.
+func ParseToken(tokenString string) (*Claims, error) {
+	cfg, err := TokenConfigFromEnv()
+	if err != nil {
+		return nil, err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return cfg.ParseToken(tokenString)
 }
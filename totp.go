@@ -0,0 +1,175 @@
+package usermod
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+var ErrTOTPRequired = errors.New("totp code required")
+var ErrTOTPInvalid = errors.New("invalid totp code")
+var ErrTOTPReplayed = errors.New("totp code already used")
+var ErrTOTPKeyMissing = errors.New("totp encryption key not configured")
+
+// TOTPIssuer names the account in authenticator apps
+var TOTPIssuer = "usermod"
+
+// TOTPHeader carries the second factor for BasicAuth
+var TOTPHeader = "X-TOTP-Code"
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is the number of periods either side of now that are accepted
+	totpSkew = 1
+)
+
+// TOTPEncryptionKey encrypts secrets at rest, and is read from
+// TOTP_ENCRYPTION_KEY. Users can't enroll until it is set, and changing it
+// leaves enrolled users unable to log in.
+var TOTPEncryptionKey = TOTPKeyFromEnv()
+
+// TOTPKeyFromEnv derives a key from TOTP_ENCRYPTION_KEY, or returns nil
+// when it isn't set
+func TOTPKeyFromEnv() []byte {
+	secret := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if secret == "" {
+		return nil
+	}
+	return NewTOTPKey(secret)
+}
+
+// NewTOTPKey derives a TOTPEncryptionKey from a secret of any length
+func NewTOTPKey(secret string) []byte {
+	sum := sha256.Sum256([]byte("usermod totp:" + secret))
+	return sum[:]
+}
+
+// totpCipher encrypts with TOTPEncryptionKey
+func totpCipher() (cipher.AEAD, error) {
+	if len(TOTPEncryptionKey) == 0 {
+		return nil, ErrTOTPKeyMissing
+	}
+	block, err := aes.NewCipher(TOTPEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random 160 bit secret, base32 encoded as
+// authenticator apps expect.
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI builds the otpauth:// provisioning uri, usually shown as a QR code
+func TOTPURI(secret, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// TOTPCode computes the RFC 6238 code for the period containing t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCodeAt(secret, t.Unix()/totpPeriod)
+}
+
+func totpCodeAt(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000), nil
+}
+
+// validateTOTP checks the code against the periods around t, returning the
+// matching step.
+func validateTOTP(secret, code string, t time.Time) (int64, error) {
+	now := t.Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		expected, err := totpCodeAt(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrTOTPInvalid
+}
+
+func encryptTOTPSecret(secret string) ([]byte, error) {
+	gcm, err := totpCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(secret), nil), nil
+}
+
+func decryptTOTPSecret(b []byte) (string, error) {
+	gcm, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(b) < gcm.NonceSize() {
+		return "", errors.New("invalid totp secret")
+	}
+	secret, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	return string(secret), err
+}
+
+// verifyTOTP checks a code against the user's secret. When consume is set
+// the code's period is recorded, so the same code can't be used twice.
+func verifyTOTP(ctx context.Context, store UserStore, u *User, code string, consume bool) error {
+	if code == "" {
+		return ErrTOTPRequired
+	}
+	secret, err := decryptTOTPSecret(u.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	step, err := validateTOTP(secret, code, time.Now())
+	if err != nil {
+		return err
+	}
+	if !consume {
+		return nil
+	}
+	return store.ConsumeTOTPStep(ctx, u.ID.String(), step)
+}
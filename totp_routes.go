@@ -0,0 +1,150 @@
+package usermod
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+type TOTPJSON struct {
+	Code string `json:"code"`
+}
+
+type TOTPEnrollJSON struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// readTOTPCode reads the code from the request body, which may be empty
+func readTOTPCode(r *http.Request) (string, error) {
+	t := TOTPJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil || len(bytes) == 0 {
+		return "", err
+	}
+	err = json.Unmarshal(bytes, &t)
+	return t.Code, err
+}
+
+// EnrollTOTP generates a new secret for the user, which must be confirmed
+// before it is enforced. Re-enrolling while TOTP is enabled requires a code
+// from the current secret, which stays in force until the new one is
+// confirmed.
+func (rr *Router) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+
+	code, err := readTOTPCode(r)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	encrypted, err := encryptTOTPSecret(secret)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if u.TOTPEnabled && !rr.guardTOTP(w, r, u, code) {
+		return
+	}
+	err = rr.store.SetPendingTOTP(r.Context(), u.ID.String(), encrypted)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, TOTPEnrollJSON{Secret: secret, URI: TOTPURI(secret, u.Email)})
+}
+
+// ConfirmTOTP enables TOTP once the user proves their authenticator has
+// the enrolled secret, replacing any secret enabled before it
+func (rr *Router) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+
+	code, err := readTOTPCode(r)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(u.TOTPPending) == 0 {
+		jsonErrorFromString(w, "no pending totp enrollment", http.StatusConflict)
+		return
+	}
+
+	secret, err := decryptTOTPSecret(u.TOTPPending)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if code == "" {
+		jsonError(w, ErrTOTPRequired, http.StatusBadRequest)
+		return
+	}
+	step, err := validateTOTP(secret, code, time.Now())
+	if err != nil {
+		jsonError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	err = rr.store.SetTOTP(r.Context(), u.ID.String(), u.TOTPPending, true)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = rr.store.ConsumeTOTPStep(r.Context(), u.ID.String(), step)
+	if err != nil && err != ErrTOTPReplayed {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// DisableTOTP removes TOTP from the account, given a current code
+func (rr *Router) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+
+	code, err := readTOTPCode(r)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !u.TOTPEnabled {
+		jsonErrorFromString(w, "totp is not enabled", http.StatusConflict)
+		return
+	}
+	if !rr.guardTOTP(w, r, u, code) {
+		return
+	}
+
+	err = rr.store.SetTOTP(r.Context(), u.ID.String(), nil, false)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// guardTOTP checks a code from the user's current secret, counting
+// failures towards the lockout so that codes can't be guessed by whoever
+// holds a session or token. It responds and returns false on failure.
+func (rr *Router) guardTOTP(w http.ResponseWriter, r *http.Request, u *User, code string) bool {
+	err := rr.lockout.Guard(r.Context(), u, clientIP(r), func() error {
+		return verifyTOTP(r.Context(), rr.store, u, code, true)
+	})
+	var locked *LockoutError
+	if errors.As(err, &locked) {
+		writeLockoutError(w, locked)
+		return false
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
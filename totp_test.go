@@ -0,0 +1,234 @@
+package usermod_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+func (s *UserModTestSuite) totpRequest(method, path, token, code string) *http.Response {
+	b, _ := json.Marshal(usermod.TOTPJSON{Code: code})
+	r, _ := http.NewRequest(method, s.ts.URL+"/api"+path, bytes.NewReader(b))
+	r.Header.Add("Authorization", "Bearer "+token)
+	w, _ := http.DefaultClient.Do(r)
+	return w
+}
+
+func (s *UserModTestSuite) enrollTOTP(token string) string {
+	w := s.totpRequest(http.MethodPost, "/user/totp/enroll", token, "")
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	e := usermod.TOTPEnrollJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&e))
+	return e.Secret
+}
+
+func (s *UserModTestSuite) totpCode(secret string, t time.Time) string {
+	code, err := usermod.TOTPCode(secret, t)
+	assert.Nil(s.T(), err)
+	return code
+}
+
+func (s *UserModTestSuite) loginWithTOTP(u *usermod.User, code string) int {
+	l := usermod.LoginJSON{Email: u.Email, Password: string(testPassword), TOTPCode: code}
+	b, _ := json.Marshal(l)
+	r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/login", bytes.NewReader(b))
+	w, _ := http.DefaultClient.Do(r)
+	return w.StatusCode
+}
+
+func (s *UserModTestSuite) TestTOTPCode() {
+	// RFC 6238 appendix B, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		assert.Equal(s.T(), tt.code, s.totpCode(secret, time.Unix(tt.unix, 0)))
+	}
+
+	uri, err := url.Parse(usermod.TOTPURI(secret, "user@ummmfoo.com"))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "otpauth", uri.Scheme)
+	assert.Equal(s.T(), "totp", uri.Host)
+	assert.Equal(s.T(), "/usermod:user@ummmfoo.com", uri.Path)
+	assert.Equal(s.T(), secret, uri.Query().Get("secret"))
+	assert.Equal(s.T(), "usermod", uri.Query().Get("issuer"))
+}
+
+func (s *UserModTestSuite) TestTOTPEnrollAndLogin() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	now := time.Now()
+
+	secret := s.enrollTOTP(token)
+	assert.NotEqual(s.T(), "", secret)
+
+	// enrollment isn't enforced until it is confirmed
+	stored, err := usermod.GetUserByID(s.db, u.ID.String())
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), stored.TOTPEnabled)
+	assert.NotContains(s.T(), string(stored.TOTPPending), secret)
+	assert.Equal(s.T(), http.StatusOK, s.loginWithTOTP(u, ""))
+
+	w := s.totpRequest(http.MethodPost, "/user/totp/confirm", token, "000000")
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+	w = s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, now))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	w = s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, now))
+	assert.Equal(s.T(), http.StatusConflict, w.StatusCode)
+
+	tests := []struct {
+		name       string
+		code       string
+		statusCode int
+	}{
+		{"missing code", "", http.StatusUnauthorized},
+		{"wrong code", "000000", http.StatusUnauthorized},
+		{"code used to confirm", s.totpCode(secret, now), http.StatusUnauthorized},
+		{"next code", s.totpCode(secret, now.Add(30*time.Second)), http.StatusOK},
+		{"replayed code", s.totpCode(secret, now.Add(30*time.Second)), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.statusCode, s.loginWithTOTP(u, tt.code))
+		})
+	}
+
+	// re-enrolling needs the current factor
+	w = s.totpRequest(http.MethodPost, "/user/totp/enroll", token, "")
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestTOTPReenroll() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	now := time.Now()
+	secret := s.enrollTOTP(token)
+	w := s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, now.Add(-30*time.Second)))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	enabled, _ := usermod.GetUserByID(s.db, u.ID.String())
+
+	w = s.totpRequest(http.MethodPost, "/user/totp/enroll", token, s.totpCode(secret, now))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	e := usermod.TOTPEnrollJSON{}
+	assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(&e))
+
+	// the enabled secret guards logins until the new one is confirmed
+	stored, _ := usermod.GetUserByID(s.db, u.ID.String())
+	assert.True(s.T(), stored.TOTPEnabled)
+	assert.Equal(s.T(), enabled.TOTPSecret, stored.TOTPSecret)
+	assert.NotNil(s.T(), stored.TOTPPending)
+	assert.Equal(s.T(), http.StatusUnauthorized, s.loginWithTOTP(u, ""))
+	assert.Equal(s.T(), http.StatusOK, s.loginWithTOTP(u, s.totpCode(secret, now.Add(30*time.Second))))
+
+	w = s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(e.Secret, now))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	stored, _ = usermod.GetUserByID(s.db, u.ID.String())
+	assert.True(s.T(), stored.TOTPEnabled)
+	assert.NotEqual(s.T(), enabled.TOTPSecret, stored.TOTPSecret)
+	assert.Nil(s.T(), stored.TOTPPending)
+}
+
+func (s *UserModTestSuite) TestTOTPGuessing() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	secret := s.enrollTOTP(token)
+	w := s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, time.Now()))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	// a stolen token can't guess its way to disabling the second factor
+	for i := 0; i < 5; i++ {
+		w = s.totpRequest(http.MethodDelete, "/user/totp", token, "000000")
+		assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+	}
+	w = s.totpRequest(http.MethodDelete, "/user/totp", token, "000000")
+	assert.Equal(s.T(), http.StatusTooManyRequests, w.StatusCode)
+	w = s.totpRequest(http.MethodPost, "/user/totp/enroll", token, "000000")
+	assert.Equal(s.T(), http.StatusTooManyRequests, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestTOTPWithoutKey() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	key := usermod.TOTPEncryptionKey
+	usermod.TOTPEncryptionKey = nil
+	defer func() { usermod.TOTPEncryptionKey = key }()
+
+	w := s.totpRequest(http.MethodPost, "/user/totp/enroll", token, "")
+	assert.Equal(s.T(), http.StatusInternalServerError, w.StatusCode)
+	body, _ := io.ReadAll(w.Body)
+	assert.Contains(s.T(), string(body), usermod.ErrTOTPKeyMissing.Error())
+	stored, _ := usermod.GetUserByID(s.db, u.ID.String())
+	assert.Nil(s.T(), stored.TOTPPending)
+}
+
+func (s *UserModTestSuite) TestTOTPBasicAuth() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	now := time.Now()
+	secret := s.enrollTOTP(token)
+	w := s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, now))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	tests := []struct {
+		name       string
+		code       string
+		statusCode int
+	}{
+		{"missing code", "", http.StatusUnauthorized},
+		{"wrong code", "000000", http.StatusUnauthorized},
+		{"current code", s.totpCode(secret, now), http.StatusOK},
+		{"current code again", s.totpCode(secret, now), http.StatusOK},
+	}
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, s.ts.URL+"/auth", nil)
+			auth := u.Email + ":" + string(testPassword)
+			r.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+			if tt.code != "" {
+				r.Header.Add(usermod.TOTPHeader, tt.code)
+			}
+			w, _ := http.DefaultClient.Do(r)
+			assert.Equal(t, tt.statusCode, w.StatusCode)
+		})
+	}
+}
+
+func (s *UserModTestSuite) TestTOTPDisable() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	now := time.Now()
+
+	w := s.totpRequest(http.MethodDelete, "/user/totp", token, "")
+	assert.Equal(s.T(), http.StatusConflict, w.StatusCode)
+
+	secret := s.enrollTOTP(token)
+	w = s.totpRequest(http.MethodPost, "/user/totp/confirm", token, s.totpCode(secret, now.Add(-30*time.Second)))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	assert.Equal(s.T(), http.StatusUnauthorized, s.loginWithTOTP(u, ""))
+
+	w = s.totpRequest(http.MethodDelete, "/user/totp", token, "000000")
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+	w = s.totpRequest(http.MethodDelete, "/user/totp", token, s.totpCode(secret, now))
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	stored, err := usermod.GetUserByID(s.db, u.ID.String())
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), stored.TOTPEnabled)
+	assert.Nil(s.T(), stored.TOTPSecret)
+	assert.Equal(s.T(), http.StatusOK, s.loginWithTOTP(u, ""))
+}
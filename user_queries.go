@@ -1,12 +1,13 @@
 package usermod
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
@@ -17,28 +18,35 @@ type User struct {
 	PhoneNumber string    `json:"phone"`
 	IsActivated bool      `json:"-"`
 	IsDeleted   bool      `json:"-"`
-	db          *sql.DB
+	// TOTPSecret is encrypted, and only in use once TOTPEnabled is set
+	TOTPSecret   []byte `json:"-"`
+	TOTPEnabled  bool   `json:"-"`
+	TOTPLastStep int64  `json:"-"`
+	// TOTPPending is an encrypted secret enrolled but not yet confirmed
+	TOTPPending []byte `json:"-"`
+	// IsDisabled is set by admins, and unlike IsActivated isn't cleared by
+	// activation tokens
+	IsDisabled bool `json:"-"`
+	store      UserStore
 }
 
+// ErrEmailTaken is returned when another user, even a deleted one, has
+// the email
+var ErrEmailTaken = errors.New("email already in use")
+
 var userTblName = "users"
 
-var userTblSQL = fmt.Sprintf(`CREATE TABLE %s (
-	id UUID PRIMARY KEY,
-	name VARCHAR(255),
-	email VARCHAR(255),
-	password TEXT,
-	phone_number VARCHAR(255),
-	is_activated BOOLEAN DEFAULT FALSE,
-	is_deleted BOOLEAN DEFAULT FALSE
-);`, userTblName)
+var userColumns = "id, name, email, password, phone_number, is_activated, is_deleted, " +
+	"totp_secret, totp_enabled, totp_last_step, totp_pending, is_disabled"
 
-func (u *User) scanInto(row *sql.Row) error {
-	return row.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.PhoneNumber, &u.IsActivated, &u.IsDeleted)
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
 }
 
-func (u *User) CreateTable() error {
-	_, err := u.db.Exec(userTblSQL)
-	return err
+func (u *User) scanInto(row scanner) error {
+	return row.Scan(&u.ID, &u.Name, &u.Email, &u.Password, &u.PhoneNumber, &u.IsActivated, &u.IsDeleted,
+		&u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep, &u.TOTPPending, &u.IsDisabled)
 }
 
 func (u *User) TableName() string {
@@ -46,12 +54,17 @@ func (u *User) TableName() string {
 }
 
 func NewUser(db *sql.DB) *User {
-	return &User{db: db}
+	return &User{store: NewSQLStore(db)}
 }
 
 func NewUserWithDetails(db *sql.DB, name, email string, password []byte) *User {
+	return NewUserInStore(NewSQLStore(db), name, email, password)
+}
+
+// NewUserInStore creates a user, not yet inserted, backed by any UserStore
+func NewUserInStore(store UserStore, name, email string, password []byte) *User {
 	return &User{
-		db:          db,
+		store:       store,
 		ID:          uuid.New(),
 		Name:        name,
 		Email:       email,
@@ -61,9 +74,9 @@ func NewUserWithDetails(db *sql.DB, name, email string, password []byte) *User {
 	}
 }
 
-func EncryptPassword(pw []byte) []byte {
-	cryptpass, _ := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
-	return cryptpass
+// EncryptPassword hashes the password with DefaultPasswordHasher
+func EncryptPassword(pw []byte) ([]byte, error) {
+	return DefaultPasswordHasher.Hash(pw)
 }
 
 func NewUserWithPhoneNumber(db *sql.DB, name, email string, password []byte, phone string) *User {
@@ -72,17 +85,18 @@ func NewUserWithPhoneNumber(db *sql.DB, name, email string, password []byte, pho
 	return u
 }
 
+// Insert hashes the user's password and stores the user
 func (u *User) Insert() error {
-
-	query := fmt.Sprintf("INSERT INTO %s VALUES ($1, $2, $3, $4, $5, $6, $7)", u.TableName())
-
-	passwd := EncryptPassword(u.Password)
-
-	stmt, err := u.db.Prepare(query)
+	passwd, err := EncryptPassword(u.Password)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(u.ID.String(), u.Name, u.Email, passwd, u.PhoneNumber, false, false)
+	stored := *u
+	stored.Password = passwd
+	stored.IsActivated = false
+	stored.IsDeleted = false
+
+	err = u.store.InsertUser(context.Background(), &stored)
 	if err != nil {
 		return err
 	}
@@ -91,48 +105,23 @@ func (u *User) Insert() error {
 }
 
 func Activate(db *sql.DB, id string) error {
-	u := User{db: db}
-	query := fmt.Sprintf(
-		`UPDATE %s SET is_activated=true WHERE id = $1`, u.TableName())
-	stmt, err := u.db.Prepare(query)
-	if err != nil {
-		return err
-	}
-
-	_, err = stmt.Exec(id)
-	if err != nil {
-		u.IsActivated = true
-	}
-	return err
+	return NewSQLStore(db).Activate(context.Background(), id)
 }
 
 func (u *User) Deactivate() error {
-	query := fmt.Sprintf(
-		`UPDATE %s SET is_activated=$1 WHERE email = $2 AND id = $3`, u.TableName())
-	stmt, err := u.db.Prepare(query)
-	if err != nil {
-		return err
-	}
-
-	_, err = stmt.Exec(false, u.Email, u.ID.String())
-	if err != nil {
+	err := u.store.Deactivate(context.Background(), u.ID.String())
+	if err == nil {
 		u.IsActivated = false
 	}
 	return err
-
 }
 
 func (u *User) ChangePassword(password []byte) error {
-	cryptpass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	query := fmt.Sprintf("UPDATE %s SET password = $1 WHERE id = $2", u.TableName())
-	stmt, err := u.db.Prepare(query)
+	cryptpass, err := EncryptPassword(password)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(cryptpass, u.ID.String())
+	err = u.store.SetPassword(context.Background(), u.ID.String(), cryptpass)
 	if err != nil {
 		return err
 	}
@@ -140,19 +129,10 @@ func (u *User) ChangePassword(password []byte) error {
 	return nil
 }
 
-func AuthenticateByEmail(db *sql.DB, email string, password []byte) (*User, error) {
-	u := User{db: db}
-	query := fmt.Sprintf("SELECT * FROM %s WHERE email = $1 AND is_activated = $2", u.TableName())
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return &u, err
-	}
-	res := stmt.QueryRow(email, true)
-	if res.Err() != nil {
-		return &u, res.Err()
-	}
-
-	err = u.scanInto(res)
+// authenticate loads the active user with the given email, and checks their
+// password
+func authenticate(ctx context.Context, store UserStore, email string, password []byte) (*User, error) {
+	u, err := store.GetActiveUserByEmail(ctx, email)
 	if err != nil {
 		return &User{}, err
 	}
@@ -161,38 +141,52 @@ func AuthenticateByEmail(db *sql.DB, email string, password []byte) (*User, erro
 	if err != nil {
 		return &User{}, err
 	}
-	return &u, err
+	return u, nil
+}
 
+func AuthenticateByEmail(db *sql.DB, email string, password []byte) (*User, error) {
+	return authenticate(context.Background(), NewSQLStore(db), email, password)
 }
 
 func AuthenticateByUID(db *sql.DB, id string, password []byte) (*User, error) {
-	u := User{db: db}
-	query := fmt.Sprintf("SELECT * FROM %s WHERE id = $1 AND is_activated = $2", u.TableName())
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return &u, err
-	}
-	res := stmt.QueryRow(id, true)
-	if res.Err() != nil {
-		return &u, res.Err()
-	}
-
-	err = u.scanInto(res)
+	u, err := NewSQLStore(db).GetUserByID(context.Background(), id)
 	if err != nil {
 		return &User{}, err
 	}
+	if !u.IsActive() {
+		return &User{}, sql.ErrNoRows
+	}
 
 	err = u.validatePassword(password)
 	if err != nil {
 		return &User{}, err
 	}
-	return &u, err
+	return u, err
+
+}
 
+// IsActive reports whether the user may authenticate, that is they have been
+// activated and have neither been soft deleted nor disabled.
+func (u *User) IsActive() bool {
+	return u.IsActivated && !u.IsDeleted && !u.IsDisabled
 }
 
+// validatePassword checks the password, and replaces a hash made by an
+// outdated algorithm or cost with one made by DefaultPasswordHasher
 func (u *User) validatePassword(password []byte) error {
-	err := bcrypt.CompareHashAndPassword(u.Password, password)
-	return err
+	rehash, err := verifyPassword(u.Password, password)
+	if err != nil || !rehash {
+		return err
+	}
+	cryptpass, err := EncryptPassword(password)
+	if err != nil {
+		return nil
+	}
+	// the old hash still works, so failing to replace it doesn't fail the login
+	if u.store != nil && u.store.SetPassword(context.Background(), u.ID.String(), cryptpass) == nil {
+		u.Password = cryptpass
+	}
+	return nil
 }
 
 // Update updates the user's details, always resetting the name,
@@ -209,25 +203,11 @@ func (u *User) Update(name, email, phone_number string) error {
 		phone_number = u.PhoneNumber
 	}
 
-	query := fmt.Sprintf("UPDATE %s SET ", u.TableName())
-	query += " name = $1, email = $2, phone_number = $3 "
-	query += "WHERE id = $4"
-
-	stmt, err := u.db.Prepare(query)
-	if err != nil {
-		return err
-	}
-
-	res, err := stmt.Exec(name, email, phone_number, u.ID.String())
+	err := u.store.UpdateUser(context.Background(), u.ID.String(), name, email, phone_number)
 	if err != nil {
 		return err
 	}
 
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		return errors.New("no rows were updated")
-	}
-
 	u.Name = name
 	u.Email = email
 	u.PhoneNumber = phone_number
@@ -236,78 +216,269 @@ func (u *User) Update(name, email, phone_number string) error {
 }
 
 func GetUserByID(db *sql.DB, id string) (*User, error) {
-	u := User{db: db}
-	query := fmt.Sprintf("SELECT * from %s where id = $1", u.TableName())
-	stmt, err := db.Prepare(query)
+	return NewSQLStore(db).GetUserByID(context.Background(), id)
+}
+
+func GetActiveUserByEmail(db *sql.DB, email string) (*User, error) {
+	return NewSQLStore(db).GetActiveUserByEmail(context.Background(), email)
+}
+
+func GetUserByEmail(db *sql.DB, email string) (*User, error) {
+	return NewSQLStore(db).GetUserByEmail(context.Background(), email)
+}
+
+func (u *User) DeleteByUID(id string) error {
+	return u.store.DeleteUser(context.Background(), id)
+}
+
+func (u *User) SoftDeleteByUID(id string) error {
+	return u.store.SoftDeleteUser(context.Background(), id)
+}
+
+func (s *SQLStore) InsertUser(ctx context.Context, u *User) error {
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", userTblName, userColumns, placeholders(12))
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
-		return &u, err
+		return err
 	}
+	_, err = stmt.ExecContext(ctx, u.ID.String(), u.Name, u.Email, u.Password, u.PhoneNumber, u.IsActivated, u.IsDeleted,
+		u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep, u.TOTPPending, u.IsDisabled)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
 
-	res := stmt.QueryRow(id)
-	if res.Err() != nil {
-		return &u, res.Err()
+func (s *SQLStore) Activate(ctx context.Context, id string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET is_activated=true WHERE id = $1`, userTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return err
 	}
-	return &u, u.scanInto(res)
+
+	_, err = stmt.ExecContext(ctx, id)
+	return err
 }
 
-func GetActiveUserByEmail(db *sql.DB, email string) (*User, error) {
-	u := User{db: db}
-	query := fmt.Sprintf("SELECT * from %s where is_activated = $1 AND email = $2", u.TableName())
-	stmt, err := u.db.Prepare(query)
+func (s *SQLStore) Deactivate(ctx context.Context, id string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET is_activated=$1 WHERE id = $2`, userTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
-		return &u, err
+		return err
 	}
 
-	res := stmt.QueryRow(true, email)
-	if res.Err() != nil {
-		return &u, res.Err()
+	_, err = stmt.ExecContext(ctx, false, id)
+	return err
+}
+
+func (s *SQLStore) SetPassword(ctx context.Context, id string, hash []byte) error {
+	query := fmt.Sprintf("UPDATE %s SET password = $1 WHERE id = $2", userTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return err
 	}
-	return &u, u.scanInto(res)
+	_, err = stmt.ExecContext(ctx, hash, id)
+	return err
+}
 
+func (s *SQLStore) UpdateUser(ctx context.Context, id, name, email, phone string) error {
+	query := fmt.Sprintf("UPDATE %s SET ", userTblName)
+	query += " name = $1, email = $2, phone_number = $3 "
+	query += "WHERE id = $4"
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.ExecContext(ctx, name, email, phone, id)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	// some drivers, such as mysql, only count rows whose values changed
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		if _, err = s.GetUserByID(ctx, id); err != nil {
+			return errors.New("no rows were updated")
+		}
+	}
+	return nil
 }
 
-func GetUserByEmail(db *sql.DB, email string) (*User, error) {
-	u := User{db: db}
-	query := fmt.Sprintf("SELECT * from %s where email = $1", u.TableName())
-	stmt, err := u.db.Prepare(query)
+// getUser runs a query selecting a single user
+func (s *SQLStore) getUser(ctx context.Context, where string, args ...any) (*User, error) {
+	u := User{store: s}
+	query := fmt.Sprintf("SELECT %s from %s where %s", userColumns, userTblName, where)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return &u, err
 	}
 
-	res := stmt.QueryRow(email)
+	res := stmt.QueryRowContext(ctx, args...)
 	if res.Err() != nil {
 		return &u, res.Err()
 	}
 	return &u, u.scanInto(res)
+}
 
+func (s *SQLStore) GetUserByID(ctx context.Context, id string) (*User, error) {
+	return s.getUser(ctx, "id = $1", id)
 }
 
-func (u *User) DeleteByUID(id string) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", u.TableName())
-	stmt, err := u.db.Prepare(query)
+func (s *SQLStore) GetActiveUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.getUser(ctx, "is_activated = $1 AND is_disabled = $2 AND email = $3", true, false, email)
+}
+
+func (s *SQLStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.getUser(ctx, "email = $1", email)
+}
+
+func (s *SQLStore) DeleteUser(ctx context.Context, id string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", userTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(id)
+	_, err = stmt.ExecContext(ctx, id)
+	return err
+}
+
+func (s *SQLStore) SoftDeleteUser(ctx context.Context, id string) error {
+	query := fmt.Sprintf("UPDATE %s set is_deleted = $1 where id = $2", userTblName)
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return err
 	}
+
+	_, err = stmt.ExecContext(ctx, true, id)
 	return err
 }
 
-func (u *User) SoftDeleteByUID(id string) error {
-	query := fmt.Sprintf("UPDATE %s set is_deleted = $1 where id = $2", u.TableName())
+func (s *SQLStore) RestoreUser(ctx context.Context, id string) error {
+	query := fmt.Sprintf("UPDATE %s set is_deleted = $1 where id = $2", userTblName)
 
-	stmt, err := u.db.Prepare(query)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(true, id)
+	_, err = stmt.ExecContext(ctx, false, id)
+	return err
+}
+
+// SetDisabled disables or re-enables the user, leaving whether they
+// activated their account alone
+func (s *SQLStore) SetDisabled(ctx context.Context, id string, disabled bool) error {
+	query := fmt.Sprintf("UPDATE %s SET is_disabled = $1 WHERE id = $2", userTblName)
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return err
 	}
 
+	_, err = stmt.ExecContext(ctx, disabled, id)
+	return err
+}
+
+// likeEscaper escapes LIKE wildcards, using ! since backslashes are treated
+// differently across databases
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// ListUsers returns a page of users matching the filter, and the total
+// number of matches.
+func (s *SQLStore) ListUsers(ctx context.Context, filter UserFilter) ([]*User, int, error) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Email != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(filter.Email)) + "%"
+		where = append(where, fmt.Sprintf("LOWER(email) LIKE %s ESCAPE '!'", arg(pattern)))
+	}
+	if filter.Name != "" {
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(filter.Name)) + "%"
+		where = append(where, fmt.Sprintf("LOWER(name) LIKE %s ESCAPE '!'", arg(pattern)))
+	}
+	if filter.Activated != nil {
+		where = append(where, "is_activated = "+arg(*filter.Activated))
+	}
+	if filter.Deleted != nil {
+		where = append(where, "is_deleted = "+arg(*filter.Deleted))
+	}
+	if filter.Disabled != nil {
+		where = append(where, "is_disabled = "+arg(*filter.Disabled))
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s%s", userTblName, clause)
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY email, id LIMIT %s OFFSET %s",
+		userColumns, userTblName, clause, arg(filter.Limit), arg(filter.Offset))
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u := User{store: s}
+		if err = u.scanInto(rows); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, &u)
+	}
+	return users, total, rows.Err()
+}
+
+// SetTOTP stores an encrypted TOTP secret, which only guards logins once
+// enabled, and clears any pending one. A nil secret removes TOTP from the
+// account. The last used step is kept, since steps only move forward
+// whatever the secret.
+func (s *SQLStore) SetTOTP(ctx context.Context, id string, secret []byte, enabled bool) error {
+	query := fmt.Sprintf("UPDATE %s SET totp_secret = $1, totp_enabled = $2, totp_pending = NULL WHERE id = $3", userTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), secret, enabled, id)
 	return err
 }
+
+// SetPendingTOTP stores an encrypted secret awaiting confirmation,
+// leaving the current one in force
+func (s *SQLStore) SetPendingTOTP(ctx context.Context, id string, secret []byte) error {
+	query := fmt.Sprintf("UPDATE %s SET totp_pending = $1 WHERE id = $2", userTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), secret, id)
+	return err
+}
+
+// ConsumeTOTPStep records the period of a used code, returning
+// ErrTOTPReplayed if it, or a later one, was already used.
+func (s *SQLStore) ConsumeTOTPStep(ctx context.Context, id string, step int64) error {
+	query := fmt.Sprintf("UPDATE %s SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $3", userTblName)
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), step, id, step)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrTOTPReplayed
+	}
+	return nil
+}
@@ -1,38 +1,403 @@
 package usermod
 
 import (
-	"database/sql"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
 type Router struct {
-	db *sql.DB
+	store     Store
+	sessions  SessionStore
+	notifier  Notifier
+	templates map[Token]*MessageTemplate
+	webAuthn  *WebAuthnConfig
+	oidc      *OIDCProviderConfig
+	providers map[string]*identityProvider
+	tokens    *TokenConfig
+	lockout   *Lockout
+	limits    *RateLimits
+	policy    *PasswordPolicy
 }
 
-// NewRouter should be mounted to the correct location within your application
-func NewRouter(db *sql.DB) *chi.Mux {
-	rr := Router{db: db}
+// RouterOption configures optional behaviour of the router
+type RouterOption func(*Router)
+
+// WithSessionStore replaces the default SQL session store
+func WithSessionStore(store SessionStore) RouterOption {
+	return func(rr *Router) {
+		rr.sessions = store
+	}
+}
+
+// WithNotifier delivers activation and password reset tokens to users as
+// they are issued
+func WithNotifier(n Notifier) RouterOption {
+	return func(rr *Router) {
+		rr.notifier = n
+	}
+}
+
+// WithTemplates replaces DefaultTemplates for rendering notifications
+func WithTemplates(templates map[Token]*MessageTemplate) RouterOption {
+	return func(rr *Router) {
+		rr.templates = templates
+	}
+}
+
+// WithWebAuthn enables passkey registration and login for the relying
+// party described by cfg
+func WithWebAuthn(cfg WebAuthnConfig) RouterOption {
+	return func(rr *Router) {
+		rand.Read(cfg.decoyKey[:])
+		rr.webAuthn = &cfg
+	}
+}
+
+// WithOIDCProvider makes the router an OpenID Connect provider for the
+// registered OAuth clients
+func WithOIDCProvider(cfg OIDCProviderConfig) RouterOption {
+	return func(rr *Router) {
+		rr.oidc = &cfg
+	}
+}
+
+// WithIdentityProvider lets users log in with an external OpenID Connect
+// provider. It can be given once per provider.
+func WithIdentityProvider(cfg IdentityProviderConfig) RouterOption {
+	return func(rr *Router) {
+		rr.providers[cfg.Name] = newIdentityProvider(cfg)
+	}
+}
+
+// WithTokenConfig signs access tokens with the given keys, in place of
+// TokenConfigFromEnv
+func WithTokenConfig(cfg *TokenConfig) RouterOption {
+	return func(rr *Router) {
+		rr.tokens = cfg
+	}
+}
+
+// WithLockout replaces the default lockout of failed logins, which keeps
+// its counters in the store. A nil lockout disables it.
+func WithLockout(l *Lockout) RouterOption {
+	return func(rr *Router) {
+		rr.lockout = l
+	}
+}
+
+// WithRateLimits replaces the default throttling of the unauthenticated
+// routes, which counts in memory. A nil RateLimits disables it.
+func WithRateLimits(l *RateLimits) RouterOption {
+	return func(rr *Router) {
+		rr.limits = l
+	}
+}
+
+// WithPasswordPolicy replaces NewPasswordPolicy as the policy for new
+// passwords. A nil policy accepts any password.
+func WithPasswordPolicy(p *PasswordPolicy) RouterOption {
+	return func(rr *Router) {
+		rr.policy = p
+	}
+}
+
+// NewRouter should be mounted to the correct location within your application.
+// Without WithTokenConfig it panics if TokenConfigFromEnv fails.
+func NewRouter(store Store, opts ...RouterOption) *chi.Mux {
+	rr := Router{
+		store:     store,
+		sessions:  store.Sessions(),
+		templates: DefaultTemplates,
+		providers: map[string]*identityProvider{},
+		lockout:   NewLockout(store.LoginAttempts()),
+		limits:    NewRateLimits(NewMemoryRateLimitStore()),
+		policy:    NewPasswordPolicy(),
+	}
+	for _, opt := range opts {
+		opt(&rr)
+	}
+	if rr.tokens == nil {
+		rr.tokens = mustTokenConfigFromEnv()
+	}
+	if rr.lockout != nil && rr.lockout.OnLock == nil {
+		l := *rr.lockout
+		l.OnLock = rr.notifyLocked
+		rr.lockout = &l
+	}
+	authenticated := Authenticated(store, rr.sessions, rr.tokens, rr.lockout)
+	auth := func(next http.Handler) http.Handler {
+		return authenticated(RequireScope(AccountScope)(next))
+	}
+	limits := rr.limits
+	if limits == nil {
+		// zero limits allow every request
+		limits = &RateLimits{}
+	}
+
+	// adding a way to sign in, or replacing one, needs the user to have
+	// proved who they are lately, as a stolen token could otherwise
+	// outlive a password change
+	recent := RequireRecentAuth(RecentAuthMaxAge)
+
 	r := chi.NewRouter()
-	r.Post("/user", rr.CreateUser)
-	r.With(BasicAuth(db)).Get("/user", rr.Get)
-	r.With(BasicAuth(db)).Patch("/user", rr.UpdateUser)
-	r.With(BasicAuth(db)).Delete("/user", rr.DeleteUser)
-	r.With(BasicAuth(db)).Post("/change_password", rr.ChangePassword)
-	r.Get("/user/activate", rr.ActivateUser)
-	r.Post("/user/forgot_password", rr.ForgotPassword)
+	r.With(limits.throttle("create_user", limits.CreateUserByIP, limits.CreateUserByEmail)).Post("/user", rr.CreateUser)
+	r.Post("/login", rr.Login)
+	r.With(limits.throttle("magic_link", limits.MagicLinkByIP, limits.MagicLinkByEmail)).Post("/login/magic", rr.SendMagicLink)
+	r.Get("/login/magic", rr.MagicLinkLogin)
+	r.Post("/logout", rr.Logout)
+	r.Post("/token/refresh", rr.RefreshToken)
+	r.Get("/.well-known/jwks.json", rr.JWKS)
+	r.With(auth).Get("/user", rr.Get)
+	r.With(auth).Patch("/user", rr.UpdateUser)
+	r.With(auth, recent).Delete("/user", rr.DeleteUser)
+	r.With(auth).Post("/user/reauthenticate", rr.Reauthenticate)
+	r.With(auth).Post("/change_password", rr.ChangePassword)
+	r.With(limits.throttle("activate", limits.ActivateByIP, RateLimit{})).Get("/user/activate", rr.ActivateUser)
+	r.With(limits.throttle("forgot_password", limits.ForgotPasswordByIP, limits.ForgotPasswordByEmail)).
+		Post("/user/forgot_password", rr.ForgotPassword)
+	r.Post("/user/reset_password", rr.ResetPassword)
+	r.With(auth, recent).Post("/user/totp/enroll", rr.EnrollTOTP)
+	r.With(auth).Post("/user/totp/confirm", rr.ConfirmTOTP)
+	r.With(auth).Delete("/user/totp", rr.DisableTOTP)
+	r.With(auth, recent).Post("/user/recovery_codes", rr.GenerateRecoveryCodes)
+	r.With(auth, recent).Post("/user/api_keys", rr.CreateAPIKey)
+	r.With(auth).Get("/user/api_keys", rr.ListAPIKeys)
+	r.With(auth).Delete("/user/api_keys/{id}", rr.DeleteAPIKey)
+	r.With(limits.throttle("recover", limits.RecoverByIP, limits.RecoverByEmail)).Post("/user/recover", rr.Recover)
+	if rr.webAuthn != nil {
+		r.With(auth, recent).Post("/webauthn/register/begin", rr.BeginWebAuthnRegistration)
+		r.With(auth, recent).Post("/webauthn/register/finish", rr.FinishWebAuthnRegistration)
+		r.With(limits.throttle("webauthn_login", limits.WebAuthnLoginByIP, limits.WebAuthnLoginByEmail)).
+			Post("/webauthn/login/begin", rr.BeginWebAuthnLogin)
+		r.Post("/webauthn/login/finish", rr.FinishWebAuthnLogin)
+	}
+	if rr.oidc != nil {
+		r.Get("/.well-known/openid-configuration", rr.OIDCDiscovery)
+		r.With(rr.oidcLogin(auth)).Get("/oauth/authorize", rr.Authorize)
+		r.Post("/oauth/token", rr.OAuthToken)
+		r.With(OAuthTokenAuth(store, rr.tokens)).Get("/oauth/userinfo", rr.UserInfo)
+		r.With(OAuthTokenAuth(store, rr.tokens)).Post("/oauth/userinfo", rr.UserInfo)
+	}
+	if len(rr.providers) > 0 {
+		r.Get("/login/{provider}", rr.IdentityLogin)
+		r.Get("/login/{provider}/callback", rr.IdentityCallback)
+		r.Post("/login/{provider}/totp", rr.IdentityTOTP)
+		r.With(auth).Get("/user/identities", rr.ListIdentities)
+		r.With(auth, recent).Get("/user/identities/{provider}/link", rr.LinkIdentity)
+		r.With(auth).Delete("/user/identities/{provider}", rr.UnlinkIdentity)
+	}
+	r.Mount("/admin", rr.adminRouter(auth))
 
 	return r
 }
 
+// UserJSON is the authenticated user's view of their account
+type UserJSON struct {
+	*User
+	RecoveryCodes int `json:"recovery_codes"`
+}
+
+type LoginJSON struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	TOTPCode string `json:"totp_code,omitempty"`
+}
+
+type TokenJSON struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type RefreshJSON struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// writeTokens issues an access token for the user, alongside the refresh
+// token. authTime is when the user logged in, or zero when unknown.
+func (rr *Router) writeTokens(w http.ResponseWriter, r *http.Request, u *User, rt *RefreshToken, authTime time.Time) {
+	roles, err := rr.store.GetUserRoles(r.Context(), u.ID.String())
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	token, err := rr.tokens.createToken(u, roles, authTime)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(TokenJSON{Token: token, RefreshToken: rt.ID.String()})
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// JWKS publishes the public keys that verify access tokens. HMAC keys are
+// left out, so the set is empty unless asymmetric keys are configured.
+func (rr *Router) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=300")
+	writeJSON(w, rr.tokens.Keys.JWKS())
+}
+
+// Login exchanges an email and password for a signed JWT
+func (rr *Router) Login(w http.ResponseWriter, r *http.Request) {
+	l := LoginJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &l)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	u, err := rr.lockout.login(r.Context(), rr.store, clientIP(r), l.Email, []byte(l.Password), l.TOTPCode, true)
+	var locked *LockoutError
+	if errors.As(err, &locked) {
+		writeLockoutError(w, locked)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	rr.startSession(w, r, u)
+}
+
+// startSession logs an authenticated user in, setting the session cookie
+// and responding with an access and refresh token
+func (rr *Router) startSession(w http.ResponseWriter, r *http.Request, u *User) {
+	rt := NewRefreshTokenInStore(rr.store, u.ID, uuid.New())
+	err := rt.Insert()
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	sess, err := rr.sessions.Create(r.Context(), u.ID, time.Now().Add(SessionDefaultExpiry))
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, sess)
+	rr.writeTokens(w, r, u, rt, time.Unix(sess.AuthTime, 0))
+}
+
+// Logout ends the session identified by the session cookie, and revokes
+// the bearer token, if any
+func (rr *Router) Logout(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err == nil && cookie.Value != "" {
+		err = rr.sessions.Delete(r.Context(), cookie.Value)
+		if err != nil {
+			jsonError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if claims, err := rr.tokens.ParseToken(bearer); err == nil {
+			err = rr.tokens.RevokeToken(r.Context(), claims)
+			if err != nil {
+				jsonError(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	clearSessionCookie(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+// RefreshToken exchanges a refresh token for a new access token, rotating
+// the refresh token in the process
+func (rr *Router) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	rj := RefreshJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &rj)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	if rj.RefreshToken == "" {
+		jsonErrorFromString(w, "refresh token must be specified", http.StatusBadRequest)
+		return
+	}
+
+	u, rt, err := rotateRefreshToken(r.Context(), rr.store, rj.RefreshToken)
+	if err == ErrRefreshTokenInvalid || err == ErrRefreshTokenReused {
+		jsonError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// refresh tokens don't remember the login, so these can't step up
+	rr.writeTokens(w, r, u, rt, time.Time{})
+}
+
+// notify tells the user about a newly issued token, if a notifier is set
+func (rr *Router) notify(ctx context.Context, u *User, t *UserOperationToken) error {
+	if rr.notifier == nil {
+		return nil
+	}
+	notifications, err := RenderNotifications(rr.templates, u, t)
+	if err != nil {
+		return err
+	}
+	return rr.send(ctx, notifications)
+}
+
+// notifyLocked tells the user their account was locked, and until when
+func (rr *Router) notifyLocked(ctx context.Context, u *User, until time.Time) error {
+	if rr.notifier == nil {
+		return nil
+	}
+	notifications, err := renderNotifications(rr.templates, AccountLockedNotice, &TemplateData{User: u, Expires: until})
+	if err != nil {
+		return err
+	}
+	return rr.send(ctx, notifications)
+}
+
+func (rr *Router) send(ctx context.Context, notifications []*Notification) error {
+	for _, n := range notifications {
+		if err := rr.notifier.Notify(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (rr *Router) Get(w http.ResponseWriter, r *http.Request) {
 
 	uid := r.Context().Value(CTX_USER_KEY).(*User)
 
-	b, err := json.Marshal(uid)
+	remaining, err := rr.store.CountRecoveryCodes(r.Context(), uid.ID.String())
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(UserJSON{User: uid, RecoveryCodes: remaining})
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
@@ -44,41 +409,69 @@ func (rr *Router) Get(w http.ResponseWriter, r *http.Request) {
 // DelteUser will mark a user as soft deleted in the database
 func (rr *Router) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	uid := r.Context().Value(CTX_UID_KEY).(string)
-	u := User{db: rr.db}
+	u := User{store: rr.store}
 	err := u.SoftDeleteByUID(uid)
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
 	}
+	err = rr.tokens.RevokeUserTokens(r.Context(), uid)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (rr *Router) CreateUser(w http.ResponseWriter, r *http.Request) {
-	u := User{db: rr.db}
+// CreateUserJSON registers a user, whose password must meet the router's
+// password policy
+type CreateUserJSON struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+	Password string `json:"password"`
+}
 
+func (rr *Router) CreateUser(w http.ResponseWriter, r *http.Request) {
+	cu := CreateUserJSON{}
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
 	}
-	err = json.Unmarshal(bytes, &u)
+	err = json.Unmarshal(bytes, &cu)
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	u := NewUserInStore(rr.store, cu.Name, cu.Email, []byte(cu.Password))
+	u.PhoneNumber = cu.Phone
+	if !rr.checkPassword(w, r, u, u.Password) {
+		return
+	}
 	err = u.Insert()
+	if err == ErrEmailTaken {
+		jsonError(w, err, http.StatusConflict)
+		return
+	}
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	uot := NewUserOperationTokenDefaultExpires(rr.db, u.ID, ActivationToken)
+	uot := NewUserOperationTokenInStore(rr.store, u.ID, ActivationToken, time.Now().Add(TokenDefaultExpiry))
 	err = uot.Insert()
 	if err != nil {
 		jsonError(w, err, http.StatusBadRequest)
 		return
 	}
+
+	err = rr.notify(r.Context(), u, uot)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -109,13 +502,22 @@ func (rr *Router) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	if uu.Name != "" {
 		name = uu.Name
 	}
-	if uu.Email != "" {
+	if uu.Email != "" && uu.Email != u.Email {
+		// the email receives password resets, so changing it takes the account
+		if !recentlyAuthenticated(r, RecentAuthMaxAge) {
+			jsonError(w, ErrReauthenticationRequired, http.StatusUnauthorized)
+			return
+		}
 		email = uu.Email
 	}
 	if uu.Phone != "" {
 		phone = uu.Phone
 	}
 	err = u.Update(name, email, phone)
+	if err == ErrEmailTaken {
+		jsonError(w, err, http.StatusConflict)
+		return
+	}
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
@@ -143,35 +545,242 @@ func (rr *Router) ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.ChangePassword(uu.NewPassword)
+	err = rr.lockout.Guard(r.Context(), u, clientIP(r), func() error {
+		if u.validatePassword(uu.OldPassword) != nil {
+			return ErrInvalidCredentials
+		}
+		return nil
+	})
+	if err != nil {
+		writeReauthenticationError(w, err)
+		return
+	}
+	if !rr.checkPassword(w, r, u, uu.NewPassword) {
+		return
+	}
+	err = rr.setPassword(r.Context(), u, uu.NewPassword)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = rr.signOutEverywhere(r.Context(), u.ID)
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
 	}
+
+	// a caller signed in by session or token stays signed in, on new ones
+	_, session := r.Context().Value(CTX_SESSION_KEY).(*Session)
+	_, token := r.Context().Value(CTX_CLAIMS_KEY).(*Claims)
+	if session || token {
+		rr.startSession(w, r, u)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// ReauthenticateJSON confirms the signed in user's password, and their TOTP
+// code when enabled
+type ReauthenticateJSON struct {
+	Password string `json:"password"`
+	TOTPCode string `json:"totp_code,omitempty"`
+}
+
+// Reauthenticate repeats the login of a signed in user, for routes behind
+// RequireRecentAuth. The current session is replaced, and the response is
+// that of Login.
+func (rr *Router) Reauthenticate(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+
+	rj := ReauthenticateJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &rj)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	_, err = rr.lockout.login(r.Context(), rr.store, clientIP(r), u.Email, []byte(rj.Password), rj.TOTPCode, true)
+	if err != nil {
+		writeReauthenticationError(w, err)
+		return
+	}
+	if sess, ok := r.Context().Value(CTX_SESSION_KEY).(*Session); ok {
+		err = rr.sessions.Delete(r.Context(), sess.ID)
+		if err != nil {
+			jsonError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	rr.startSession(w, r, u)
+}
+
+// writeReauthenticationError responds to a signed in user who failed to
+// confirm their password, as BasicAuth does
+func writeReauthenticationError(w http.ResponseWriter, err error) {
+	var locked *LockoutError
+	switch {
+	case errors.As(err, &locked):
+		writeLockoutError(w, locked)
+	case err == ErrInvalidCredentials:
+		jsonError(w, err, http.StatusForbidden)
+	default:
+		jsonError(w, err, http.StatusUnauthorized)
+	}
+}
+
 func (rr *Router) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	email := r.URL.Query().Get("email")
 	if email == "" {
 		jsonErrorFromString(w, "no email specified", http.StatusBadRequest)
 		return
 	}
-	u, err := GetActiveUserByEmail(rr.db, email)
+	u, err := rr.store.GetActiveUserByEmail(r.Context(), email)
 	if err != nil {
 		jsonError(w, err, http.StatusNotFound)
 		return
 	}
 
-	uot := NewUserOperationTokenDefaultExpires(rr.db, u.ID, ForgotPaswordToken)
+	uot := NewUserOperationTokenInStore(rr.store, u.ID, ForgotPaswordToken, time.Now().Add(TokenDefaultExpiry))
 	err = uot.Insert()
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
 	}
+
+	err = rr.notify(r.Context(), u, uot)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+type ResetPasswordJSON struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetPassword completes the forgot password flow, consuming the token
+// and logging the user out everywhere
+func (rr *Router) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	rp := ResetPasswordJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &rp)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	if rp.Token == "" || rp.Password == "" {
+		jsonErrorFromString(w, "token and password must be specified", http.StatusBadRequest)
+		return
+	}
+
+	// the password is checked before the token is used up
+	t, err := rr.store.GetToken(r.Context(), rp.Token)
+	if err != nil || t.TokenType != ForgotPaswordToken {
+		jsonErrorFromString(w, "Invalid token", http.StatusNotFound)
+		return
+	}
+	u, err := rr.store.GetUserByID(r.Context(), t.UserID.String())
+	if err != nil || !u.IsActive() {
+		jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+		return
+	}
+	if !rr.checkPassword(w, r, u, []byte(rp.Password)) {
+		return
+	}
+
+	uid, err := rr.store.ConsumeToken(r.Context(), rp.Token, ForgotPaswordToken)
+	if err != nil {
+		jsonErrorFromString(w, "Invalid token", http.StatusNotFound)
+		return
+	}
+
+	err = rr.setPassword(r.Context(), u, []byte(rp.Password))
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = rr.signOutEverywhere(r.Context(), uid)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// proving control of the email lifts a lockout
+	err = rr.lockout.Unlock(r.Context(), u)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkPassword applies the password policy to a new password for u,
+// responding with its violations when it fails
+func (rr *Router) checkPassword(w http.ResponseWriter, r *http.Request, u *User, password []byte) bool {
+	if rr.policy == nil {
+		return true
+	}
+	err := rr.policy.Validate(password, u)
+	if err == nil {
+		err = rr.policy.CheckBreached(r.Context(), password)
+	}
+	if err == nil {
+		err = rr.policy.CheckHistory(r.Context(), rr.store, u, password)
+	}
+	var rejected *PasswordPolicyError
+	if errors.As(err, &rejected) {
+		writePasswordError(w, rejected)
+		return false
+	}
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// setPassword changes the user's password, moving the old one to their
+// history when the policy keeps one
+func (rr *Router) setPassword(ctx context.Context, u *User, password []byte) error {
+	old := u.Password
+	if err := u.ChangePassword(password); err != nil {
+		return err
+	}
+	if rr.policy == nil || rr.policy.History <= 0 || len(old) == 0 {
+		return nil
+	}
+	return rr.store.AddPasswordHistory(ctx, u.ID.String(), old, rr.policy.History)
+}
+
+// signOutEverywhere revokes the user's refresh tokens, sessions and any
+// outstanding password reset tokens, after their password was reset. API
+// keys and passkeys are credentials of their own and survive it; since
+// adding either requires a recent login, a stolen token can't leave one
+// behind, and users revoke keys under /user/api_keys.
+func (rr *Router) signOutEverywhere(ctx context.Context, uid uuid.UUID) error {
+	if err := rr.store.RevokeUserRefreshTokens(ctx, uid.String()); err != nil {
+		return err
+	}
+	if err := rr.tokens.RevokeUserTokens(ctx, uid.String()); err != nil {
+		return err
+	}
+	if err := rr.sessions.DeleteUserSessions(ctx, uid); err != nil {
+		return err
+	}
+	return rr.store.InvalidateUserTokens(ctx, uid.String(), ForgotPaswordToken)
+}
+
 func (rr *Router) ActivateUser(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 
@@ -180,13 +789,13 @@ func (rr *Router) ActivateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uid, err := MarkTokenAsUsed(rr.db, token)
+	uid, err := rr.store.ConsumeToken(r.Context(), token, ActivationToken)
 	if err != nil {
 		jsonErrorFromString(w, "Invalid token", http.StatusNotFound)
 		return
 	}
 
-	err = Activate(rr.db, uid.String())
+	err = rr.store.Activate(r.Context(), uid.String())
 	if err != nil {
 		jsonError(w, err, http.StatusInternalServerError)
 		return
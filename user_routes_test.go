@@ -2,6 +2,7 @@ package usermod_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/chayim/usermod"
 	"github.com/stretchr/testify/assert"
@@ -20,9 +22,9 @@ func (s *UserModTestSuite) TestCreateUserRoute() {
 
 	url := s.ts.URL + endpoint
 
-	u := usermod.User{Name: "Chayim",
+	u := usermod.CreateUserJSON{Name: "Chayim",
 		Email:    "c@ummmfoo.com",
-		Password: []byte("password!!"),
+		Password: "correct horse battery",
 	}
 
 	b, _ := json.Marshal(u)
@@ -36,7 +38,7 @@ func (s *UserModTestSuite) TestCreateUserRoute() {
 	found, err := usermod.GetUserByEmail(s.db, u.Email)
 	assert.Nil(s.T(), err)
 	assert.Equal(s.T(), u.Name, found.Name)
-	assert.NotEqual(s.T(), u.Password, found.Password)
+	assert.NotEqual(s.T(), []byte(u.Password), found.Password)
 }
 
 func (s *UserModTestSuite) TestGetUserRoute() {
@@ -108,16 +110,24 @@ func (s *UserModTestSuite) TestChangePasswordRoute() {
 	u := s.newActivatedUser()
 	url := s.ts.URL + "/api/change_password"
 
-	// is this possible?
-	uu := usermod.PasswordJSON{OldPassword: testPassword, NewPassword: []byte("thisisnewyou")}
-	b, _ := json.Marshal(uu)
-	reader := bytes.NewReader(b)
-
-	r, _ := http.NewRequest(http.MethodPost, url, reader)
 	auth := u.Email + ":" + string(testPassword)
 	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+
+	// the current password must be confirmed
+	wrong := usermod.PasswordJSON{OldPassword: []byte("notthepassword"), NewPassword: []byte("thisisnewyou")}
+	b, _ := json.Marshal(wrong)
+	r, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
 	r.Header.Add("Authorization", basicAuth)
 	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusForbidden, w.StatusCode)
+	_, err := usermod.AuthenticateByEmail(s.db, u.Email, testPassword)
+	assert.Nil(s.T(), err)
+
+	uu := usermod.PasswordJSON{OldPassword: testPassword, NewPassword: []byte("thisisnewyou")}
+	b, _ = json.Marshal(uu)
+	r, _ = http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	r.Header.Add("Authorization", basicAuth)
+	w, _ = http.DefaultClient.Do(r)
 	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
 
 	u2, err := usermod.AuthenticateByEmail(s.db, u.Email, uu.NewPassword)
@@ -195,3 +205,258 @@ func (s *UserModTestSuite) TestForgotPassword() {
 	}
 
 }
+
+func (s *UserModTestSuite) login(u *usermod.User, password []byte) string {
+	return s.loginAt(s.ts.URL+"/api", u, password)
+}
+
+// loginAt logs in to the router mounted at base
+func (s *UserModTestSuite) loginAt(base string, u *usermod.User, password []byte) string {
+	l := usermod.LoginJSON{Email: u.Email, Password: string(password)}
+	b, _ := json.Marshal(l)
+	r, _ := http.NewRequest(http.MethodPost, base+"/login", bytes.NewReader(b))
+	w, _ := http.DefaultClient.Do(r)
+	if w.StatusCode != http.StatusOK {
+		return ""
+	}
+	tok := usermod.TokenJSON{}
+	json.NewDecoder(w.Body).Decode(&tok)
+	return tok.Token
+}
+
+func (s *UserModTestSuite) TestLoginRoute() {
+	u := s.newActivatedUser()
+
+	assert.Equal(s.T(), "", s.login(u, []byte("notthepassword")))
+
+	token := s.login(u, testPassword)
+	assert.NotEqual(s.T(), "", token)
+
+	tests := []struct {
+		name       string
+		url        string
+		header     string
+		statusCode int
+	}{{
+		name:       "no header",
+		url:        s.ts.URL + "/auth2",
+		header:     "",
+		statusCode: http.StatusUnauthorized,
+	}, {
+		name:       "bad token",
+		url:        s.ts.URL + "/auth2",
+		header:     "Bearer notatoken",
+		statusCode: http.StatusUnauthorized,
+	}, {
+		name:       "middleware",
+		url:        s.ts.URL + "/auth2",
+		header:     "Bearer " + token,
+		statusCode: http.StatusOK,
+	}, {
+		name:       "user route",
+		url:        s.ts.URL + endpoint,
+		header:     "Bearer " + token,
+		statusCode: http.StatusOK,
+	}}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+			if tc.header != "" {
+				r.Header.Add("Authorization", tc.header)
+			}
+			w, _ := http.DefaultClient.Do(r)
+			assert.Equal(t, tc.statusCode, w.StatusCode)
+		})
+	}
+
+	// soft deleted users lose access with their outstanding tokens
+	err := u.SoftDeleteByUID(u.ID.String())
+	assert.Nil(s.T(), err)
+	r, _ := http.NewRequest(http.MethodGet, s.ts.URL+endpoint, nil)
+	r.Header.Add("Authorization", "Bearer "+token)
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusForbidden, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestRefreshTokenRoute() {
+	u := s.newActivatedUser()
+	url := s.ts.URL + "/api/token/refresh"
+
+	l := usermod.LoginJSON{Email: u.Email, Password: string(testPassword)}
+	b, _ := json.Marshal(l)
+	r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/login", bytes.NewReader(b))
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	tok := usermod.TokenJSON{}
+	json.NewDecoder(w.Body).Decode(&tok)
+	assert.NotEqual(s.T(), "", tok.RefreshToken)
+
+	refresh := func(token string) (int, usermod.TokenJSON) {
+		b, _ := json.Marshal(usermod.RefreshJSON{RefreshToken: token})
+		r, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		w, _ := http.DefaultClient.Do(r)
+		res := usermod.TokenJSON{}
+		json.NewDecoder(w.Body).Decode(&res)
+		return w.StatusCode, res
+	}
+
+	code, _ := refresh("")
+	assert.Equal(s.T(), http.StatusBadRequest, code)
+
+	code, rotated := refresh(tok.RefreshToken)
+	assert.Equal(s.T(), http.StatusOK, code)
+	assert.NotEqual(s.T(), "", rotated.Token)
+	assert.NotEqual(s.T(), tok.RefreshToken, rotated.RefreshToken)
+
+	// replaying the original token revokes the rotated one as well
+	code, _ = refresh(tok.RefreshToken)
+	assert.Equal(s.T(), http.StatusUnauthorized, code)
+	code, _ = refresh(rotated.RefreshToken)
+	assert.Equal(s.T(), http.StatusUnauthorized, code)
+}
+
+func (s *UserModTestSuite) TestSessionLoginLogout() {
+	u := s.newActivatedUser()
+
+	l := usermod.LoginJSON{Email: u.Email, Password: string(testPassword)}
+	b, _ := json.Marshal(l)
+	r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/login", bytes.NewReader(b))
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	var cookie *http.Cookie
+	for _, c := range w.Cookies() {
+		if c.Name == usermod.SessionCookieName {
+			cookie = c
+		}
+	}
+	assert.NotNil(s.T(), cookie)
+	assert.True(s.T(), cookie.HttpOnly)
+
+	r, _ = http.NewRequest(http.MethodGet, s.ts.URL+endpoint, nil)
+	r.AddCookie(cookie)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+	body, _ := io.ReadAll(w.Body)
+	assert.True(s.T(), strings.Contains(string(body), u.Email))
+
+	r, _ = http.NewRequest(http.MethodPost, s.ts.URL+"/api/logout", nil)
+	r.AddCookie(cookie)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	r, _ = http.NewRequest(http.MethodGet, s.ts.URL+endpoint, nil)
+	r.AddCookie(cookie)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusUnauthorized, w.StatusCode)
+}
+
+func (s *UserModTestSuite) TestResetPasswordRoute() {
+	u := s.newActivatedUser()
+	url := s.ts.URL + "/api/user/reset_password"
+
+	token := s.newUserOperationsToken(u)
+	other := s.newUserOperationsToken(u)
+	activation := usermod.NewUserOperationTokenDefaultExpires(s.db, u.ID, usermod.ActivationToken)
+	assert.Nil(s.T(), activation.Insert())
+	refresh := s.newRefreshToken(u)
+	sessions := usermod.NewSQLSessionStore(s.db)
+	sess, err := sessions.Create(context.Background(), u.ID, time.Now().Add(time.Hour))
+	assert.Nil(s.T(), err)
+
+	tests := []struct {
+		name       string
+		token      string
+		password   string
+		statusCode int
+	}{{
+		name:       "no token",
+		token:      "",
+		password:   "newpassword",
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "no password",
+		token:      token.ID.String(),
+		password:   "",
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "wrong token type",
+		token:      activation.ID.String(),
+		password:   "newpassword",
+		statusCode: http.StatusNotFound,
+	}, {
+		name:       "works",
+		token:      token.ID.String(),
+		password:   "newpassword",
+		statusCode: http.StatusOK,
+	}, {
+		name:       "token reused",
+		token:      token.ID.String(),
+		password:   "anotherpassword",
+		statusCode: http.StatusNotFound,
+	}, {
+		name:       "other outstanding token",
+		token:      other.ID.String(),
+		password:   "anotherpassword",
+		statusCode: http.StatusNotFound,
+	}}
+	for _, tc := range tests {
+		s.T().Run(tc.name, func(t *testing.T) {
+			b, _ := json.Marshal(usermod.ResetPasswordJSON{Token: tc.token, Password: tc.password})
+			r, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+			w, _ := http.DefaultClient.Do(r)
+			assert.Equal(t, tc.statusCode, w.StatusCode)
+		})
+	}
+
+	_, err = usermod.AuthenticateByEmail(s.db, u.Email, []byte("newpassword"))
+	assert.Nil(s.T(), err)
+
+	_, _, err = usermod.RotateRefreshToken(s.db, refresh.ID.String())
+	assert.Equal(s.T(), usermod.ErrRefreshTokenInvalid, err)
+	_, err = sessions.Get(context.Background(), sess.ID)
+	assert.Equal(s.T(), usermod.ErrSessionNotFound, err)
+}
+
+func (s *UserModTestSuite) TestTokenNotifications() {
+	u := usermod.CreateUserJSON{Name: "Chayim", Email: "c@ummmfoo.com", Password: "correct horse battery"}
+	b, _ := json.Marshal(u)
+	r, _ := http.NewRequest(http.MethodPost, s.ts.URL+endpoint, bytes.NewReader(b))
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusCreated, w.StatusCode)
+
+	n, ok := s.notifier.Last()
+	assert.True(s.T(), ok)
+	assert.Equal(s.T(), usermod.ActivationToken, n.TokenType)
+	assert.Equal(s.T(), u.Email, n.To)
+
+	// the delivered token activates the account
+	token := strings.TrimSpace(strings.Split(strings.Split(n.Text, "account: ")[1], "\n")[0])
+	r, _ = http.NewRequest(http.MethodGet, s.ts.URL+"/api/user/activate?token="+token, nil)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	r, _ = http.NewRequest(http.MethodPost, s.ts.URL+"/api/user/forgot_password?email="+u.Email, nil)
+	w, _ = http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	n, _ = s.notifier.Last()
+	assert.Equal(s.T(), usermod.ForgotPaswordToken, n.TokenType)
+	assert.Equal(s.T(), 2, len(s.notifier.Notifications()))
+}
+
+func (s *UserModTestSuite) TestCreateUserEmailTaken() {
+	create := func(email string) int {
+		b, _ := json.Marshal(usermod.CreateUserJSON{Name: "Chayim", Email: email, Password: "correct horse battery"})
+		w, _ := http.Post(s.ts.URL+endpoint, "application/json", bytes.NewReader(b))
+		return w.StatusCode
+	}
+	assert.Equal(s.T(), http.StatusCreated, create("taken@ummmfoo.com"))
+	assert.Equal(s.T(), http.StatusConflict, create("taken@ummmfoo.com"))
+
+	// nor can another user change to it
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	w := s.authedRequest(http.MethodPatch, "/user", token, nil, usermod.UpdateJSON{Email: "taken@ummmfoo.com"})
+	assert.Equal(s.T(), http.StatusConflict, w.StatusCode)
+}
@@ -1,6 +1,7 @@
 package usermod
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"time"
@@ -13,6 +14,12 @@ type Token int
 const (
 	ForgotPaswordToken Token = iota
 	ActivationToken
+	WebAuthnRegistrationToken
+	WebAuthnLoginToken
+	MagicLinkToken
+	// AccountLockedNotice is never issued; it names the notification sent
+	// when the lockout locks an account
+	AccountLockedNotice
 )
 
 // Antipattern, this relies on email and not the foreign eky to user
@@ -23,43 +30,41 @@ type UserOperationToken struct {
 	Expiry    int64     `json:"-"`
 	TokenType Token     `json:"tokenType"`
 	Used      bool      `json:"-"`
-	db        *sql.DB
+	store     TokenStore
 }
 
 var TokenDefaultExpiry = time.Hour * 48 // dfeault expire 48 hours
+
+// MagicLinkDefaultExpiry is kept short, as the token logs the user in
+var MagicLinkDefaultExpiry = time.Minute * 15
 var userOpsTokenTblName = "user_ops_tokens"
-var userOpsTokenTblSQL = fmt.Sprintf(`CREATE TABLE %s (
-	id UUID PRIMARY KEY,
-	user_id UUID,
-	expiry int,
-	token_type int,
-	used BOOLEAN DEFAULT FALSE
-);`, userOpsTokenTblName)
+
+var userOpsTokenColumns = "id, user_id, expiry, token_type, used"
 
 func NewUserOperationToken(db *sql.DB) *UserOperationToken {
-	return &UserOperationToken{db: db}
+	return &UserOperationToken{store: NewSQLStore(db)}
 }
 
 func NewUserOperationTokenWithExpires(db *sql.DB, user uuid.UUID, tokenType Token, expires time.Time) *UserOperationToken {
-	return &UserOperationToken{
-		ID:        uuid.New(),
-		UserID:    user,
-		TokenType: tokenType,
-		db:        db,
-		Expiry:    expires.Unix(),
-	}
+	return NewUserOperationTokenInStore(NewSQLStore(db), user, tokenType, expires)
 }
 
 func NewUserOperationTokenDefaultExpires(db *sql.DB, user uuid.UUID, tokenType Token) *UserOperationToken {
+	return NewUserOperationTokenInStore(NewSQLStore(db), user, tokenType, time.Now().Add(TokenDefaultExpiry))
+}
+
+// NewUserOperationTokenInStore creates a token, not yet inserted, backed by
+// any TokenStore
+func NewUserOperationTokenInStore(store TokenStore, user uuid.UUID, tokenType Token, expires time.Time) *UserOperationToken {
 	return &UserOperationToken{
 		ID:        uuid.New(),
 		UserID:    user,
 		TokenType: tokenType,
-		db:        db,
-		Expiry:    time.Now().Add(TokenDefaultExpiry).Unix(),
+		store:     store,
+		Expiry:    expires.Unix(),
 	}
-
 }
+
 func (u *UserOperationToken) TableName() string {
 	return userOpsTokenTblName
 }
@@ -68,75 +73,150 @@ func (u *UserOperationToken) scanInto(row *sql.Row) error {
 	return row.Scan(&u.ID, &u.UserID, &u.Expiry, &u.TokenType, &u.Used)
 }
 
-func (u *UserOperationToken) CreateTable() error {
-	_, err := u.db.Exec(userOpsTokenTblSQL)
-	return err
-}
 func (u *UserOperationToken) Insert() error {
-	query := fmt.Sprintf("INSERT INTO %s VALUES ($1, $2, $3, $4, $5)", u.TableName())
+	return u.store.InsertToken(context.Background(), u)
+}
 
-	stmt, err := u.db.Prepare(query)
+func GetUserOperationToken(db *sql.DB, token string) (*UserOperationToken, error) {
+	return NewSQLStore(db).GetToken(context.Background(), token)
+}
+
+func GetTokenIfValid(db *sql.DB, uid, token string) (*UserOperationToken, error) {
+	return NewSQLStore(db).GetTokenIfValid(context.Background(), uid, token)
+}
+
+// ConsumeToken atomically marks a valid, unused token of the given type as
+// used, returning the user it was issued to. sql.ErrNoRows is returned when
+// the token does not exist, has expired, was already used or is of a
+// different type.
+func ConsumeToken(db *sql.DB, tok string, tokenType Token) (uuid.UUID, error) {
+	return NewSQLStore(db).ConsumeToken(context.Background(), tok, tokenType)
+}
+
+// InvalidateUserTokens marks every outstanding token of the given type
+// belonging to the user as used.
+func InvalidateUserTokens(db *sql.DB, uid string, tokenType Token) error {
+	return NewSQLStore(db).InvalidateUserTokens(context.Background(), uid, tokenType)
+}
+
+func MarkTokenAsUsed(db *sql.DB, tok string) (uuid.UUID, error) {
+	return NewSQLStore(db).MarkTokenAsUsed(context.Background(), tok)
+}
+
+func (s *SQLStore) InsertToken(ctx context.Context, u *UserOperationToken) error {
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", userOpsTokenTblName, userOpsTokenColumns, placeholders(5))
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(u.ID, u.UserID.String(), u.Expiry, u.TokenType, u.Used)
+	_, err = stmt.ExecContext(ctx, u.ID.String(), u.UserID.String(), u.Expiry, u.TokenType, u.Used)
 	return err
 }
 
-func GetUserOperationToken(db *sql.DB, token string) (*UserOperationToken, error) {
-	u := UserOperationToken{db: db}
-	query := fmt.Sprintf("SELECT * from %s WHERE id = $1", u.TableName())
-	stmt, err := db.Prepare(query)
+func (s *SQLStore) GetToken(ctx context.Context, token string) (*UserOperationToken, error) {
+	u := UserOperationToken{store: s}
+	query := fmt.Sprintf("SELECT %s from %s WHERE id = $1", userOpsTokenColumns, userOpsTokenTblName)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return &u, err
 	}
-	res := stmt.QueryRow(token)
+	res := stmt.QueryRowContext(ctx, token)
 	if res.Err() != nil {
 		return &u, res.Err()
 	}
 	return &u, u.scanInto(res)
 }
 
-func GetTokenIfValid(db *sql.DB, uid, token string) (*UserOperationToken, error) {
-	u := UserOperationToken{db: db}
+func (s *SQLStore) GetTokenIfValid(ctx context.Context, uid, token string) (*UserOperationToken, error) {
+	u := UserOperationToken{store: s}
 	query := fmt.Sprintf(
-		`SELECT * from %s
+		`SELECT %s from %s
 		WHERE user_id = $1 AND
 		id = $2 AND
 		used = $3 AND
 		expiry >= $4
-		`, u.TableName())
+		`, userOpsTokenColumns, userOpsTokenTblName)
 	now := time.Now().Unix()
 
-	stmt, err := db.Prepare(query)
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
 		return &u, err
 	}
-	res := stmt.QueryRow(uid, token, false, now)
+	res := stmt.QueryRowContext(ctx, uid, token, false, now)
 	if res.Err() != nil {
 		return &u, res.Err()
 	}
 	return &u, u.scanInto(res)
 }
 
-func MarkTokenAsUsed(db *sql.DB, tok string) (uuid.UUID, error) {
-	u := UserOperationToken{db: db}
+// updateToken runs an update matching at most one token, returning the user
+// the token was issued to. Dialects without RETURNING follow the update with
+// a select, which is safe since a token's user never changes. When
+// requireRow is set, an update that matched nothing returns sql.ErrNoRows.
+func (s *SQLStore) updateToken(ctx context.Context, tok string, requireRow bool, query string, args ...any) (uuid.UUID, error) {
+	var uid uuid.UUID
+	if s.dialect.SupportsReturning() {
+		stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query+" RETURNING user_id"))
+		if err != nil {
+			return uuid.Nil, err
+		}
+		res := stmt.QueryRowContext(ctx, args...)
+		if res.Err() != nil {
+			return uuid.Nil, res.Err()
+		}
+		err = res.Scan(&uid)
+		return uid, err
+	}
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if rows, _ := res.RowsAffected(); requireRow && rows == 0 {
+		return uuid.Nil, sql.ErrNoRows
+	}
+
+	query = fmt.Sprintf("SELECT user_id from %s WHERE id = $1", userOpsTokenTblName)
+	err = s.db.QueryRowContext(ctx, s.dialect.Rebind(query), tok).Scan(&uid)
+	return uid, err
+}
+
+func (s *SQLStore) ConsumeToken(ctx context.Context, tok string, tokenType Token) (uuid.UUID, error) {
 	query := fmt.Sprintf(`
 		UPDATE %s SET used = $1
 		WHERE
-		id = $2
-		RETURNING user_id`, u.TableName())
+		id = $2 AND
+		token_type = $3 AND
+		used = $4 AND
+		expiry >= $5`, userOpsTokenTblName)
 
-	stmt, err := u.db.Prepare(query)
+	return s.updateToken(ctx, tok, true, query, true, tok, tokenType, false, time.Now().Unix())
+}
+
+func (s *SQLStore) InvalidateUserTokens(ctx context.Context, uid string, tokenType Token) error {
+	query := fmt.Sprintf(
+		"UPDATE %s SET used = $1 WHERE user_id = $2 AND token_type = $3 AND used = $4", userOpsTokenTblName)
+
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.Rebind(query))
 	if err != nil {
-		return uuid.Nil, err
+		return err
 	}
+	_, err = stmt.ExecContext(ctx, true, uid, tokenType, false)
+	return err
+}
 
-	res := stmt.QueryRow(true, tok)
-	if res.Err() != nil {
-		return uuid.Nil, res.Err()
-	}
-	var uid uuid.UUID
-	err = res.Scan(&uid)
-	return uid, err
+// MarkTokenAsUsed marks the token used whatever its type, state or expiry.
+// Use ConsumeToken to check them.
+func (s *SQLStore) MarkTokenAsUsed(ctx context.Context, tok string) (uuid.UUID, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s SET used = $1
+		WHERE
+		id = $2`, userOpsTokenTblName)
+
+	return s.updateToken(ctx, tok, false, query, true, tok)
 }
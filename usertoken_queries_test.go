@@ -1,6 +1,8 @@
 package usermod_test
 
 import (
+	"time"
+
 	"github.com/chayim/usermod"
 	"github.com/stretchr/testify/assert"
 )
@@ -43,3 +45,39 @@ func (s *UserModTestSuite) TestUOTMarkTokenAsUsed() {
 	res, _ := usermod.GetUserOperationToken(s.db, u.ID.String())
 	assert.Equal(s.T(), res.Used, true)
 }
+
+func (s *UserModTestSuite) TestUOTConsumeToken() {
+	user := s.newUser()
+	u := s.newUserOperationsToken(user)
+
+	_, err := usermod.ConsumeToken(s.db, u.ID.String(), usermod.ActivationToken)
+	assert.NotNil(s.T(), err)
+
+	uid, err := usermod.ConsumeToken(s.db, u.ID.String(), usermod.ForgotPaswordToken)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.ID, uid)
+
+	_, err = usermod.ConsumeToken(s.db, u.ID.String(), usermod.ForgotPaswordToken)
+	assert.NotNil(s.T(), err)
+
+	expired := usermod.NewUserOperationTokenWithExpires(s.db, user.ID,
+		usermod.ForgotPaswordToken, time.Now().Add(-time.Minute))
+	assert.Nil(s.T(), expired.Insert())
+	_, err = usermod.ConsumeToken(s.db, expired.ID.String(), usermod.ForgotPaswordToken)
+	assert.NotNil(s.T(), err)
+}
+
+func (s *UserModTestSuite) TestUOTInvalidateUserTokens() {
+	user := s.newUser()
+	reset := s.newUserOperationsToken(user)
+	activation := usermod.NewUserOperationTokenDefaultExpires(s.db, user.ID, usermod.ActivationToken)
+	assert.Nil(s.T(), activation.Insert())
+
+	err := usermod.InvalidateUserTokens(s.db, user.ID.String(), usermod.ForgotPaswordToken)
+	assert.Nil(s.T(), err)
+
+	res, _ := usermod.GetUserOperationToken(s.db, reset.ID.String())
+	assert.True(s.T(), res.Used)
+	res, _ = usermod.GetUserOperationToken(s.db, activation.ID.String())
+	assert.False(s.T(), res.Used)
+}
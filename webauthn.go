@@ -0,0 +1,319 @@
+package usermod
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrWebAuthnInvalid = errors.New("invalid webauthn response")
+var ErrWebAuthnUnsupportedKey = errors.New("unsupported webauthn public key")
+
+// WebAuthnChallengeExpiry is how long a ceremony may take to complete
+var WebAuthnChallengeExpiry = time.Minute * 5
+
+var webAuthnCredentialTblName = "webauthn_credentials"
+
+// COSE algorithm identifiers
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// WebAuthnConfig identifies the relying party, which is the application
+// usermod is mounted in. RPID is its domain, and Origins are the exact
+// origins, such as https://example.com, that ceremonies may run on.
+type WebAuthnConfig struct {
+	RPID                    string
+	RPName                  string
+	Origins                 []string
+	RequireUserVerification bool
+	// decoyKey derives the credentials offered for emails without any
+	decoyKey [32]byte
+}
+
+// decoyCredentials stands in for the credentials of an email without any.
+// Its id is derived from the email, so that asking twice gives the same
+// answer, as it would for real credentials.
+func (c *WebAuthnConfig) decoyCredentials(email string) []WebAuthnDescriptor {
+	mac := hmac.New(sha256.New, c.decoyKey[:])
+	mac.Write([]byte(strings.ToLower(email)))
+	return []WebAuthnDescriptor{{Type: "public-key", ID: b64url.EncodeToString(mac.Sum(nil))}}
+}
+
+// WebAuthnCredential is a public key registered by an authenticator.
+// Attestation statements are not verified, so any authenticator is trusted.
+type WebAuthnCredential struct {
+	ID        string
+	UserID    uuid.UUID
+	PublicKey []byte
+	SignCount uint32
+	Created   int64
+}
+
+// WebAuthnStore persists WebAuthn credentials. IDs are the base64url
+// encoded credential ids chosen by the authenticator.
+type WebAuthnStore interface {
+	InsertWebAuthnCredential(ctx context.Context, c *WebAuthnCredential) error
+	GetWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error)
+	GetUserWebAuthnCredentials(ctx context.Context, uid string) ([]*WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(ctx context.Context, id string, count uint32) error
+}
+
+var b64url = base64.RawURLEncoding
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// parseClientData checks the ceremony type and origin, returning the
+// challenge for the caller to match.
+func (c *WebAuthnConfig) parseClientData(raw []byte, ceremony string) ([]byte, error) {
+	cd := clientData{}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	if cd.Type != ceremony {
+		return nil, ErrWebAuthnInvalid
+	}
+	allowed := false
+	for _, o := range c.Origins {
+		allowed = allowed || o == cd.Origin
+	}
+	if !allowed {
+		return nil, ErrWebAuthnInvalid
+	}
+	return b64url.DecodeString(cd.Challenge)
+}
+
+// parseAuthenticatorData also checks the relying party and user flags
+func (c *WebAuthnConfig) parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad := authenticatorData{RPIDHash: b[:32], Flags: b[32], SignCount: binary.BigEndian.Uint32(b[33:37])}
+
+	rpHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(ad.RPIDHash, rpHash[:]) {
+		return nil, ErrWebAuthnInvalid
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return nil, ErrWebAuthnInvalid
+	}
+	if c.RequireUserVerification && ad.Flags&flagUserVerified == 0 {
+		return nil, ErrWebAuthnInvalid
+	}
+
+	if ad.Flags&flagAttestedCredData != 0 {
+		// aaguid, then the length prefixed credential id and its cose key
+		rest := b[37:]
+		if len(rest) < 18 {
+			return nil, ErrWebAuthnInvalid
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, ErrWebAuthnInvalid
+		}
+		ad.CredentialID = rest[:n]
+		_, after, err := cborDecode(rest[n:])
+		if err != nil {
+			return nil, ErrWebAuthnInvalid
+		}
+		ad.PublicKey = rest[n : len(rest)-len(after)]
+	}
+	return &ad, nil
+}
+
+// parseAttestation returns the authenticator data of a registration,
+// which must carry a new credential with a supported key.
+func (c *WebAuthnConfig) parseAttestation(attestationObject []byte) (*authenticatorData, error) {
+	obj, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	m, ok := obj.(map[any]any)
+	if !ok {
+		return nil, ErrWebAuthnInvalid
+	}
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad, err := c.parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(ad.CredentialID) == 0 {
+		return nil, ErrWebAuthnInvalid
+	}
+	if _, _, err = parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// parseCOSEKey supports ES256, EdDSA (Ed25519) and RS256 keys
+func parseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	obj, _, err := cborDecode(b)
+	if err != nil {
+		return nil, 0, ErrWebAuthnInvalid
+	}
+	m, ok := obj.(map[any]any)
+	if !ok {
+		return nil, 0, ErrWebAuthnInvalid
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	y, _ := m[int64(-3)].([]byte)
+
+	switch {
+	case kty == 2 && alg == coseES256 && crv == 1 && len(x) == 32 && len(y) == 32:
+		// ecdh rejects points that aren't on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, 0, ErrWebAuthnUnsupportedKey
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, alg, nil
+	case kty == 1 && alg == coseEdDSA && crv == 6 && len(x) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrWebAuthnUnsupportedKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, ErrWebAuthnUnsupportedKey
+}
+
+// verifyAssertion checks the signature over the authenticator data and
+// client data hash.
+func verifyAssertion(coseKey, authData, clientDataJSON, sig []byte) error {
+	pub, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), hash[:]...)
+	digest := sha256.Sum256(signed)
+
+	ok := false
+	switch alg {
+	case coseES256:
+		ok = ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig)
+	case coseEdDSA:
+		ok = ed25519.Verify(pub.(ed25519.PublicKey), signed, sig)
+	case coseRS256:
+		ok = rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return ErrWebAuthnInvalid
+	}
+	return nil
+}
+
+// checkSignCount rejects a counter that didn't move forward, which
+// suggests a cloned authenticator. Authenticators without a counter
+// always report zero.
+func checkSignCount(stored, received uint32) error {
+	if (stored != 0 || received != 0) && received <= stored {
+		return ErrWebAuthnInvalid
+	}
+	return nil
+}
+
+func (s *SQLStore) InsertWebAuthnCredential(ctx context.Context, c *WebAuthnCredential) error {
+	query := fmt.Sprintf("INSERT INTO %s (id, user_id, public_key, sign_count, created) VALUES ($1, $2, $3, $4, $5)",
+		webAuthnCredentialTblName)
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), c.ID, c.UserID.String(), c.PublicKey, c.SignCount, c.Created)
+	return err
+}
+
+func (s *SQLStore) GetWebAuthnCredential(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	query := fmt.Sprintf("SELECT id, user_id, public_key, sign_count, created FROM %s WHERE id = $1",
+		webAuthnCredentialTblName)
+	c := WebAuthnCredential{}
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind(query), id).
+		Scan(&c.ID, &c.UserID, &c.PublicKey, &c.SignCount, &c.Created)
+	return &c, err
+}
+
+func (s *SQLStore) GetUserWebAuthnCredentials(ctx context.Context, uid string) ([]*WebAuthnCredential, error) {
+	query := fmt.Sprintf("SELECT id, user_id, public_key, sign_count, created FROM %s WHERE user_id = $1 ORDER BY created",
+		webAuthnCredentialTblName)
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creds := []*WebAuthnCredential{}
+	for rows.Next() {
+		c := WebAuthnCredential{}
+		if err = rows.Scan(&c.ID, &c.UserID, &c.PublicKey, &c.SignCount, &c.Created); err != nil {
+			return nil, err
+		}
+		creds = append(creds, &c)
+	}
+	return creds, rows.Err()
+}
+
+// UpdateWebAuthnSignCount only moves the counter forward, so that two
+// concurrent assertions with the same counter can't both succeed.
+// sql.ErrNoRows is returned when the counter wasn't updated.
+func (s *SQLStore) UpdateWebAuthnSignCount(ctx context.Context, id string, count uint32) error {
+	query := fmt.Sprintf("UPDATE %s SET sign_count = $1 WHERE id = $2 AND sign_count < $3",
+		webAuthnCredentialTblName)
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind(query), count, id, count)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
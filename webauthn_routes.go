@@ -0,0 +1,325 @@
+package usermod
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The JSON types below mirror the browser's PublicKeyCredential API, with
+// binary values base64url encoded.
+
+type WebAuthnRP struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type WebAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type WebAuthnCreationOptions struct {
+	Challenge          string               `json:"challenge"`
+	RP                 WebAuthnRP           `json:"rp"`
+	User               WebAuthnUser         `json:"user"`
+	PubKeyCredParams   []WebAuthnParam      `json:"pubKeyCredParams"`
+	Timeout            int64                `json:"timeout"`
+	ExcludeCredentials []WebAuthnDescriptor `json:"excludeCredentials"`
+	Attestation        string               `json:"attestation"`
+}
+
+type WebAuthnRequestOptions struct {
+	Challenge        string               `json:"challenge"`
+	RPID             string               `json:"rpId"`
+	AllowCredentials []WebAuthnDescriptor `json:"allowCredentials"`
+	Timeout          int64                `json:"timeout"`
+	UserVerification string               `json:"userVerification"`
+}
+
+type WebAuthnCreationJSON struct {
+	PublicKey WebAuthnCreationOptions `json:"publicKey"`
+}
+
+type WebAuthnRequestJSON struct {
+	PublicKey WebAuthnRequestOptions `json:"publicKey"`
+}
+
+type WebAuthnResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+// WebAuthnCredentialJSON is the credential returned by
+// navigator.credentials.create or get
+type WebAuthnCredentialJSON struct {
+	ID       string           `json:"id"`
+	RawID    string           `json:"rawId"`
+	Type     string           `json:"type"`
+	Response WebAuthnResponse `json:"response"`
+}
+
+type WebAuthnLoginJSON struct {
+	Email string `json:"email"`
+}
+
+var webAuthnParams = []WebAuthnParam{
+	{Type: "public-key", Alg: coseES256},
+	{Type: "public-key", Alg: coseEdDSA},
+	{Type: "public-key", Alg: coseRS256},
+}
+
+// credential ids are stored in a VARCHAR(255) column
+const maxWebAuthnCredentialID = 255
+
+// newChallenge issues a single use challenge for the ceremony, as a user
+// operation token whose id is the challenge
+func (rr *Router) newChallenge(u *User, tokenType Token) (*UserOperationToken, error) {
+	uot := NewUserOperationTokenInStore(rr.store, u.ID, tokenType, time.Now().Add(WebAuthnChallengeExpiry))
+	return uot, uot.Insert()
+}
+
+// consumeChallenge returns the user the challenge was issued to
+func (rr *Router) consumeChallenge(r *http.Request, challenge []byte, tokenType Token) (uuid.UUID, error) {
+	id, err := uuid.FromBytes(challenge)
+	if err != nil {
+		return uuid.Nil, ErrWebAuthnInvalid
+	}
+	uid, err := rr.store.ConsumeToken(r.Context(), id.String(), tokenType)
+	if err != nil {
+		return uuid.Nil, ErrWebAuthnInvalid
+	}
+	return uid, nil
+}
+
+func (rr *Router) credentialDescriptors(r *http.Request, u *User) ([]WebAuthnDescriptor, error) {
+	creds, err := rr.store.GetUserWebAuthnCredentials(r.Context(), u.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	descriptors := []WebAuthnDescriptor{}
+	for _, c := range creds {
+		descriptors = append(descriptors, WebAuthnDescriptor{Type: "public-key", ID: c.ID})
+	}
+	return descriptors, nil
+}
+
+func readWebAuthnCredential(r *http.Request) (*WebAuthnCredentialJSON, error) {
+	c := WebAuthnCredentialJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(bytes, &c); err != nil {
+		return nil, err
+	}
+	if c.Type != "public-key" {
+		return nil, ErrWebAuthnInvalid
+	}
+	return &c, nil
+}
+
+// BeginWebAuthnRegistration returns the options for
+// navigator.credentials.create, for the logged in user
+func (rr *Router) BeginWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+
+	exclude, err := rr.credentialDescriptors(r, u)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	uot, err := rr.newChallenge(u, WebAuthnRegistrationToken)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, WebAuthnCreationJSON{PublicKey: WebAuthnCreationOptions{
+		Challenge:          b64url.EncodeToString(uot.ID[:]),
+		RP:                 WebAuthnRP{ID: rr.webAuthn.RPID, Name: rr.webAuthn.RPName},
+		User:               WebAuthnUser{ID: b64url.EncodeToString(u.ID[:]), Name: u.Email, DisplayName: u.Name},
+		PubKeyCredParams:   webAuthnParams,
+		Timeout:            WebAuthnChallengeExpiry.Milliseconds(),
+		ExcludeCredentials: exclude,
+		Attestation:        "none",
+	}})
+}
+
+// FinishWebAuthnRegistration verifies the new credential and stores it
+func (rr *Router) FinishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	u := r.Context().Value(CTX_USER_KEY).(*User)
+
+	c, err := readWebAuthnCredential(r)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	clientDataJSON, err1 := b64url.DecodeString(c.Response.ClientDataJSON)
+	attestation, err2 := b64url.DecodeString(c.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		jsonError(w, ErrWebAuthnInvalid, http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := rr.webAuthn.parseClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	uid, err := rr.consumeChallenge(r, challenge, WebAuthnRegistrationToken)
+	if err != nil || uid != u.ID {
+		jsonError(w, ErrWebAuthnInvalid, http.StatusUnauthorized)
+		return
+	}
+	ad, err := rr.webAuthn.parseAttestation(attestation)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	id := b64url.EncodeToString(ad.CredentialID)
+	if len(id) > maxWebAuthnCredentialID {
+		jsonError(w, ErrWebAuthnInvalid, http.StatusBadRequest)
+		return
+	}
+	if _, err = rr.store.GetWebAuthnCredential(r.Context(), id); err == nil {
+		jsonErrorFromString(w, "credential already registered", http.StatusConflict)
+		return
+	}
+	cred := WebAuthnCredential{
+		ID:        id,
+		UserID:    u.ID,
+		PublicKey: ad.PublicKey,
+		SignCount: ad.SignCount,
+		Created:   time.Now().Unix(),
+	}
+	err = rr.store.InsertWebAuthnCredential(r.Context(), &cred)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// BeginWebAuthnLogin returns the options for navigator.credentials.get,
+// allowing the credentials registered to the user. Unknown emails, and
+// users without credentials, are offered a decoy in the same shape, so that
+// the response tells neither apart.
+func (rr *Router) BeginWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	l := WebAuthnLoginJSON{}
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = json.Unmarshal(bytes, &l)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var allow []WebAuthnDescriptor
+	u, err := rr.store.GetActiveUserByEmail(r.Context(), l.Email)
+	if err == nil && u.IsActive() {
+		if allow, err = rr.credentialDescriptors(r, u); err != nil {
+			jsonError(w, err, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		// the challenge is issued to nobody, so that it can't be finished
+		u = &User{ID: uuid.New()}
+	}
+	if len(allow) == 0 {
+		allow = rr.webAuthn.decoyCredentials(l.Email)
+	}
+	uot, err := rr.newChallenge(u, WebAuthnLoginToken)
+	if err != nil {
+		jsonError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	verification := "preferred"
+	if rr.webAuthn.RequireUserVerification {
+		verification = "required"
+	}
+	writeJSON(w, WebAuthnRequestJSON{PublicKey: WebAuthnRequestOptions{
+		Challenge:        b64url.EncodeToString(uot.ID[:]),
+		RPID:             rr.webAuthn.RPID,
+		AllowCredentials: allow,
+		Timeout:          WebAuthnChallengeExpiry.Milliseconds(),
+		UserVerification: verification,
+	}})
+}
+
+// FinishWebAuthnLogin verifies the assertion and logs the user in, the
+// same as Login
+func (rr *Router) FinishWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	c, err := readWebAuthnCredential(r)
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	clientDataJSON, err1 := b64url.DecodeString(c.Response.ClientDataJSON)
+	authData, err2 := b64url.DecodeString(c.Response.AuthenticatorData)
+	sig, err3 := b64url.DecodeString(c.Response.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		jsonError(w, ErrWebAuthnInvalid, http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := rr.webAuthn.parseClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		jsonError(w, err, http.StatusBadRequest)
+		return
+	}
+	uid, err := rr.consumeChallenge(r, challenge, WebAuthnLoginToken)
+	if err != nil {
+		jsonError(w, err, http.StatusUnauthorized)
+		return
+	}
+	cred, err := rr.store.GetWebAuthnCredential(r.Context(), c.RawID)
+	if err != nil || cred.UserID != uid {
+		jsonError(w, ErrWebAuthnInvalid, http.StatusUnauthorized)
+		return
+	}
+
+	ad, err := rr.webAuthn.parseAuthenticatorData(authData)
+	if err == nil {
+		err = verifyAssertion(cred.PublicKey, authData, clientDataJSON, sig)
+	}
+	if err == nil {
+		err = checkSignCount(cred.SignCount, ad.SignCount)
+	}
+	if err == nil && ad.SignCount != 0 {
+		err = rr.store.UpdateWebAuthnSignCount(r.Context(), cred.ID, ad.SignCount)
+	}
+	if err != nil {
+		jsonError(w, ErrWebAuthnInvalid, http.StatusUnauthorized)
+		return
+	}
+
+	u, err := rr.store.GetUserByID(r.Context(), uid.String())
+	if err != nil || !u.IsActive() {
+		jsonErrorFromString(w, "invalid user", http.StatusForbidden)
+		return
+	}
+	rr.startSession(w, r, u)
+}
@@ -0,0 +1,274 @@
+package usermod_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/chayim/usermod"
+	"github.com/stretchr/testify/assert"
+)
+
+var testWebAuthn = usermod.WebAuthnConfig{
+	RPID:    "localhost",
+	RPName:  "usermod",
+	Origins: []string{"https://localhost"},
+}
+
+var b64url = base64.RawURLEncoding
+
+// cborPair keeps map entries in the order they are encoded
+type cborPair struct {
+	key   any
+	value any
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+}
+
+// cborEncode handles the few types the software authenticator needs
+func cborEncode(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []cborPair:
+		b := cborHead(5, uint64(len(v)))
+		for _, p := range v {
+			b = append(b, cborEncode(p.key)...)
+			b = append(b, cborEncode(p.value)...)
+		}
+		return b
+	}
+	panic("unsupported cbor type")
+}
+
+// softAuthenticator is an ES256 authenticator holding a single credential
+type softAuthenticator struct {
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator() *softAuthenticator {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	id := make([]byte, 32)
+	rand.Read(id)
+	return &softAuthenticator{origin: testWebAuthn.Origins[0], key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	return b
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte, extra []byte) []byte {
+	rpHash := sha256.Sum256([]byte(rpID))
+	b := append(rpHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, a.signCount)
+	return append(b, extra...)
+}
+
+func (a *softAuthenticator) create(opts usermod.WebAuthnCreationOptions) usermod.WebAuthnCredentialJSON {
+	coseKey := cborEncode([]cborPair{
+		{1, 2}, {3, -7}, {-1, 1},
+		{-2, a.key.X.FillBytes(make([]byte, 32))},
+		{-3, a.key.Y.FillBytes(make([]byte, 32))},
+	})
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), coseKey...)
+
+	attestation := cborEncode([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(opts.RP.ID, 0x41, attested)},
+	})
+	return usermod.WebAuthnCredentialJSON{
+		ID:    b64url.EncodeToString(a.credentialID),
+		RawID: b64url.EncodeToString(a.credentialID),
+		Type:  "public-key",
+		Response: usermod.WebAuthnResponse{
+			ClientDataJSON:    b64url.EncodeToString(a.clientData("webauthn.create", opts.Challenge)),
+			AttestationObject: b64url.EncodeToString(attestation),
+		},
+	}
+}
+
+func (a *softAuthenticator) get(opts usermod.WebAuthnRequestOptions) usermod.WebAuthnCredentialJSON {
+	a.signCount++
+	authData := a.authData(opts.RPID, 0x01, nil)
+	clientData := a.clientData("webauthn.get", opts.Challenge)
+	hash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	return usermod.WebAuthnCredentialJSON{
+		ID:    b64url.EncodeToString(a.credentialID),
+		RawID: b64url.EncodeToString(a.credentialID),
+		Type:  "public-key",
+		Response: usermod.WebAuthnResponse{
+			ClientDataJSON:    b64url.EncodeToString(clientData),
+			AuthenticatorData: b64url.EncodeToString(authData),
+			Signature:         b64url.EncodeToString(sig),
+		},
+	}
+}
+
+func (s *UserModTestSuite) webAuthnPost(path, token string, body any, out any) int {
+	b, _ := json.Marshal(body)
+	r, _ := http.NewRequest(http.MethodPost, s.ts.URL+"/api/webauthn"+path, bytes.NewReader(b))
+	if token != "" {
+		r.Header.Add("Authorization", "Bearer "+token)
+	}
+	w, _ := http.DefaultClient.Do(r)
+	if out != nil && w.StatusCode == http.StatusOK {
+		assert.Nil(s.T(), json.NewDecoder(w.Body).Decode(out))
+	}
+	return w.StatusCode
+}
+
+func (s *UserModTestSuite) registerPasskey(token string, a *softAuthenticator) int {
+	opts := usermod.WebAuthnCreationJSON{}
+	assert.Equal(s.T(), http.StatusOK, s.webAuthnPost("/register/begin", token, nil, &opts))
+	return s.webAuthnPost("/register/finish", token, a.create(opts.PublicKey), nil)
+}
+
+func (s *UserModTestSuite) beginPasskeyLogin(u *usermod.User) usermod.WebAuthnRequestOptions {
+	opts := usermod.WebAuthnRequestJSON{}
+	assert.Equal(s.T(), http.StatusOK, s.webAuthnPost("/login/begin", "", usermod.WebAuthnLoginJSON{Email: u.Email}, &opts))
+	return opts.PublicKey
+}
+
+func (s *UserModTestSuite) TestWebAuthnRegisterAndLogin() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	a := newSoftAuthenticator()
+
+	// nothing to log in with yet, which looks the same as an unknown email
+	decoy := s.beginPasskeyLogin(u)
+	assert.Len(s.T(), decoy.AllowCredentials, 1)
+	assert.Equal(s.T(), decoy.AllowCredentials, s.beginPasskeyLogin(u).AllowCredentials)
+	unknown := s.beginPasskeyLogin(&usermod.User{Email: "nobody@ummmfoo.com"})
+	assert.Len(s.T(), unknown.AllowCredentials, 1)
+	assert.NotEqual(s.T(), decoy.AllowCredentials, unknown.AllowCredentials)
+	assert.NotEqual(s.T(), "", unknown.Challenge)
+	assert.Equal(s.T(), http.StatusUnauthorized, s.webAuthnPost("/login/finish", "", a.get(unknown), nil))
+
+	assert.Equal(s.T(), http.StatusUnauthorized, s.webAuthnPost("/register/begin", "", nil, nil))
+	assert.Equal(s.T(), http.StatusCreated, s.registerPasskey(token, a))
+	assert.Equal(s.T(), http.StatusConflict, s.registerPasskey(token, a))
+
+	opts := s.beginPasskeyLogin(u)
+	assert.Equal(s.T(), "localhost", opts.RPID)
+	assert.Len(s.T(), opts.AllowCredentials, 1)
+	assert.Equal(s.T(), b64url.EncodeToString(a.credentialID), opts.AllowCredentials[0].ID)
+
+	assertion := a.get(opts)
+	tok := usermod.TokenJSON{}
+	assert.Equal(s.T(), http.StatusOK, s.webAuthnPost("/login/finish", "", assertion, &tok))
+	assert.NotEqual(s.T(), "", tok.Token)
+	assert.NotEqual(s.T(), "", tok.RefreshToken)
+
+	r, _ := http.NewRequest(http.MethodGet, s.ts.URL+"/auth2", nil)
+	r.Header.Add("Authorization", "Bearer "+tok.Token)
+	w, _ := http.DefaultClient.Do(r)
+	assert.Equal(s.T(), http.StatusOK, w.StatusCode)
+
+	// challenges are single use
+	assert.Equal(s.T(), http.StatusUnauthorized, s.webAuthnPost("/login/finish", "", assertion, nil))
+
+	// a counter that goes backwards suggests a cloned authenticator
+	a.signCount = 0
+	assert.Equal(s.T(), http.StatusUnauthorized, s.webAuthnPost("/login/finish", "", a.get(s.beginPasskeyLogin(u)), nil))
+	a.signCount = 10
+	assert.Equal(s.T(), http.StatusOK, s.webAuthnPost("/login/finish", "", a.get(s.beginPasskeyLogin(u)), nil))
+}
+
+func (s *UserModTestSuite) TestWebAuthnRejectsBadResponses() {
+	u := s.newActivatedUser()
+	token := s.login(u, testPassword)
+	a := newSoftAuthenticator()
+	assert.Equal(s.T(), http.StatusCreated, s.registerPasskey(token, a))
+
+	tests := []struct {
+		name       string
+		tamper     func(opts *usermod.WebAuthnRequestOptions, a *softAuthenticator)
+		modify     func(c *usermod.WebAuthnCredentialJSON)
+		statusCode int
+	}{{
+		name:       "wrong origin",
+		tamper:     func(opts *usermod.WebAuthnRequestOptions, a *softAuthenticator) { a.origin = "https://evil.com" },
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "wrong relying party",
+		tamper:     func(opts *usermod.WebAuthnRequestOptions, a *softAuthenticator) { opts.RPID = "evil.com" },
+		statusCode: http.StatusUnauthorized,
+	}, {
+		name: "other key",
+		tamper: func(opts *usermod.WebAuthnRequestOptions, a *softAuthenticator) {
+			a.key = newSoftAuthenticator().key
+		},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		name:   "unknown credential",
+		tamper: func(opts *usermod.WebAuthnRequestOptions, a *softAuthenticator) {},
+		modify: func(c *usermod.WebAuthnCredentialJSON) {
+			c.RawID = b64url.EncodeToString([]byte("unknown"))
+		},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		name: "unknown challenge",
+		tamper: func(opts *usermod.WebAuthnRequestOptions, a *softAuthenticator) {
+			opts.Challenge = b64url.EncodeToString(make([]byte, 16))
+		},
+		statusCode: http.StatusUnauthorized,
+	}}
+	for _, tt := range tests {
+		s.T().Run(tt.name, func(t *testing.T) {
+			tampered := *a
+			opts := s.beginPasskeyLogin(u)
+			tt.tamper(&opts, &tampered)
+			c := tampered.get(opts)
+			if tt.modify != nil {
+				tt.modify(&c)
+			}
+			assert.Equal(t, tt.statusCode, s.webAuthnPost("/login/finish", "", c, nil))
+		})
+	}
+
+	// a registration challenge can't be used to log in
+	reg := usermod.WebAuthnCreationJSON{}
+	assert.Equal(s.T(), http.StatusOK, s.webAuthnPost("/register/begin", token, nil, &reg))
+	c := a.get(usermod.WebAuthnRequestOptions{Challenge: reg.PublicKey.Challenge, RPID: "localhost"})
+	assert.Equal(s.T(), http.StatusUnauthorized, s.webAuthnPost("/login/finish", "", c, nil))
+
+	// a malformed attestation is rejected
+	other := newSoftAuthenticator()
+	assert.Equal(s.T(), http.StatusOK, s.webAuthnPost("/register/begin", token, nil, &reg))
+	c = other.create(reg.PublicKey)
+	c.Response.AttestationObject = b64url.EncodeToString([]byte{0xbf, 0x00})
+	assert.Equal(s.T(), http.StatusBadRequest, s.webAuthnPost("/register/finish", token, c, nil))
+}